@@ -9,5 +9,6 @@ Dependencies
 
     go get github.com/aws/aws-sdk-go
     go get github.com/hashicorp/go-multierror
+    go get golang.org/x/crypto/ssh
 */
 package cloudflow
@@ -0,0 +1,63 @@
+package cloudflow
+
+import (
+	"context"
+	"sync"
+)
+
+// Params are parameters of a workflow run shared by tasks through context.
+// Tasks read parameters, and can set parameters for later tasks.
+type Params struct {
+	mu     sync.RWMutex
+	values map[string]string
+}
+
+// NewParams creates parameters with initial values.
+func NewParams(values map[string]string) *Params {
+	p := &Params{values: make(map[string]string, len(values))}
+	for name, value := range values {
+		p.values[name] = value
+	}
+	return p
+}
+
+// Get returns the parameter value and whether it is set.
+// Get on nil Params returns no value.
+func (p *Params) Get(name string) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	value, ok := p.values[name]
+	return value, ok
+}
+
+// Set sets the parameter value.
+func (p *Params) Set(name, value string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.values[name] = value
+}
+
+// setDefault sets the parameter value unless it is already set.
+func (p *Params) setDefault(name, value string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.values[name]; !ok {
+		p.values[name] = value
+	}
+}
+
+type paramsKey struct{}
+
+// WithParams returns a copy of ctx carrying params.
+func WithParams(ctx context.Context, params *Params) context.Context {
+	return context.WithValue(ctx, paramsKey{}, params)
+}
+
+// ParamsFromContext returns params carried by ctx, or nil.
+func ParamsFromContext(ctx context.Context) *Params {
+	params, _ := ctx.Value(paramsKey{}).(*Params)
+	return params
+}
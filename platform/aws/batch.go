@@ -1,80 +1,360 @@
 package aws
 
 import (
-	"time"
-
+	"context"
 	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/batch"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/hashicorp/go-multierror"
+	"github.com/yonekawa/cloudflow"
+	"github.com/yonekawa/cloudflow/task"
 )
 
 var defaultTimeout = 30 * time.Minute
 var defaultPollingTime = 30 * time.Second
+var defaultTerminateReason = "cloudflow: stopped by workflow"
+var defaultBatchLogGroupName = "/aws/batch/job"
 
 // BatchJobTask execute AWS Batch Job.
+//
+// The job is stopped when the task times out, polling the job status fails, the context is cancelled
+// or the process receives one of Signals, so it does not keep running in AWS Batch.
+// Jobs still in queue are cancelled, and started jobs are terminated.
+//
+// Status transitions of the jobs are logged, and polling backs off while DescribeJobs is throttled.
 type BatchJobTask struct {
 	Session        *session.Session
 	SubmitJobInput *batch.SubmitJobInput
 	PollingTime    time.Duration
 	Timeout        time.Duration
+
+	// TerminateReason is passed to TerminateJob and CancelJob.
+	TerminateReason string
+	// Signals stopping the job. Signals are handled only while the job is running,
+	// and the next signal is handled by the default behavior.
+	Signals []os.Signal
+
+	// Logger receives the job logs in CloudWatch Logs prefixed with the job name.
+	Logger *log.Logger
+	// LogGroupName is the log group of the job. Default is /aws/batch/job.
+	LogGroupName string
+	// LogTailLines is the number of the last log lines included in the error on failure.
+	LogTailLines int
+
+	// DependentJobs are submitted after SubmitJobInput, each depending on the previous job by DependsOn.
+	// AWS Batch runs the chain, and the task waits for all jobs.
+	DependentJobs []*batch.SubmitJobInput
+	// ArrayFailureTolerance is the number of failed children allowed for array jobs.
+	// AWS Batch still marks the array job FAILED, so dependent jobs do not run.
+	ArrayFailureTolerance int
+
+	// Overrides fills SubmitJobInput by workflow parameters. It is not applied to DependentJobs.
+	Overrides *BatchJobOverrides
+
+	// JobIDs is the submitted job ids.
+	JobIDs []string
+	// Results is the final state of the submitted jobs.
+	Results []*BatchJobResult
+}
+
+// BatchJobResult is the final state of a submitted job.
+type BatchJobResult struct {
+	JobID        string
+	JobName      string
+	Status       string
+	StatusReason string
+	// Attempts is the number of attempts, and LastAttempt is the final one.
+	Attempts    int
+	LastAttempt *batch.AttemptDetail
 }
 
 // NewBatchJobTask creates a AWS Batch Job task.
 func NewBatchJobTask(session *session.Session, input *batch.SubmitJobInput) *BatchJobTask {
 	return &BatchJobTask{
-		Session:        session,
-		SubmitJobInput: input,
-		PollingTime:    defaultPollingTime,
-		Timeout:        defaultTimeout,
+		Session:         session,
+		SubmitJobInput:  input,
+		PollingTime:     defaultPollingTime,
+		Timeout:         defaultTimeout,
+		TerminateReason: defaultTerminateReason,
+		Signals:         []os.Signal{os.Interrupt, syscall.SIGTERM},
+		LogTailLines:    defaultLogTailLines,
 	}
 }
 
+// SetLogger sets log writer.
+func (bjt *BatchJobTask) SetLogger(logger *log.Logger) {
+	bjt.Logger = logger
+}
+
 // Execute implement Task.Execute
 func (bjt *BatchJobTask) Execute() error {
-	completeChan := make(chan error)
+	return bjt.ExecuteContext(context.Background())
+}
 
-	go func() {
-		b := batch.New(bjt.Session)
-		submit, err := submitJob(b, bjt.SubmitJobInput)
+// ExecuteContext implement ContextTask.ExecuteContext.
+func (bjt *BatchJobTask) ExecuteContext(ctx context.Context) error {
+	b := batch.New(bjt.Session)
+	bjt.Results = nil
+	jobs, err := bjt.submitJobs(b, cloudflow.ParamsFromContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer bjt.setResults(jobs)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	received := bjt.notifySignals(ctx, cancel)
+
+	ids := make([]*string, len(jobs))
+	for i, job := range jobs {
+		ids[i] = aws.String(job.id)
+	}
+	throttle := newBatchThrottle(bjt.PollingTime)
+	// failed is set when a job failed, otherwise the jobs are abandoned when polling stops with error.
+	failed := false
+	sensor := task.NewSensorTask(func(ctx context.Context) (bool, error) {
+		describe, err := describeJobs(b, &batch.DescribeJobsInput{Jobs: ids})
+		if request.IsErrorThrottle(err) {
+			logf(bjt.Logger, "cloudflow: describing aws batch jobs is throttled: %v", err)
+			return false, throttle.wait(ctx)
+		}
 		if err != nil {
-			completeChan <- err
+			return false, err
+		}
+		throttle.reset()
+		details := make(map[string]*batch.JobDetail, len(describe.Jobs))
+		for _, detail := range describe.Jobs {
+			details[aws.StringValue(detail.JobId)] = detail
 		}
 
-		elapsed := 0 * time.Millisecond
-
-		for {
-			describe, err := describeJobs(b, &batch.DescribeJobsInput{Jobs: []*string{submit.JobId}})
-			if err != nil {
-				completeChan <- err
+		done := true
+		for _, job := range jobs {
+			detail, ok := details[job.id]
+			if !ok {
+				return false, fmt.Errorf("cloudflow: aws batch job:%v not found", job.id)
 			}
-
-			if len(describe.Jobs) == 0 {
-				completeChan <- fmt.Errorf("cloudflow: aws batch job:%v not found", submit.JobId)
-				break
+			if err := bjt.update(job, detail); err != nil {
+				failed = true
+				return false, err
 			}
+			done = done && job.succeeded
+		}
+		return done, nil
+	})
+	sensor.PollingTime = bjt.PollingTime
+	sensor.Timeout = bjt.Timeout
 
-			job := describe.Jobs[0]
-			switch *job.Status {
-			case "SUCCEEDED":
-				completeChan <- nil
-				break
-			case "FAILED":
-				completeChan <- fmt.Errorf("cloudflow: aws batch job id:%v failed by reason:%v", job.JobId, job.StatusReason)
-				break
-			default:
-				time.Sleep(bjt.PollingTime)
-				elapsed += bjt.PollingTime
-			}
+	err = sensor.ExecuteContext(ctx)
+	switch {
+	case err == task.ErrSensorTimeout:
+		return bjt.stopJobs(b, jobs, "timed out")
+	case err != nil && ctx.Err() != nil:
+		select {
+		case sig := <-received:
+			return bjt.stopJobs(b, jobs, fmt.Sprintf("received signal %v", sig))
+		default:
+			return bjt.stopJobs(b, jobs, "cancelled")
+		}
+	case err != nil && !failed:
+		return bjt.stopJobs(b, jobs, fmt.Sprintf("polling failed: %v", err))
+	}
+	return err
+}
+
+// batchJob is a submitted job tracked by BatchJobTask.
+type batchJob struct {
+	id        string
+	name      string
+	status    string
+	succeeded bool
+	logs      *logTail
+	detail    *batch.JobDetail
+}
 
-			if elapsed >= bjt.Timeout {
-				completeChan <- fmt.Errorf("cloudflow: aws batch job id:%v timed out", job.JobId)
-				break
+// submitJobs submits SubmitJobInput and DependentJobs, each depending on the previous job.
+// If submitting fails, the jobs already submitted are cancelled.
+func (bjt *BatchJobTask) submitJobs(b *batch.Batch, params *cloudflow.Params) ([]*batchJob, error) {
+	head := bjt.SubmitJobInput
+	if bjt.Overrides != nil {
+		var err error
+		if head, err = bjt.Overrides.apply(head, params); err != nil {
+			return nil, err
+		}
+	}
+	inputs := append([]*batch.SubmitJobInput{head}, bjt.DependentJobs...)
+	group := bjt.LogGroupName
+	if group == "" {
+		group = defaultBatchLogGroupName
+	}
+	bjt.JobIDs = nil
+	jobs := make([]*batchJob, 0, len(inputs))
+	for _, input := range inputs {
+		in := *input
+		if len(jobs) > 0 {
+			in.DependsOn = append(append([]*batch.JobDependency{}, input.DependsOn...), &batch.JobDependency{JobId: aws.String(jobs[len(jobs)-1].id)})
+		}
+		submit, err := submitJob(b, &in)
+		if err != nil {
+			if len(jobs) > 0 {
+				return nil, multierror.Append(err, bjt.stopJobs(b, jobs, "is abandoned since submitting dependent jobs failed"))
 			}
+			return nil, err
+		}
+
+		job := &batchJob{id: aws.StringValue(submit.JobId), name: aws.StringValue(submit.JobName), status: "SUBMITTED"}
+		job.logs = newLogTail(cloudwatchlogs.New(bjt.Session), group, job.name, bjt.Logger, bjt.LogTailLines)
+		jobs = append(jobs, job)
+		bjt.JobIDs = append(bjt.JobIDs, job.id)
+	}
+	return jobs, nil
+}
+
+// update applies the described job detail to the job, and returns error if the job failed.
+func (bjt *BatchJobTask) update(job *batchJob, detail *batch.JobDetail) error {
+	job.detail = detail
+	if status := aws.StringValue(detail.Status); status != job.status {
+		logf(bjt.Logger, "%s: aws batch job %v %v -> %v", job.name, job.id, job.status, status)
+		job.status = status
+	}
+	if detail.Container != nil {
+		job.logs.fetch(aws.StringValue(detail.Container.LogStreamName))
+	}
+	if job.status != "SUCCEEDED" && job.status != "FAILED" {
+		return nil
+	}
+
+	if detail.ArrayProperties != nil && detail.ArrayProperties.StatusSummary != nil {
+		size := aws.Int64Value(detail.ArrayProperties.Size)
+		succeeded := aws.Int64Value(detail.ArrayProperties.StatusSummary["SUCCEEDED"])
+		failed := aws.Int64Value(detail.ArrayProperties.StatusSummary["FAILED"])
+		logf(bjt.Logger, "%s: array job %v finished: %d succeeded, %d failed of %d", job.name, job.id, succeeded, failed, size)
+		if job.status == "FAILED" && failed > 0 && failed <= int64(bjt.ArrayFailureTolerance) {
+			job.succeeded = true
+			return nil
+		}
+		if job.status == "FAILED" {
+			return fmt.Errorf("cloudflow: aws batch array job id:%v failed: %d succeeded, %d failed of %d", job.id, succeeded, failed, size)
+		}
+	}
+
+	if job.status == "FAILED" {
+		return fmt.Errorf("cloudflow: aws batch job id:%v failed by reason:%v%s", job.id, aws.StringValue(detail.StatusReason), job.logs.tail())
+	}
+	job.succeeded = true
+	return nil
+}
+
+var maxBatchThrottleBackoff = 5 * time.Minute
+
+// batchThrottle waits longer each time DescribeJobs is throttled, in addition to the polling time.
+type batchThrottle struct {
+	initial time.Duration
+	backoff time.Duration
+}
+
+func newBatchThrottle(initial time.Duration) *batchThrottle {
+	if initial <= 0 {
+		initial = time.Second
+	}
+	return &batchThrottle{initial: initial}
+}
+
+func (bt *batchThrottle) wait(ctx context.Context) error {
+	if bt.backoff == 0 {
+		bt.backoff = bt.initial
+	} else if bt.backoff *= 2; bt.backoff > maxBatchThrottleBackoff {
+		bt.backoff = maxBatchThrottleBackoff
+	}
+
+	timer := time.NewTimer(bt.backoff)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (bt *batchThrottle) reset() {
+	bt.backoff = 0
+}
+
+// notifySignals calls cancel on the first signal until ctx is done,
+// and returns channel receiving the signal.
+func (bjt *BatchJobTask) notifySignals(ctx context.Context, cancel context.CancelFunc) <-chan os.Signal {
+	received := make(chan os.Signal, 1)
+	if len(bjt.Signals) == 0 {
+		return received
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, bjt.Signals...)
+	go func() {
+		defer signal.Stop(sigChan)
+		select {
+		case sig := <-sigChan:
+			received <- sig
+			cancel()
+		case <-ctx.Done():
 		}
 	}()
+	return received
+}
+
+func (bjt *BatchJobTask) setResults(jobs []*batchJob) {
+	bjt.Results = make([]*BatchJobResult, len(jobs))
+	for i, job := range jobs {
+		result := &BatchJobResult{JobID: job.id, JobName: job.name, Status: job.status}
+		if job.detail != nil {
+			result.StatusReason = aws.StringValue(job.detail.StatusReason)
+			result.Attempts = len(job.detail.Attempts)
+			if result.Attempts > 0 {
+				result.LastAttempt = job.detail.Attempts[result.Attempts-1]
+			}
+		}
+		bjt.Results[i] = result
+	}
+}
+
+// stopJobs cancels the jobs in queue and terminates the started jobs,
+// and returns error reporting why and whether the jobs were stopped.
+func (bjt *BatchJobTask) stopJobs(b *batch.Batch, jobs []*batchJob, cause string) error {
+	reason := bjt.TerminateReason
+	if reason == "" {
+		reason = defaultTerminateReason
+	}
 
-	return <-completeChan
+	var ids, errs []string
+	for _, job := range jobs {
+		var err error
+		switch job.status {
+		case "SUCCEEDED", "FAILED":
+			continue
+		case "SUBMITTED", "PENDING", "RUNNABLE":
+			_, err = cancelJob(b, &batch.CancelJobInput{JobId: aws.String(job.id), Reason: aws.String(reason)})
+		default:
+			_, err = terminateJob(b, &batch.TerminateJobInput{JobId: aws.String(job.id), Reason: aws.String(reason)})
+		}
+		ids = append(ids, job.id)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("cloudflow: aws batch job id:%v %s, and stopping the job failed: %v", strings.Join(ids, ","), cause, strings.Join(errs, "; "))
+	}
+	return fmt.Errorf("cloudflow: aws batch job id:%v %s, and the job was stopped", strings.Join(ids, ","), cause)
 }
 
 // for mock testing
@@ -84,3 +364,9 @@ var submitJob = func(b *batch.Batch, input *batch.SubmitJobInput) (*batch.Submit
 var describeJobs = func(b *batch.Batch, input *batch.DescribeJobsInput) (*batch.DescribeJobsOutput, error) {
 	return b.DescribeJobs(input)
 }
+var cancelJob = func(b *batch.Batch, input *batch.CancelJobInput) (*batch.CancelJobOutput, error) {
+	return b.CancelJob(input)
+}
+var terminateJob = func(b *batch.Batch, input *batch.TerminateJobInput) (*batch.TerminateJobOutput, error) {
+	return b.TerminateJob(input)
+}
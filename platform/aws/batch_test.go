@@ -1,13 +1,26 @@
 package aws
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"syscall"
 	"testing"
 
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/batch"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/yonekawa/cloudflow"
 )
 
 func TestBatchJobTask_Execute(t *testing.T) {
@@ -19,6 +32,14 @@ func TestBatchJobTask_Execute(t *testing.T) {
 	}
 	testBatchJobTaskSucceeded(t, sess)
 	testBatchJobTaskTimeout(t, sess)
+	testBatchJobTaskCancelled(t, sess)
+	testBatchJobTaskSignal(t, sess)
+	testBatchJobTaskPollingFailed(t, sess)
+	testBatchJobTaskLogs(t, sess)
+	testBatchJobTaskArray(t, sess)
+	testBatchJobTaskDependentJobs(t, sess)
+	testBatchJobTaskTransitions(t, sess)
+	testBatchJobTaskOverrides(t, sess)
 }
 
 func testBatchJobTaskSucceeded(t *testing.T, sess *session.Session) {
@@ -65,10 +86,485 @@ func testBatchJobTaskTimeout(t *testing.T, sess *session.Session) {
 		return out, nil
 	}
 
+	var terminated *batch.TerminateJobInput
+	terminateJob = func(b *batch.Batch, input *batch.TerminateJobInput) (*batch.TerminateJobOutput, error) {
+		terminated = input
+		return &batch.TerminateJobOutput{}, nil
+	}
+
 	bjt := NewBatchJobTask(sess, &batch.SubmitJobInput{})
 	bjt.PollingTime = 10 * time.Microsecond
 	bjt.Timeout = time.Second
-	if err := bjt.Execute(); err == nil {
-		t.Error("expect to occur timeout but it succeeded")
+	bjt.TerminateReason = "test timeout"
+	err := bjt.Execute()
+	if err == nil {
+		t.Fatal("expect to occur timeout but it succeeded")
+	}
+	if !strings.Contains(err.Error(), "timed out, and the job was stopped") {
+		t.Errorf("batch job: invalid timeout error: %v", err)
+	}
+	if terminated == nil || aws.StringValue(terminated.JobId) != jobID || aws.StringValue(terminated.Reason) != "test timeout" {
+		t.Errorf("batch job: timed out job is not terminated: %v", terminated)
+	}
+
+	terminateJob = func(b *batch.Batch, input *batch.TerminateJobInput) (*batch.TerminateJobOutput, error) {
+		return nil, errors.New("terminate error")
+	}
+	if err := bjt.Execute(); err == nil || !strings.Contains(err.Error(), "stopping the job failed: terminate error") {
+		t.Errorf("batch job: terminate error is not reported: %v", err)
+	}
+}
+
+func testBatchJobTaskCancelled(t *testing.T, sess *session.Session) {
+	jobID := "TESTING3"
+	submitJob = func(b *batch.Batch, input *batch.SubmitJobInput) (*batch.SubmitJobOutput, error) {
+		return &batch.SubmitJobOutput{JobId: aws.String(jobID)}, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	describeJobs = func(b *batch.Batch, input *batch.DescribeJobsInput) (*batch.DescribeJobsOutput, error) {
+		cancel()
+		detail := &batch.JobDetail{JobId: aws.String(jobID), Status: aws.String("RUNNABLE")}
+		return &batch.DescribeJobsOutput{Jobs: []*batch.JobDetail{detail}}, nil
+	}
+	var cancelled *batch.CancelJobInput
+	cancelJob = func(b *batch.Batch, input *batch.CancelJobInput) (*batch.CancelJobOutput, error) {
+		cancelled = input
+		return &batch.CancelJobOutput{}, nil
+	}
+
+	bjt := NewBatchJobTask(sess, &batch.SubmitJobInput{})
+	bjt.PollingTime = time.Minute
+	err := bjt.ExecuteContext(ctx)
+	if err == nil || !strings.Contains(err.Error(), "cancelled, and the job was stopped") {
+		t.Errorf("batch job: invalid cancel error: %v", err)
+	}
+	if cancelled == nil || aws.StringValue(cancelled.JobId) != jobID || aws.StringValue(cancelled.Reason) != defaultTerminateReason {
+		t.Errorf("batch job: queued job is not cancelled: %v", cancelled)
+	}
+}
+
+func testBatchJobTaskSignal(t *testing.T, sess *session.Session) {
+	jobID := "TESTING4"
+	submitJob = func(b *batch.Batch, input *batch.SubmitJobInput) (*batch.SubmitJobOutput, error) {
+		return &batch.SubmitJobOutput{JobId: aws.String(jobID)}, nil
+	}
+	describeJobs = func(b *batch.Batch, input *batch.DescribeJobsInput) (*batch.DescribeJobsOutput, error) {
+		syscall.Kill(syscall.Getpid(), syscall.SIGUSR1)
+		detail := &batch.JobDetail{JobId: aws.String(jobID), Status: aws.String("RUNNING")}
+		return &batch.DescribeJobsOutput{Jobs: []*batch.JobDetail{detail}}, nil
+	}
+	var terminated *batch.TerminateJobInput
+	terminateJob = func(b *batch.Batch, input *batch.TerminateJobInput) (*batch.TerminateJobOutput, error) {
+		terminated = input
+		return &batch.TerminateJobOutput{}, nil
+	}
+
+	bjt := NewBatchJobTask(sess, &batch.SubmitJobInput{})
+	bjt.PollingTime = time.Minute
+	bjt.Signals = []os.Signal{syscall.SIGUSR1}
+	err := bjt.Execute()
+	if err == nil || !strings.Contains(err.Error(), "received signal user defined signal 1, and the job was stopped") {
+		t.Errorf("batch job: invalid signal error: %v", err)
+	}
+	if terminated == nil || aws.StringValue(terminated.JobId) != jobID {
+		t.Errorf("batch job: job is not terminated on signal: %v", terminated)
+	}
+}
+
+func testBatchJobTaskPollingFailed(t *testing.T, sess *session.Session) {
+	jobID := "TESTING6"
+	submitJob = func(b *batch.Batch, input *batch.SubmitJobInput) (*batch.SubmitJobOutput, error) {
+		return &batch.SubmitJobOutput{JobId: aws.String(jobID)}, nil
+	}
+	describeJobs = func(b *batch.Batch, input *batch.DescribeJobsInput) (*batch.DescribeJobsOutput, error) {
+		return nil, awserr.New("ServerException", "Internal Error", nil)
+	}
+	var cancelled *batch.CancelJobInput
+	cancelJob = func(b *batch.Batch, input *batch.CancelJobInput) (*batch.CancelJobOutput, error) {
+		cancelled = input
+		return &batch.CancelJobOutput{}, nil
+	}
+
+	bjt := NewBatchJobTask(sess, &batch.SubmitJobInput{})
+	bjt.PollingTime = 10 * time.Microsecond
+	err := bjt.Execute()
+	if err == nil || !strings.Contains(err.Error(), "polling failed: ServerException") || !strings.Contains(err.Error(), "and the job was stopped") {
+		t.Errorf("batch job: invalid polling error: %v", err)
+	}
+	if cancelled == nil || aws.StringValue(cancelled.JobId) != jobID {
+		t.Errorf("batch job: job is not stopped when polling failed: %v", cancelled)
+	}
+
+	cancelled = nil
+	describeJobs = func(b *batch.Batch, input *batch.DescribeJobsInput) (*batch.DescribeJobsOutput, error) {
+		return &batch.DescribeJobsOutput{}, nil
+	}
+	if err := bjt.Execute(); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("batch job: invalid not found error: %v", err)
+	}
+	if cancelled == nil {
+		t.Error("batch job: job is not stopped when it is not found")
+	}
+
+	cancelled = nil
+	describeJobs = func(b *batch.Batch, input *batch.DescribeJobsInput) (*batch.DescribeJobsOutput, error) {
+		detail := &batch.JobDetail{JobId: aws.String(jobID), Status: aws.String("FAILED"), StatusReason: aws.String("test")}
+		return &batch.DescribeJobsOutput{Jobs: []*batch.JobDetail{detail}}, nil
+	}
+	if err := bjt.Execute(); err == nil || strings.Contains(err.Error(), "stopped") {
+		t.Errorf("batch job: invalid job failure error: %v", err)
+	}
+	if cancelled != nil {
+		t.Errorf("batch job: failed job is stopped: %v", cancelled)
+	}
+}
+
+func testBatchJobTaskLogs(t *testing.T, sess *session.Session) {
+	jobID := "TESTING5"
+	submitJob = func(b *batch.Batch, input *batch.SubmitJobInput) (*batch.SubmitJobOutput, error) {
+		return &batch.SubmitJobOutput{JobId: aws.String(jobID), JobName: input.JobName}, nil
+	}
+	statuses := []string{"RUNNING", "RUNNING", "FAILED"}
+	var events []*cloudwatchlogs.OutputLogEvent
+	describeJobs = func(b *batch.Batch, input *batch.DescribeJobsInput) (*batch.DescribeJobsOutput, error) {
+		detail := &batch.JobDetail{
+			JobId:        aws.String(jobID),
+			Status:       aws.String(statuses[0]),
+			StatusReason: aws.String("Essential container in task exited"),
+			Container:    &batch.ContainerDetail{LogStreamName: aws.String("test-job/default/0001")},
+		}
+		statuses = statuses[1:]
+		// lines are appended while the job runs
+		for i := 0; i < 3 && len(events) < 5; i++ {
+			events = append(events, &cloudwatchlogs.OutputLogEvent{Message: aws.String(fmt.Sprintf("line%d", len(events)+1))})
+		}
+		return &batch.DescribeJobsOutput{Jobs: []*batch.JobDetail{detail}}, nil
+	}
+	getLogEvents = func(svc *cloudwatchlogs.CloudWatchLogs, input *cloudwatchlogs.GetLogEventsInput) (*cloudwatchlogs.GetLogEventsOutput, error) {
+		if aws.StringValue(input.LogGroupName) != "/aws/batch/job" || aws.StringValue(input.LogStreamName) != "test-job/default/0001" {
+			t.Errorf("batch job: invalid log stream: %v", input)
+		}
+		// two events per page, and the token stays at the end of the stream
+		start := 0
+		if input.NextToken != nil {
+			fmt.Sscanf(*input.NextToken, "f/%d", &start)
+		}
+		end := start + 2
+		if end > len(events) {
+			end = len(events)
+		}
+		return &cloudwatchlogs.GetLogEventsOutput{
+			Events:           events[start:end],
+			NextForwardToken: aws.String(fmt.Sprintf("f/%d", end)),
+		}, nil
+	}
+
+	bjt := NewBatchJobTask(sess, &batch.SubmitJobInput{JobName: aws.String("test-job")})
+	bjt.PollingTime = 10 * time.Microsecond
+	bjt.LogTailLines = 2
+	var buf bytes.Buffer
+	bjt.SetLogger(log.New(&buf, "", 0))
+
+	err := bjt.Execute()
+	if err == nil {
+		t.Fatal("batch job: failed job must be error")
+	}
+	if expected := "failed by reason:Essential container in task exited\nlast log lines of test-job/default/0001:\nline4\nline5"; !strings.HasSuffix(err.Error(), expected) {
+		t.Errorf("batch job: error must include last log lines: %v", err)
+	}
+	if logs := buf.String(); logs != "test-job: aws batch job TESTING5 SUBMITTED -> RUNNING\ntest-job: line1\ntest-job: line2\ntest-job: line3\ntest-job: line4\ntest-job: line5\ntest-job: aws batch job TESTING5 RUNNING -> FAILED\n" {
+		t.Errorf("batch job: invalid forwarded logs: %q", logs)
+	}
+}
+
+func testBatchJobTaskArray(t *testing.T, sess *session.Session) {
+	jobID := "TESTING6"
+	submitJob = func(b *batch.Batch, input *batch.SubmitJobInput) (*batch.SubmitJobOutput, error) {
+		return &batch.SubmitJobOutput{JobId: aws.String(jobID), JobName: input.JobName}, nil
+	}
+	describeJobs = func(b *batch.Batch, input *batch.DescribeJobsInput) (*batch.DescribeJobsOutput, error) {
+		detail := &batch.JobDetail{
+			JobId:  aws.String(jobID),
+			Status: aws.String("FAILED"),
+			ArrayProperties: &batch.ArrayPropertiesDetail{
+				Size:          aws.Int64(10),
+				StatusSummary: map[string]*int64{"SUCCEEDED": aws.Int64(8), "FAILED": aws.Int64(2)},
+			},
+		}
+		return &batch.DescribeJobsOutput{Jobs: []*batch.JobDetail{detail}}, nil
+	}
+
+	bjt := NewBatchJobTask(sess, &batch.SubmitJobInput{
+		JobName:         aws.String("test-array"),
+		ArrayProperties: &batch.ArrayProperties{Size: aws.Int64(10)},
+	})
+	var buf bytes.Buffer
+	bjt.SetLogger(log.New(&buf, "", 0))
+	bjt.ArrayFailureTolerance = 1
+	if err := bjt.Execute(); err == nil || !strings.Contains(err.Error(), "8 succeeded, 2 failed of 10") {
+		t.Errorf("batch job: invalid array job error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "test-array: array job TESTING6 finished: 8 succeeded, 2 failed of 10") {
+		t.Errorf("batch job: array job summary is not logged: %q", buf.String())
+	}
+
+	bjt.ArrayFailureTolerance = 2
+	if err := bjt.Execute(); err != nil {
+		t.Errorf("batch job: array job within failure tolerance must succeed: %v", err)
+	}
+}
+
+func testBatchJobTaskDependentJobs(t *testing.T, sess *session.Session) {
+	var submitted []*batch.SubmitJobInput
+	submitJob = func(b *batch.Batch, input *batch.SubmitJobInput) (*batch.SubmitJobOutput, error) {
+		submitted = append(submitted, input)
+		return &batch.SubmitJobOutput{JobId: aws.String(fmt.Sprintf("job-%d", len(submitted))), JobName: input.JobName}, nil
+	}
+	polls := 0
+	describeJobs = func(b *batch.Batch, input *batch.DescribeJobsInput) (*batch.DescribeJobsOutput, error) {
+		polls++
+		out := &batch.DescribeJobsOutput{}
+		for i, id := range input.Jobs {
+			status := "SUCCEEDED"
+			if polls == 1 && i > 0 {
+				status = "PENDING"
+			}
+			out.Jobs = append(out.Jobs, &batch.JobDetail{JobId: id, Status: aws.String(status)})
+		}
+		return out, nil
+	}
+
+	external := &batch.JobDependency{JobId: aws.String("external")}
+	third := &batch.SubmitJobInput{JobName: aws.String("third"), DependsOn: []*batch.JobDependency{external}}
+	bjt := NewBatchJobTask(sess, &batch.SubmitJobInput{JobName: aws.String("first")})
+	bjt.DependentJobs = []*batch.SubmitJobInput{{JobName: aws.String("second")}, third}
+	bjt.PollingTime = 10 * time.Microsecond
+	if err := bjt.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if polls != 2 {
+		t.Errorf("batch job: must wait for all jobs but polled %d times", polls)
+	}
+	if !reflect.DeepEqual(bjt.JobIDs, []string{"job-1", "job-2", "job-3"}) {
+		t.Errorf("batch job: invalid job ids: %v", bjt.JobIDs)
+	}
+	if len(submitted[0].DependsOn) != 0 ||
+		!reflect.DeepEqual(submitted[1].DependsOn, []*batch.JobDependency{{JobId: aws.String("job-1")}}) ||
+		!reflect.DeepEqual(submitted[2].DependsOn, []*batch.JobDependency{external, {JobId: aws.String("job-2")}}) {
+		t.Errorf("batch job: invalid dependencies: %v", submitted)
+	}
+	if len(third.DependsOn) != 1 {
+		t.Errorf("batch job: input must not be modified: %v", third)
+	}
+
+	// jobs already submitted are cancelled when submitting fails
+	submitted = nil
+	submitJob = func(b *batch.Batch, input *batch.SubmitJobInput) (*batch.SubmitJobOutput, error) {
+		if aws.StringValue(input.JobName) == "third" {
+			return nil, errors.New("submit error")
+		}
+		submitted = append(submitted, input)
+		return &batch.SubmitJobOutput{JobId: aws.String(fmt.Sprintf("job-%d", len(submitted))), JobName: input.JobName}, nil
+	}
+	var cancelled []string
+	cancelJob = func(b *batch.Batch, input *batch.CancelJobInput) (*batch.CancelJobOutput, error) {
+		cancelled = append(cancelled, aws.StringValue(input.JobId))
+		return &batch.CancelJobOutput{}, nil
+	}
+	if err := bjt.Execute(); err == nil || !strings.Contains(err.Error(), "submit error") {
+		t.Errorf("batch job: submit error is not reported: %v", err)
+	}
+	if !reflect.DeepEqual(cancelled, []string{"job-1", "job-2"}) {
+		t.Errorf("batch job: submitted jobs are not cancelled: %v", cancelled)
+	}
+}
+
+func testBatchJobTaskTransitions(t *testing.T, sess *session.Session) {
+	jobID := "TESTING7"
+	submitJob = func(b *batch.Batch, input *batch.SubmitJobInput) (*batch.SubmitJobOutput, error) {
+		return &batch.SubmitJobOutput{JobId: aws.String(jobID), JobName: input.JobName}, nil
+	}
+	statuses := []string{"RUNNABLE", "", "STARTING", "", "RUNNING", "RUNNING", "SUCCEEDED"}
+	describeJobs = func(b *batch.Batch, input *batch.DescribeJobsInput) (*batch.DescribeJobsOutput, error) {
+		status := statuses[0]
+		statuses = statuses[1:]
+		if status == "" {
+			return nil, awserr.New("TooManyRequestsException", "Too Many Requests", nil)
+		}
+		detail := &batch.JobDetail{JobId: aws.String(jobID), Status: aws.String(status)}
+		return &batch.DescribeJobsOutput{Jobs: []*batch.JobDetail{detail}}, nil
+	}
+
+	bjt := NewBatchJobTask(sess, &batch.SubmitJobInput{JobName: aws.String("test-job")})
+	bjt.PollingTime = 10 * time.Microsecond
+	var buf bytes.Buffer
+	bjt.SetLogger(log.New(&buf, "", 0))
+	if err := bjt.Execute(); err != nil {
+		t.Fatalf("batch job: throttling must not fail the job: %v", err)
+	}
+	if len(statuses) != 0 {
+		t.Errorf("batch job: polling finished before the job succeeded: %v", statuses)
+	}
+
+	var transitions []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, "test-job: ") {
+			transitions = append(transitions, line)
+		}
+	}
+	expected := []string{
+		"test-job: aws batch job TESTING7 SUBMITTED -> RUNNABLE",
+		"test-job: aws batch job TESTING7 RUNNABLE -> STARTING",
+		"test-job: aws batch job TESTING7 STARTING -> RUNNING",
+		"test-job: aws batch job TESTING7 RUNNING -> SUCCEEDED",
+	}
+	if !reflect.DeepEqual(transitions, expected) {
+		t.Errorf("batch job: invalid transitions: %v", transitions)
+	}
+}
+
+func testBatchJobTaskOverrides(t *testing.T, sess *session.Session) {
+	var submitted *batch.SubmitJobInput
+	submitJob = func(b *batch.Batch, input *batch.SubmitJobInput) (*batch.SubmitJobOutput, error) {
+		submitted = input
+		return &batch.SubmitJobOutput{JobId: aws.String("TESTING8"), JobName: input.JobName}, nil
+	}
+	attempts := []*batch.AttemptDetail{
+		{StatusReason: aws.String("Host EC2 terminated")},
+		{StatusReason: aws.String("Essential container in task exited"), Container: &batch.AttemptContainerDetail{ExitCode: aws.Int64(0)}},
+	}
+	describeJobs = func(b *batch.Batch, input *batch.DescribeJobsInput) (*batch.DescribeJobsOutput, error) {
+		detail := &batch.JobDetail{JobId: aws.String("TESTING8"), Status: aws.String("SUCCEEDED"), Attempts: attempts}
+		return &batch.DescribeJobsOutput{Jobs: []*batch.JobDetail{detail}}, nil
+	}
+
+	input := &batch.SubmitJobInput{
+		JobName:       aws.String("test-job"),
+		JobDefinition: aws.String("default-definition"),
+		Parameters:    map[string]*string{"mode": aws.String("full")},
+		ContainerOverrides: &batch.ContainerOverrides{
+			Environment:          []*batch.KeyValuePair{{Name: aws.String("LANG"), Value: aws.String("C")}, {Name: aws.String("DATE"), Value: aws.String("")}},
+			ResourceRequirements: []*batch.ResourceRequirement{{Type: aws.String("GPU"), Value: aws.String("1")}, {Type: aws.String("VCPU"), Value: aws.String("1")}},
+		},
+	}
+	bjt := NewBatchJobTask(sess, input)
+	bjt.Overrides = &BatchJobOverrides{
+		JobDefinition: "${job_definition}",
+		Parameters:    map[string]string{"date": "${date}"},
+		Command:       []string{"sh", "-c", "run --date=${date} --path=$PATH"},
+		Environment:   map[string]string{"DATE": "${date}"},
+		Vcpus:         "${vcpus}",
+		Memory:        "2048",
+	}
+	params := cloudflow.NewParams(map[string]string{"job_definition": "arn:aws:batch:job-definition/test:2", "date": "2017-01-01", "vcpus": "4"})
+	if err := bjt.ExecuteContext(cloudflow.WithParams(context.Background(), params)); err != nil {
+		t.Fatal(err)
+	}
+
+	if aws.StringValue(submitted.JobDefinition) != "arn:aws:batch:job-definition/test:2" {
+		t.Errorf("batch job: invalid job definition: %v", aws.StringValue(submitted.JobDefinition))
+	}
+	if !reflect.DeepEqual(submitted.Parameters, map[string]*string{"mode": aws.String("full"), "date": aws.String("2017-01-01")}) {
+		t.Errorf("batch job: invalid parameters: %v", submitted.Parameters)
+	}
+	overrides := submitted.ContainerOverrides
+	if !reflect.DeepEqual(overrides.Command, aws.StringSlice([]string{"sh", "-c", "run --date=2017-01-01 --path=$PATH"})) {
+		t.Errorf("batch job: invalid command: %v", overrides.Command)
+	}
+	if !reflect.DeepEqual(overrides.Environment, []*batch.KeyValuePair{{Name: aws.String("LANG"), Value: aws.String("C")}, {Name: aws.String("DATE"), Value: aws.String("2017-01-01")}}) {
+		t.Errorf("batch job: invalid environment: %v", overrides.Environment)
+	}
+	expectedResources := []*batch.ResourceRequirement{
+		{Type: aws.String("GPU"), Value: aws.String("1")},
+		{Type: aws.String("VCPU"), Value: aws.String("4")},
+		{Type: aws.String("MEMORY"), Value: aws.String("2048")},
+	}
+	if !reflect.DeepEqual(overrides.ResourceRequirements, expectedResources) {
+		t.Errorf("batch job: invalid resource requirements: %v", overrides.ResourceRequirements)
+	}
+	if len(input.Parameters) != 1 || len(input.ContainerOverrides.ResourceRequirements) != 2 || aws.StringValue(input.ContainerOverrides.Environment[1].Value) != "" {
+		t.Errorf("batch job: input must not be modified: %v", input)
+	}
+
+	if len(bjt.Results) != 1 {
+		t.Fatalf("batch job: invalid results: %v", bjt.Results)
+	}
+	if result := bjt.Results[0]; result.JobID != "TESTING8" || result.JobName != "test-job" || result.Status != "SUCCEEDED" || result.Attempts != 2 || result.LastAttempt != attempts[1] {
+		t.Errorf("batch job: invalid result: %+v", result)
+	}
+
+	submitted = nil
+	if err := bjt.Execute(); err == nil || !strings.Contains(err.Error(), "workflow parameter job_definition,date,vcpus is not set") {
+		t.Errorf("batch job: unset parameter must be error: %v", err)
+	}
+	if submitted != nil {
+		t.Error("batch job: job is submitted with unset parameters")
+	}
+}
+
+func TestBatchJobTask_GoroutineLeak(t *testing.T) {
+	sess, err := session.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultSubmitJob, defaultDescribeJobs, defaultTerminateJob := submitJob, describeJobs, terminateJob
+	defer func() {
+		submitJob, describeJobs, terminateJob = defaultSubmitJob, defaultDescribeJobs, defaultTerminateJob
+	}()
+	submitJob = func(b *batch.Batch, input *batch.SubmitJobInput) (*batch.SubmitJobOutput, error) {
+		return &batch.SubmitJobOutput{JobId: aws.String("LEAK")}, nil
+	}
+	terminateJob = func(b *batch.Batch, input *batch.TerminateJobInput) (*batch.TerminateJobOutput, error) {
+		return &batch.TerminateJobOutput{}, nil
+	}
+	describe := func(status string, err error) func(*batch.Batch, *batch.DescribeJobsInput) (*batch.DescribeJobsOutput, error) {
+		return func(b *batch.Batch, input *batch.DescribeJobsInput) (*batch.DescribeJobsOutput, error) {
+			if err != nil {
+				return nil, err
+			}
+			detail := &batch.JobDetail{JobId: aws.String("LEAK"), Status: aws.String(status)}
+			return &batch.DescribeJobsOutput{Jobs: []*batch.JobDetail{detail}}, nil
+		}
+	}
+	execute := func(ctx context.Context) error {
+		bjt := NewBatchJobTask(sess, &batch.SubmitJobInput{})
+		bjt.PollingTime = 10 * time.Microsecond
+		bjt.Timeout = 100 * time.Millisecond
+		return bjt.ExecuteContext(ctx)
+	}
+
+	// signal.Notify starts a goroutine watching signals at the first call
+	describeJobs = describe("SUCCEEDED", nil)
+	execute(context.Background())
+	before := runtime.NumGoroutine()
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	cases := []struct {
+		name    string
+		ctx     context.Context
+		status  string
+		err     error
+		succeed bool
+	}{
+		{"succeeded", context.Background(), "SUCCEEDED", nil, true},
+		{"failed", context.Background(), "FAILED", nil, false},
+		{"api error", context.Background(), "", errors.New("describe error"), false},
+		{"timeout", context.Background(), "RUNNING", nil, false},
+		{"cancelled", cancelled, "RUNNING", nil, false},
+	}
+	for _, c := range cases {
+		describeJobs = describe(c.status, c.err)
+		if err := execute(c.ctx); (err == nil) != c.succeed {
+			t.Errorf("batch job %s: unexpected result: %v", c.name, err)
+		}
+
+		deadline := time.Now().Add(time.Second)
+		for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if n := runtime.NumGoroutine(); n > before {
+			t.Errorf("batch job %s: goroutines leaked: %d -> %d", c.name, before, n)
+		}
 	}
 }
@@ -0,0 +1,190 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"reflect"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/batch"
+	"github.com/yonekawa/cloudflow"
+)
+
+// BatchRegisterJobDefinitionTask registers AWS Batch job definition.
+// The latest active revision is reused if it has the properties set in Input.
+//
+// The ARN is kept in JobDefinitionArn, and set to the workflow parameter ParamName
+// so later tasks refer it by BatchJobOverrides.JobDefinition.
+type BatchRegisterJobDefinitionTask struct {
+	Session *session.Session
+	Input   *batch.RegisterJobDefinitionInput
+	// ParamName is the workflow parameter receiving the ARN.
+	ParamName string
+	Logger    *log.Logger
+
+	// JobDefinitionArn and Revision of the registered or reused job definition.
+	JobDefinitionArn string
+	Revision         int64
+	// Registered is true if a new revision was registered.
+	Registered bool
+}
+
+// NewBatchRegisterJobDefinitionTask creates a task registering AWS Batch job definition.
+func NewBatchRegisterJobDefinitionTask(session *session.Session, input *batch.RegisterJobDefinitionInput) *BatchRegisterJobDefinitionTask {
+	return &BatchRegisterJobDefinitionTask{Session: session, Input: input}
+}
+
+// SetLogger sets log writer.
+func (rt *BatchRegisterJobDefinitionTask) SetLogger(logger *log.Logger) {
+	rt.Logger = logger
+}
+
+// Execute implement Task.Execute.
+func (rt *BatchRegisterJobDefinitionTask) Execute() error {
+	return rt.ExecuteContext(context.Background())
+}
+
+// ExecuteContext implement ContextTask.ExecuteContext.
+func (rt *BatchRegisterJobDefinitionTask) ExecuteContext(ctx context.Context) error {
+	b := batch.New(rt.Session)
+	latest, err := latestJobDefinition(b, aws.StringValue(rt.Input.JobDefinitionName))
+	if err != nil {
+		return err
+	}
+
+	if latest != nil && sameJobDefinition(latest, rt.Input) {
+		rt.JobDefinitionArn = aws.StringValue(latest.JobDefinitionArn)
+		rt.Revision = aws.Int64Value(latest.Revision)
+		rt.Registered = false
+		logf(rt.Logger, "cloudflow: reuse aws batch job definition %v", rt.JobDefinitionArn)
+	} else {
+		out, err := registerJobDefinition(b, rt.Input)
+		if err != nil {
+			return err
+		}
+		rt.JobDefinitionArn = aws.StringValue(out.JobDefinitionArn)
+		rt.Revision = aws.Int64Value(out.Revision)
+		rt.Registered = true
+		logf(rt.Logger, "cloudflow: registered aws batch job definition %v", rt.JobDefinitionArn)
+	}
+
+	if params := cloudflow.ParamsFromContext(ctx); rt.ParamName != "" && params != nil {
+		params.Set(rt.ParamName, rt.JobDefinitionArn)
+	}
+	return nil
+}
+
+func latestJobDefinition(b *batch.Batch, name string) (*batch.JobDefinition, error) {
+	input := &batch.DescribeJobDefinitionsInput{JobDefinitionName: aws.String(name), Status: aws.String("ACTIVE")}
+	var latest *batch.JobDefinition
+	for {
+		out, err := describeJobDefinitions(b, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, def := range out.JobDefinitions {
+			if latest == nil || aws.Int64Value(def.Revision) > aws.Int64Value(latest.Revision) {
+				latest = def
+			}
+		}
+		if aws.StringValue(out.NextToken) == "" {
+			return latest, nil
+		}
+		input.NextToken = out.NextToken
+	}
+}
+
+// sameJobDefinition reports whether def has the properties set in input.
+// Properties not set in input are ignored, since AWS Batch fills defaults such as
+// empty lists, network configuration and propagated tags into the described definition.
+func sameJobDefinition(def *batch.JobDefinition, input *batch.RegisterJobDefinitionInput) bool {
+	pairs := [][2]interface{}{
+		{def.Type, input.Type},
+		{def.Parameters, input.Parameters},
+		{def.ContainerProperties, input.ContainerProperties},
+		{def.NodeProperties, input.NodeProperties},
+		{def.EcsProperties, input.EcsProperties},
+		{def.EksProperties, input.EksProperties},
+		{def.RetryStrategy, input.RetryStrategy},
+		{def.Timeout, input.Timeout},
+		{def.PlatformCapabilities, input.PlatformCapabilities},
+		{def.PropagateTags, input.PropagateTags},
+		{def.SchedulingPriority, input.SchedulingPriority},
+		{def.Tags, input.Tags},
+	}
+	for _, p := range pairs {
+		if !containsValue(jsonValue(p[0]), jsonValue(p[1])) {
+			return false
+		}
+	}
+	return true
+}
+
+// jsonValue converts v to plain json values.
+func jsonValue(v interface{}) interface{} {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var value interface{}
+	json.Unmarshal(b, &value)
+	return value
+}
+
+// containsValue reports whether described has all values set in wanted.
+// Keys of maps not in wanted are ignored. Lists must have the same length,
+// and objects such as environment variables may be listed in any order unlike commands.
+func containsValue(described, wanted interface{}) bool {
+	switch w := wanted.(type) {
+	case nil:
+		return true
+	case map[string]interface{}:
+		d, _ := described.(map[string]interface{})
+		for key, child := range w {
+			if !containsValue(d[key], child) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		d, _ := described.([]interface{})
+		if len(d) != len(w) {
+			return false
+		}
+		used := make([]bool, len(d))
+	wantedLoop:
+		for n, child := range w {
+			if _, ok := child.(map[string]interface{}); !ok {
+				if !containsValue(d[n], child) {
+					return false
+				}
+				continue
+			}
+			for i := range d {
+				if !used[i] && containsValue(d[i], child) {
+					used[i] = true
+					continue wantedLoop
+				}
+			}
+			return false
+		}
+		return true
+	case string:
+		return w == "" || described == w
+	case bool:
+		return !w && described == nil || described == w
+	case float64:
+		return w == 0 && described == nil || described == w
+	}
+	return reflect.DeepEqual(described, wanted)
+}
+
+// for mock testing
+var describeJobDefinitions = func(b *batch.Batch, input *batch.DescribeJobDefinitionsInput) (*batch.DescribeJobDefinitionsOutput, error) {
+	return b.DescribeJobDefinitions(input)
+}
+var registerJobDefinition = func(b *batch.Batch, input *batch.RegisterJobDefinitionInput) (*batch.RegisterJobDefinitionOutput, error) {
+	return b.RegisterJobDefinition(input)
+}
@@ -0,0 +1,190 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/batch"
+	"github.com/yonekawa/cloudflow"
+)
+
+func TestBatchRegisterJobDefinitionTask_Execute(t *testing.T) {
+	t.Parallel()
+
+	sess, err := session.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// AWS Batch returns empty lists for unset properties
+	active := []*batch.JobDefinition{
+		{
+			JobDefinitionArn:  aws.String("arn:aws:batch:job-definition/test:1"),
+			JobDefinitionName: aws.String("test"),
+			Revision:          aws.Int64(1),
+			Type:              aws.String("container"),
+			ContainerProperties: &batch.ContainerProperties{
+				Image:   aws.String("app:v1"),
+				Command: []*string{},
+				Volumes: []*batch.Volume{},
+			},
+		},
+	}
+	describeJobDefinitions = func(b *batch.Batch, input *batch.DescribeJobDefinitionsInput) (*batch.DescribeJobDefinitionsOutput, error) {
+		if aws.StringValue(input.JobDefinitionName) != "test" || aws.StringValue(input.Status) != "ACTIVE" {
+			t.Errorf("register job definition: invalid describe input: %v", input)
+		}
+		// paginate by one definition
+		if input.NextToken == nil {
+			return &batch.DescribeJobDefinitionsOutput{JobDefinitions: active[:1], NextToken: aws.String("next")}, nil
+		}
+		return &batch.DescribeJobDefinitionsOutput{JobDefinitions: active[1:]}, nil
+	}
+	registerJobDefinition = func(b *batch.Batch, input *batch.RegisterJobDefinitionInput) (*batch.RegisterJobDefinitionOutput, error) {
+		revision := int64(len(active) + 1)
+		arn := fmt.Sprintf("arn:aws:batch:job-definition/test:%d", revision)
+		active = append(active, &batch.JobDefinition{
+			JobDefinitionArn:    aws.String(arn),
+			JobDefinitionName:   input.JobDefinitionName,
+			Revision:            aws.Int64(revision),
+			Type:                input.Type,
+			ContainerProperties: input.ContainerProperties,
+		})
+		return &batch.RegisterJobDefinitionOutput{JobDefinitionArn: aws.String(arn), Revision: aws.Int64(revision)}, nil
+	}
+
+	input := &batch.RegisterJobDefinitionInput{
+		JobDefinitionName:   aws.String("test"),
+		Type:                aws.String("container"),
+		ContainerProperties: &batch.ContainerProperties{Image: aws.String("app:v1")},
+	}
+	rt := NewBatchRegisterJobDefinitionTask(sess, input)
+	rt.ParamName = "job_definition"
+	params := cloudflow.NewParams(nil)
+	ctx := cloudflow.WithParams(context.Background(), params)
+	if err := rt.ExecuteContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if rt.Registered || rt.Revision != 1 || rt.JobDefinitionArn != "arn:aws:batch:job-definition/test:1" {
+		t.Errorf("register job definition: same definition must be reused: %+v", rt)
+	}
+	if arn, _ := params.Get("job_definition"); arn != rt.JobDefinitionArn {
+		t.Errorf("register job definition: arn is not set to param: %v", arn)
+	}
+
+	input.ContainerProperties.Image = aws.String("app:v2")
+	if err := rt.ExecuteContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !rt.Registered || rt.Revision != 2 {
+		t.Errorf("register job definition: changed definition must be registered: %+v", rt)
+	}
+	if arn, _ := params.Get("job_definition"); arn != "arn:aws:batch:job-definition/test:2" {
+		t.Errorf("register job definition: registered arn is not set to param: %v", arn)
+	}
+
+	// the latest revision is compared
+	if err := rt.ExecuteContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if rt.Registered || rt.Revision != 2 {
+		t.Errorf("register job definition: latest revision must be reused: %+v", rt)
+	}
+}
+
+func TestSameJobDefinition(t *testing.T) {
+	t.Parallel()
+
+	input := func() *batch.RegisterJobDefinitionInput {
+		return &batch.RegisterJobDefinitionInput{
+			JobDefinitionName: aws.String("fargate"),
+			Type:              aws.String("container"),
+			ContainerProperties: &batch.ContainerProperties{
+				Image:            aws.String("app:v1"),
+				Command:          aws.StringSlice([]string{"run", "--daily"}),
+				ExecutionRoleArn: aws.String("arn:aws:iam::000000000000:role/exec"),
+				Environment: []*batch.KeyValuePair{
+					{Name: aws.String("STAGE"), Value: aws.String("prod")},
+					{Name: aws.String("REGION"), Value: aws.String("us-east-1")},
+				},
+				ResourceRequirements: []*batch.ResourceRequirement{
+					{Type: aws.String("VCPU"), Value: aws.String("1")},
+					{Type: aws.String("MEMORY"), Value: aws.String("2048")},
+				},
+			},
+			PlatformCapabilities: aws.StringSlice([]string{"FARGATE"}),
+			PropagateTags:        aws.Bool(false),
+			Tags:                 map[string]*string{"team": aws.String("data")},
+		}
+	}
+
+	// described definition as AWS Batch returns with defaults filled by the server
+	def := &batch.JobDefinition{
+		JobDefinitionArn:  aws.String("arn:aws:batch:us-east-1:000000000000:job-definition/fargate:3"),
+		JobDefinitionName: aws.String("fargate"),
+		Revision:          aws.Int64(3),
+		Status:            aws.String("ACTIVE"),
+		Type:              aws.String("container"),
+		Parameters:        map[string]*string{},
+		ContainerProperties: &batch.ContainerProperties{
+			Image:            aws.String("app:v1"),
+			Command:          aws.StringSlice([]string{"run", "--daily"}),
+			ExecutionRoleArn: aws.String("arn:aws:iam::000000000000:role/exec"),
+			Environment: []*batch.KeyValuePair{
+				{Name: aws.String("REGION"), Value: aws.String("us-east-1")},
+				{Name: aws.String("STAGE"), Value: aws.String("prod")},
+			},
+			ResourceRequirements: []*batch.ResourceRequirement{
+				{Type: aws.String("MEMORY"), Value: aws.String("2048")},
+				{Type: aws.String("VCPU"), Value: aws.String("1")},
+			},
+			Volumes:                      []*batch.Volume{},
+			MountPoints:                  []*batch.MountPoint{},
+			Ulimits:                      []*batch.Ulimit{},
+			Secrets:                      []*batch.Secret{},
+			NetworkConfiguration:         &batch.NetworkConfiguration{AssignPublicIp: aws.String("DISABLED")},
+			FargatePlatformConfiguration: &batch.FargatePlatformConfiguration{PlatformVersion: aws.String("LATEST")},
+			RuntimePlatform:              &batch.RuntimePlatform{CpuArchitecture: aws.String("X86_64"), OperatingSystemFamily: aws.String("LINUX")},
+		},
+		PlatformCapabilities: aws.StringSlice([]string{"FARGATE"}),
+		Tags: map[string]*string{
+			"team":                   aws.String("data"),
+			"aws:cloudformation:env": aws.String("prod"),
+		},
+		ContainerOrchestrationType: aws.String("ECS"),
+	}
+	if !sameJobDefinition(def, input()) {
+		t.Error("register job definition: definition with server defaults must be the same")
+	}
+
+	changes := map[string]func(*batch.RegisterJobDefinitionInput){
+		"image": func(in *batch.RegisterJobDefinitionInput) {
+			in.ContainerProperties.Image = aws.String("app:v2")
+		},
+		"command order": func(in *batch.RegisterJobDefinitionInput) {
+			in.ContainerProperties.Command = aws.StringSlice([]string{"--daily", "run"})
+		},
+		"removed env": func(in *batch.RegisterJobDefinitionInput) {
+			in.ContainerProperties.Environment = in.ContainerProperties.Environment[:1]
+		},
+		"memory": func(in *batch.RegisterJobDefinitionInput) {
+			in.ContainerProperties.ResourceRequirements[1].Value = aws.String("4096")
+		},
+		"public ip": func(in *batch.RegisterJobDefinitionInput) {
+			in.ContainerProperties.NetworkConfiguration = &batch.NetworkConfiguration{AssignPublicIp: aws.String("ENABLED")}
+		},
+		"tag": func(in *batch.RegisterJobDefinitionInput) {
+			in.Tags["team"] = aws.String("ml")
+		},
+	}
+	for name, change := range changes {
+		in := input()
+		change(in)
+		if sameJobDefinition(def, in) {
+			t.Errorf("register job definition: changed %v must not be the same", name)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package aws
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/batch"
+	"github.com/yonekawa/cloudflow"
+)
+
+// BatchJobOverrides overrides SubmitJobInput by workflow parameters.
+// ${name} in the values is replaced with the workflow parameter, and unset parameters fail the task.
+type BatchJobOverrides struct {
+	// JobDefinition is the name or ARN of the job definition.
+	JobDefinition string
+	// Parameters are merged into the parameters of the job.
+	Parameters map[string]string
+
+	Command []string
+	// Environment is merged into the environment of the container.
+	Environment map[string]string
+	// Vcpus and Memory (MiB) replace the resource requirements of the container.
+	Vcpus  string
+	Memory string
+}
+
+// apply returns a copy of input overridden by params.
+func (o *BatchJobOverrides) apply(input *batch.SubmitJobInput, params *cloudflow.Params) (*batch.SubmitJobInput, error) {
+	in := *input
+	e := &paramExpander{params: params}
+	expand := e.expand
+
+	if o.JobDefinition != "" {
+		in.JobDefinition = aws.String(expand(o.JobDefinition))
+	}
+	if len(o.Parameters) > 0 {
+		in.Parameters = make(map[string]*string, len(input.Parameters)+len(o.Parameters))
+		for name, value := range input.Parameters {
+			in.Parameters[name] = value
+		}
+		for name, value := range o.Parameters {
+			in.Parameters[name] = aws.String(expand(value))
+		}
+	}
+
+	if len(o.Command) > 0 || len(o.Environment) > 0 || o.Vcpus != "" || o.Memory != "" {
+		overrides := &batch.ContainerOverrides{}
+		if input.ContainerOverrides != nil {
+			*overrides = *input.ContainerOverrides
+		}
+		if len(o.Command) > 0 {
+			overrides.Command = make([]*string, len(o.Command))
+			for i, arg := range o.Command {
+				overrides.Command[i] = aws.String(expand(arg))
+			}
+		}
+		if len(o.Environment) > 0 {
+			overrides.Environment = overrideEnvironment(overrides.Environment, o.Environment, expand)
+		}
+		if o.Vcpus != "" {
+			overrides.ResourceRequirements = overrideResource(overrides.ResourceRequirements, batch.ResourceTypeVcpu, expand(o.Vcpus))
+		}
+		if o.Memory != "" {
+			overrides.ResourceRequirements = overrideResource(overrides.ResourceRequirements, batch.ResourceTypeMemory, expand(o.Memory))
+		}
+		in.ContainerOverrides = overrides
+	}
+
+	if err := e.err(); err != nil {
+		return nil, err
+	}
+	return &in, nil
+}
+
+func overrideEnvironment(env []*batch.KeyValuePair, values map[string]string, expand func(string) string) []*batch.KeyValuePair {
+	result := make([]*batch.KeyValuePair, 0, len(env)+len(values))
+	for _, kv := range env {
+		if _, ok := values[aws.StringValue(kv.Name)]; !ok {
+			result = append(result, kv)
+		}
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		result = append(result, &batch.KeyValuePair{Name: aws.String(name), Value: aws.String(expand(values[name]))})
+	}
+	return result
+}
+
+func overrideResource(resources []*batch.ResourceRequirement, typ, value string) []*batch.ResourceRequirement {
+	result := make([]*batch.ResourceRequirement, 0, len(resources)+1)
+	for _, r := range resources {
+		if aws.StringValue(r.Type) != typ {
+			result = append(result, r)
+		}
+	}
+	return append(result, &batch.ResourceRequirement{Type: aws.String(typ), Value: aws.String(value)})
+}
+
+// paramPattern matches ${name}, leaving $name to the shell of the container.
+var paramPattern = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// paramExpander replaces ${name} with workflow parameters, and records unset parameters.
+type paramExpander struct {
+	params  *cloudflow.Params
+	missing []string
+}
+
+func (e *paramExpander) expand(s string) string {
+	return paramPattern.ReplaceAllStringFunc(s, func(m string) string {
+		name := paramPattern.FindStringSubmatch(m)[1]
+		value, ok := e.params.Get(name)
+		if !ok && !containsString(e.missing, name) {
+			e.missing = append(e.missing, name)
+		}
+		return value
+	})
+}
+
+func (e *paramExpander) err() error {
+	if len(e.missing) == 0 {
+		return nil
+	}
+	return fmt.Errorf("cloudflow: workflow parameter %v is not set", strings.Join(e.missing, ","))
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package aws
+
+import (
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+var defaultLogTailLines = 20
+
+// logTail reads a CloudWatch Logs stream of a job or a container from where the last read ended,
+// and keeps the last lines to report them on failure.
+type logTail struct {
+	svc       *cloudwatchlogs.CloudWatchLogs
+	group     string
+	stream    string
+	prefix    string
+	logger    *log.Logger
+	maxLines  int
+	lines     []string
+	nextToken *string
+}
+
+func newLogTail(svc *cloudwatchlogs.CloudWatchLogs, group, prefix string, logger *log.Logger, maxLines int) *logTail {
+	return &logTail{svc: svc, group: group, prefix: prefix, logger: logger, maxLines: maxLines}
+}
+
+// fetch forwards the log events added since the last fetch to the logger.
+// Reading logs is best effort, so errors are logged instead of failing the job.
+func (lt *logTail) fetch(stream string) {
+	if stream == "" {
+		return
+	}
+	if stream != lt.stream {
+		lt.stream = stream
+		lt.nextToken = nil
+	}
+
+	for {
+		out, err := getLogEvents(lt.svc, &cloudwatchlogs.GetLogEventsInput{
+			LogGroupName:  aws.String(lt.group),
+			LogStreamName: aws.String(lt.stream),
+			NextToken:     lt.nextToken,
+			StartFromHead: aws.Bool(true),
+		})
+		if err != nil {
+			// the stream is created after the container starts
+			if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != cloudwatchlogs.ErrCodeResourceNotFoundException {
+				logf(lt.logger, "%s: failed to read logs of %v: %v", lt.prefix, lt.stream, err)
+			}
+			return
+		}
+		for _, event := range out.Events {
+			lt.add(aws.StringValue(event.Message))
+		}
+		if len(out.Events) == 0 || aws.StringValue(out.NextForwardToken) == aws.StringValue(lt.nextToken) {
+			lt.nextToken = out.NextForwardToken
+			return
+		}
+		lt.nextToken = out.NextForwardToken
+	}
+}
+
+func (lt *logTail) add(line string) {
+	logf(lt.logger, "%s: %s", lt.prefix, line)
+	if lt.maxLines <= 0 {
+		return
+	}
+	lt.lines = append(lt.lines, line)
+	if len(lt.lines) > lt.maxLines {
+		lt.lines = lt.lines[len(lt.lines)-lt.maxLines:]
+	}
+}
+
+// tail returns the last lines formatted to append to an error.
+func (lt *logTail) tail() string {
+	if len(lt.lines) == 0 {
+		return ""
+	}
+	return "\nlast log lines of " + lt.stream + ":\n" + strings.Join(lt.lines, "\n")
+}
+
+// for mock testing
+var getLogEvents = func(svc *cloudwatchlogs.CloudWatchLogs, input *cloudwatchlogs.GetLogEventsInput) (*cloudwatchlogs.GetLogEventsOutput, error) {
+	return svc.GetLogEvents(input)
+}
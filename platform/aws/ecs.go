@@ -0,0 +1,301 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/yonekawa/cloudflow/task"
+)
+
+// ECSContainerResult reports how a container of the task stopped.
+type ECSContainerResult struct {
+	TaskArn   string
+	Name      string
+	Essential bool
+	// ExitCode is nil when the container did not run, for example the image could not be pulled.
+	ExitCode *int64
+	Reason   string
+}
+
+// ECSRunTask runs Amazon ECS task on EC2 or Fargate and waits for it to stop.
+// Cluster, task definition, launch type, network configuration and container overrides
+// are given by RunTaskInput.
+//
+// The task fails when any essential container exits with non-zero code.
+// The task is stopped when it times out or the context is cancelled.
+// Logs of the containers using awslogs driver with a stream prefix are forwarded to Logger.
+type ECSRunTask struct {
+	Session      *session.Session
+	RunTaskInput *ecs.RunTaskInput
+	PollingTime  time.Duration
+	Timeout      time.Duration
+	// StopReason is the reason passed to StopTask.
+	StopReason string
+	Logger     *log.Logger
+	// LogTailLines is the number of the last log lines included in the error on failure.
+	LogTailLines int
+
+	// TaskArns and Containers of the latest run.
+	TaskArns   []string
+	Containers []*ECSContainerResult
+}
+
+// NewECSRunTask creates a task running ECS task.
+func NewECSRunTask(sess *session.Session, input *ecs.RunTaskInput) *ECSRunTask {
+	return &ECSRunTask{
+		Session:      sess,
+		RunTaskInput: input,
+		PollingTime:  defaultPollingTime,
+		Timeout:      defaultTimeout,
+		StopReason:   defaultTerminateReason,
+		LogTailLines: defaultLogTailLines,
+	}
+}
+
+// SetLogger sets log writer.
+func (et *ECSRunTask) SetLogger(logger *log.Logger) {
+	et.Logger = logger
+}
+
+// Execute implement Task.Execute.
+func (et *ECSRunTask) Execute() error {
+	return et.ExecuteContext(context.Background())
+}
+
+// ExecuteContext implement ContextTask.ExecuteContext.
+func (et *ECSRunTask) ExecuteContext(ctx context.Context) error {
+	svc := ecs.New(et.Session)
+	et.TaskArns, et.Containers = nil, nil
+
+	def, err := describeTaskDefinition(svc, &ecs.DescribeTaskDefinitionInput{TaskDefinition: et.RunTaskInput.TaskDefinition})
+	if err != nil {
+		return err
+	}
+
+	out, err := runTask(svc, et.RunTaskInput)
+	if err != nil {
+		return err
+	}
+	for _, t := range out.Tasks {
+		et.TaskArns = append(et.TaskArns, aws.StringValue(t.TaskArn))
+	}
+	if len(out.Failures) > 0 {
+		reasons := make([]string, len(out.Failures))
+		for i, f := range out.Failures {
+			reasons[i] = fmt.Sprintf("%v %v", aws.StringValue(f.Arn), aws.StringValue(f.Reason))
+		}
+		err := fmt.Errorf("cloudflow: ecs task %v failed to run: %v", aws.StringValue(et.RunTaskInput.TaskDefinition), strings.Join(reasons, "; "))
+		if len(out.Tasks) > 0 {
+			if serr := et.stopTasks(svc); serr != nil {
+				return fmt.Errorf("%v, and stopping the started tasks failed: %v", err, serr)
+			}
+		}
+		return err
+	}
+	if len(out.Tasks) == 0 {
+		return fmt.Errorf("cloudflow: ecs task %v did not run", aws.StringValue(et.RunTaskInput.TaskDefinition))
+	}
+	logf(et.Logger, "cloudflow: started ecs tasks %v", strings.Join(et.TaskArns, ", "))
+
+	logs := et.logTails(def.TaskDefinition)
+	statuses := make(map[string]string, len(out.Tasks))
+	var tasks []*ecs.Task
+	sensor := task.NewSensorTask(func(ctx context.Context) (bool, error) {
+		describe, err := describeTasks(svc, &ecs.DescribeTasksInput{
+			Cluster: et.RunTaskInput.Cluster,
+			Tasks:   aws.StringSlice(et.TaskArns),
+		})
+		if err != nil {
+			return false, err
+		}
+		if len(describe.Failures) > 0 {
+			return false, fmt.Errorf("cloudflow: describe ecs task %v failed: %v",
+				aws.StringValue(describe.Failures[0].Arn), aws.StringValue(describe.Failures[0].Reason))
+		}
+		tasks = describe.Tasks
+
+		done := true
+		for i, t := range tasks {
+			id := ecsTaskID(aws.StringValue(t.TaskArn))
+			if status := aws.StringValue(t.LastStatus); status != statuses[id] {
+				logf(et.Logger, "%s: ecs task %v %v -> %v", aws.StringValue(def.TaskDefinition.Family), id, statuses[id], status)
+				statuses[id] = status
+			}
+			if i == 0 {
+				for _, lt := range logs {
+					lt.fetch(lt.streamName(id))
+				}
+			}
+			if aws.StringValue(t.LastStatus) != ecs.DesiredStatusStopped {
+				done = false
+			}
+		}
+		return done, nil
+	})
+	sensor.PollingTime = et.PollingTime
+	sensor.Timeout = et.Timeout
+
+	err = sensor.ExecuteContext(ctx)
+	switch {
+	case err == task.ErrSensorTimeout:
+		return et.stopWithCause(svc, "timed out")
+	case err != nil && ctx.Err() != nil:
+		return et.stopWithCause(svc, "cancelled")
+	case err != nil:
+		if serr := et.stopTasks(svc); serr != nil {
+			return fmt.Errorf("%v, and stopping the task failed: %v", err, serr)
+		}
+		return fmt.Errorf("%v, and the task was stopped", err)
+	}
+	return et.checkContainers(def.TaskDefinition, tasks, logs)
+}
+
+// checkContainers keeps the results of the stopped containers,
+// and returns error if any essential container failed.
+func (et *ECSRunTask) checkContainers(def *ecs.TaskDefinition, tasks []*ecs.Task, logs []*ecsLogTail) error {
+	essential := make(map[string]bool, len(def.ContainerDefinitions))
+	for _, c := range def.ContainerDefinitions {
+		// containers are essential unless it is disabled explicitly
+		essential[aws.StringValue(c.Name)] = c.Essential == nil || *c.Essential
+	}
+
+	var failures []string
+	for _, t := range tasks {
+		id := ecsTaskID(aws.StringValue(t.TaskArn))
+		for _, c := range t.Containers {
+			name := aws.StringValue(c.Name)
+			e, ok := essential[name]
+			result := &ECSContainerResult{
+				TaskArn:   aws.StringValue(t.TaskArn),
+				Name:      name,
+				Essential: e || !ok,
+				ExitCode:  c.ExitCode,
+				Reason:    aws.StringValue(c.Reason),
+			}
+			et.Containers = append(et.Containers, result)
+			if !result.Essential || (c.ExitCode != nil && *c.ExitCode == 0) {
+				continue
+			}
+
+			var failure string
+			if c.ExitCode == nil {
+				failure = fmt.Sprintf("container %v of task %v did not run", name, id)
+			} else {
+				failure = fmt.Sprintf("container %v of task %v exited with code %d", name, id, *c.ExitCode)
+			}
+			if result.Reason != "" {
+				failure += " by " + result.Reason
+			}
+			if reason := aws.StringValue(t.StoppedReason); reason != "" {
+				failure += " (" + reason + ")"
+			}
+			for _, lt := range logs {
+				if lt.container == name && lt.logTail.stream == lt.streamName(id) {
+					failure += lt.tail()
+				}
+			}
+			failures = append(failures, failure)
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("cloudflow: ecs task %v failed: %v", aws.StringValue(def.Family), strings.Join(failures, "; "))
+	}
+	logf(et.Logger, "%s: ecs tasks stopped successfully", aws.StringValue(def.Family))
+	return nil
+}
+
+// stopWithCause stops the running tasks, and returns error reporting why and whether the tasks were stopped.
+func (et *ECSRunTask) stopWithCause(svc *ecs.ECS, cause string) error {
+	ids := make([]string, len(et.TaskArns))
+	for i, arn := range et.TaskArns {
+		ids[i] = ecsTaskID(arn)
+	}
+	if err := et.stopTasks(svc); err != nil {
+		return fmt.Errorf("cloudflow: ecs task %v %s, and stopping the task failed: %v", strings.Join(ids, ", "), cause, err)
+	}
+	return fmt.Errorf("cloudflow: ecs task %v %s, and the task was stopped", strings.Join(ids, ", "), cause)
+}
+
+func (et *ECSRunTask) stopTasks(svc *ecs.ECS) error {
+	var errs []string
+	for _, arn := range et.TaskArns {
+		_, err := stopTask(svc, &ecs.StopTaskInput{
+			Cluster: et.RunTaskInput.Cluster,
+			Task:    aws.String(arn),
+			Reason:  aws.String(et.StopReason),
+		})
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// ecsLogTail is the log tail of a container using awslogs driver.
+type ecsLogTail struct {
+	*logTail
+	container    string
+	streamPrefix string
+}
+
+// streamName returns the log stream of the container in the task,
+// which awslogs driver names prefix/container/task-id.
+func (lt *ecsLogTail) streamName(taskID string) string {
+	return lt.streamPrefix + "/" + lt.container + "/" + taskID
+}
+
+// logTails returns the log tails of the containers whose log streams can be named.
+// Logs are read only from the first task when the task runs multiple copies.
+func (et *ECSRunTask) logTails(def *ecs.TaskDefinition) []*ecsLogTail {
+	var tails []*ecsLogTail
+	var svc *cloudwatchlogs.CloudWatchLogs
+	for _, c := range def.ContainerDefinitions {
+		conf := c.LogConfiguration
+		if conf == nil || aws.StringValue(conf.LogDriver) != ecs.LogDriverAwslogs {
+			continue
+		}
+		group, prefix := aws.StringValue(conf.Options["awslogs-group"]), aws.StringValue(conf.Options["awslogs-stream-prefix"])
+		if group == "" || prefix == "" {
+			continue
+		}
+		if svc == nil {
+			svc = cloudwatchlogs.New(et.Session)
+		}
+		name := aws.StringValue(c.Name)
+		tails = append(tails, &ecsLogTail{
+			logTail:      newLogTail(svc, group, name, et.Logger, et.LogTailLines),
+			container:    name,
+			streamPrefix: prefix,
+		})
+	}
+	return tails
+}
+
+// ecsTaskID returns the task id which is the last part of the task arn.
+func ecsTaskID(arn string) string {
+	return arn[strings.LastIndex(arn, "/")+1:]
+}
+
+// for mock testing
+var runTask = func(svc *ecs.ECS, input *ecs.RunTaskInput) (*ecs.RunTaskOutput, error) {
+	return svc.RunTask(input)
+}
+var describeTasks = func(svc *ecs.ECS, input *ecs.DescribeTasksInput) (*ecs.DescribeTasksOutput, error) {
+	return svc.DescribeTasks(input)
+}
+var stopTask = func(svc *ecs.ECS, input *ecs.StopTaskInput) (*ecs.StopTaskOutput, error) {
+	return svc.StopTask(input)
+}
+var describeTaskDefinition = func(svc *ecs.ECS, input *ecs.DescribeTaskDefinitionInput) (*ecs.DescribeTaskDefinitionOutput, error) {
+	return svc.DescribeTaskDefinition(input)
+}
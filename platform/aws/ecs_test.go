@@ -0,0 +1,170 @@
+package aws
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// TestECSRunTask_Execute does not run in parallel since it replaces getLogEvents shared with batch tests.
+func TestECSRunTask_Execute(t *testing.T) {
+	defaultGetLogEvents := getLogEvents
+	defer func() {
+		getLogEvents = defaultGetLogEvents
+	}()
+
+	sess, err := session.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	describeTaskDefinition = func(svc *ecs.ECS, input *ecs.DescribeTaskDefinitionInput) (*ecs.DescribeTaskDefinitionOutput, error) {
+		return &ecs.DescribeTaskDefinitionOutput{TaskDefinition: &ecs.TaskDefinition{
+			Family: aws.String("etl"),
+			ContainerDefinitions: []*ecs.ContainerDefinition{
+				{
+					Name: aws.String("app"),
+					LogConfiguration: &ecs.LogConfiguration{
+						LogDriver: aws.String("awslogs"),
+						Options:   aws.StringMap(map[string]string{"awslogs-group": "/ecs/etl", "awslogs-stream-prefix": "ecs"}),
+					},
+				},
+				{Name: aws.String("sidecar"), Essential: aws.Bool(false)},
+			},
+		}}, nil
+	}
+	var run *ecs.RunTaskInput
+	runTask = func(svc *ecs.ECS, input *ecs.RunTaskInput) (*ecs.RunTaskOutput, error) {
+		run = input
+		return &ecs.RunTaskOutput{Tasks: []*ecs.Task{{TaskArn: aws.String("arn:aws:ecs:task/cluster/0001")}}}, nil
+	}
+	exitCode := int64(0)
+	statuses := []string{"PROVISIONING", "RUNNING", "STOPPED"}
+	describeTasks = func(svc *ecs.ECS, input *ecs.DescribeTasksInput) (*ecs.DescribeTasksOutput, error) {
+		if aws.StringValue(input.Cluster) != "cluster" || aws.StringValueSlice(input.Tasks)[0] != "arn:aws:ecs:task/cluster/0001" {
+			t.Errorf("ecs task: invalid describe input: %v", input)
+		}
+		status := statuses[0]
+		if len(statuses) > 1 {
+			statuses = statuses[1:]
+		}
+		task := &ecs.Task{TaskArn: aws.String("arn:aws:ecs:task/cluster/0001"), LastStatus: aws.String(status)}
+		if status == "STOPPED" {
+			task.StoppedReason = aws.String("Essential container in task exited")
+			task.Containers = []*ecs.Container{
+				{Name: aws.String("app"), ExitCode: aws.Int64(exitCode)},
+				{Name: aws.String("sidecar"), ExitCode: aws.Int64(137)},
+			}
+		}
+		return &ecs.DescribeTasksOutput{Tasks: []*ecs.Task{task}}, nil
+	}
+	var events []*cloudwatchlogs.OutputLogEvent
+	getLogEvents = func(svc *cloudwatchlogs.CloudWatchLogs, input *cloudwatchlogs.GetLogEventsInput) (*cloudwatchlogs.GetLogEventsOutput, error) {
+		if aws.StringValue(input.LogGroupName) != "/ecs/etl" || aws.StringValue(input.LogStreamName) != "ecs/app/0001" {
+			t.Errorf("ecs task: invalid log stream: %v", input)
+		}
+		if input.NextToken != nil {
+			return &cloudwatchlogs.GetLogEventsOutput{NextForwardToken: input.NextToken}, nil
+		}
+		return &cloudwatchlogs.GetLogEventsOutput{Events: events, NextForwardToken: aws.String("f/1")}, nil
+	}
+
+	input := &ecs.RunTaskInput{
+		Cluster:        aws.String("cluster"),
+		TaskDefinition: aws.String("etl"),
+		LaunchType:     aws.String(ecs.LaunchTypeFargate),
+	}
+	et := NewECSRunTask(sess, input)
+	et.PollingTime = 10 * time.Microsecond
+	var buf bytes.Buffer
+	et.SetLogger(log.New(&buf, "", 0))
+	events = []*cloudwatchlogs.OutputLogEvent{{Message: aws.String("loaded")}}
+	if err := et.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if run != input {
+		t.Errorf("ecs task: invalid run input: %v", run)
+	}
+	if len(et.TaskArns) != 1 || len(et.Containers) != 2 || !et.Containers[0].Essential || et.Containers[1].Essential {
+		t.Errorf("ecs task: invalid result: %v %v", et.TaskArns, et.Containers)
+	}
+	if logs := buf.String(); !strings.Contains(logs, "etl: ecs task 0001 PROVISIONING -> RUNNING\n") || !strings.Contains(logs, "app: loaded\n") {
+		t.Errorf("ecs task: invalid logs: %q", logs)
+	}
+
+	// essential container failed
+	exitCode = 1
+	statuses = []string{"RUNNING", "STOPPED"}
+	events = []*cloudwatchlogs.OutputLogEvent{{Message: aws.String("no such file")}}
+	err = et.Execute()
+	if err == nil {
+		t.Fatal("ecs task: failed container must be error")
+	}
+	if expected := "container app of task 0001 exited with code 1 (Essential container in task exited)\nlast log lines of ecs/app/0001:\nno such file"; !strings.HasSuffix(err.Error(), expected) {
+		t.Errorf("ecs task: invalid failure: %v", err)
+	}
+	if strings.Contains(err.Error(), "sidecar") {
+		t.Errorf("ecs task: non essential container must not fail the task: %v", err)
+	}
+
+	// run failure
+	runTask = func(svc *ecs.ECS, input *ecs.RunTaskInput) (*ecs.RunTaskOutput, error) {
+		return &ecs.RunTaskOutput{Failures: []*ecs.Failure{{Arn: aws.String("arn:container-instance"), Reason: aws.String("RESOURCE:MEMORY")}}}, nil
+	}
+	if err := et.Execute(); err == nil || !strings.Contains(err.Error(), "failed to run: arn:container-instance RESOURCE:MEMORY") {
+		t.Errorf("ecs task: invalid run failure: %v", err)
+	}
+
+	// cancelled task is stopped
+	runTask = func(svc *ecs.ECS, input *ecs.RunTaskInput) (*ecs.RunTaskOutput, error) {
+		return &ecs.RunTaskOutput{Tasks: []*ecs.Task{{TaskArn: aws.String("arn:aws:ecs:task/cluster/0001")}}}, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	describeTasks = func(svc *ecs.ECS, input *ecs.DescribeTasksInput) (*ecs.DescribeTasksOutput, error) {
+		cancel()
+		return &ecs.DescribeTasksOutput{Tasks: []*ecs.Task{{TaskArn: aws.String("arn:aws:ecs:task/cluster/0001"), LastStatus: aws.String("RUNNING")}}}, nil
+	}
+	var stopped *ecs.StopTaskInput
+	stopTask = func(svc *ecs.ECS, input *ecs.StopTaskInput) (*ecs.StopTaskOutput, error) {
+		stopped = input
+		return &ecs.StopTaskOutput{}, nil
+	}
+	et.PollingTime = time.Minute
+	if err := et.ExecuteContext(ctx); err == nil || !strings.Contains(err.Error(), "ecs task 0001 cancelled, and the task was stopped") {
+		t.Errorf("ecs task: invalid cancel error: %v", err)
+	}
+	if stopped == nil || aws.StringValue(stopped.Task) != "arn:aws:ecs:task/cluster/0001" || aws.StringValue(stopped.Cluster) != "cluster" || aws.StringValue(stopped.Reason) != defaultTerminateReason {
+		t.Errorf("ecs task: cancelled task is not stopped: %v", stopped)
+	}
+
+	// timed out task is stopped
+	stopped = nil
+	et.PollingTime = time.Millisecond
+	et.Timeout = 10 * time.Millisecond
+	if err := et.Execute(); err == nil || !strings.Contains(err.Error(), "ecs task 0001 timed out, and the task was stopped") {
+		t.Errorf("ecs task: invalid timeout error: %v", err)
+	}
+	if stopped == nil {
+		t.Error("ecs task: timed out task is not stopped")
+	}
+
+	// task failed to describe is stopped
+	stopped = nil
+	describeTasks = func(svc *ecs.ECS, input *ecs.DescribeTasksInput) (*ecs.DescribeTasksOutput, error) {
+		return &ecs.DescribeTasksOutput{Failures: []*ecs.Failure{{Arn: aws.String("arn:aws:ecs:task/cluster/0001"), Reason: aws.String("MISSING")}}}, nil
+	}
+	if err := et.Execute(); err == nil || !strings.Contains(err.Error(), "describe ecs task arn:aws:ecs:task/cluster/0001 failed: MISSING, and the task was stopped") {
+		t.Errorf("ecs task: invalid describe failure: %v", err)
+	}
+	if stopped == nil {
+		t.Error("ecs task: task failed to describe is not stopped")
+	}
+}
@@ -1,14 +1,81 @@
 package aws
 
 import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/yonekawa/cloudflow"
+	"github.com/yonekawa/cloudflow/task"
 )
 
+// LambdaFunctionError reports the error thrown by the lambda function.
+type LambdaFunctionError struct {
+	FunctionName string
+	// FunctionError is Handled or Unhandled.
+	FunctionError string
+	ErrorMessage  string
+	ErrorType     string
+	StackTrace    []string
+	// Payload is the raw error payload.
+	Payload []byte
+}
+
+func (e *LambdaFunctionError) Error() string {
+	return fmt.Sprintf("cloudflow: lambda function %v failed by %v error %v: %v", e.FunctionName, e.FunctionError, e.ErrorType, e.ErrorMessage)
+}
+
+func newLambdaFunctionError(name string, out *lambda.InvokeOutput) *LambdaFunctionError {
+	e := &LambdaFunctionError{
+		FunctionName:  name,
+		FunctionError: aws.StringValue(out.FunctionError),
+		Payload:       out.Payload,
+	}
+	var payload struct {
+		ErrorMessage string   `json:"errorMessage"`
+		ErrorType    string   `json:"errorType"`
+		StackTrace   []string `json:"stackTrace"`
+	}
+	if err := json.Unmarshal(out.Payload, &payload); err == nil {
+		e.ErrorMessage, e.ErrorType, e.StackTrace = payload.ErrorMessage, payload.ErrorType, payload.StackTrace
+	} else {
+		e.ErrorMessage = string(out.Payload)
+	}
+	return e
+}
+
 // LambdaInvokeTask invokes lambda function.
+// It returns *LambdaFunctionError when the function throws error.
+//
+// When Completion is set, the function is invoked asynchronously
+// and the task polls Completion until the invocation completes or Timeout elapses.
 type LambdaInvokeTask struct {
 	Session     *session.Session
 	InvokeInput *lambda.InvokeInput
+
+	Completion  LambdaCompletion
+	PollingTime time.Duration
+	Timeout     time.Duration
+
+	// Result receives the response payload decoded as json if not nil.
+	Result interface{}
+	// ResultParam is the workflow parameter receiving the response payload.
+	ResultParam string
+	// Logger receives the log tail of the function when InvokeInput.LogType is Tail.
+	Logger *log.Logger
+
+	// Payload is the response payload of the latest invocation.
+	Payload []byte
+	// RequestID of the latest asynchronous invocation.
+	RequestID string
 }
 
 // NewLambdaInvokeTask creates a lambda invoke task.
@@ -16,24 +83,106 @@ func NewLambdaInvokeTask(sess *session.Session, input *lambda.InvokeInput) *Lamb
 	return &LambdaInvokeTask{
 		Session:     sess,
 		InvokeInput: input,
+		PollingTime: defaultLambdaPollingTime,
+		Timeout:     defaultTimeout,
 	}
 }
 
+// SetLogger sets log writer.
+func (li *LambdaInvokeTask) SetLogger(logger *log.Logger) {
+	li.Logger = logger
+}
+
 // Execute implement Task.Execute.
 func (li *LambdaInvokeTask) Execute() error {
+	return li.ExecuteContext(context.Background())
+}
+
+// ExecuteContext implement ContextTask.ExecuteContext.
+func (li *LambdaInvokeTask) ExecuteContext(ctx context.Context) error {
 	f := lambda.New(li.Session)
 
-	_, err := invoke(f, li.InvokeInput)
+	li.Payload = nil
+	if li.Completion != nil {
+		return li.executeAsync(ctx, f)
+	}
+	out, err := invoke(ctx, f, li.InvokeInput)
 	if err != nil {
 		return err
 	}
+	name := aws.StringValue(li.InvokeInput.FunctionName)
+	logLambdaTail(li.Logger, name, out.LogResult)
+	if out.FunctionError != nil {
+		return newLambdaFunctionError(name, out)
+	}
+	return li.setPayload(ctx, out.Payload)
+}
+
+func (li *LambdaInvokeTask) executeAsync(ctx context.Context, f *lambda.Lambda) error {
+	input := *li.InvokeInput
+	input.InvocationType = aws.String(lambda.InvocationTypeEvent)
+	input.LogType = nil
 
-	// TODO: Notify invoke result
+	li.RequestID = ""
+	invokedAt := time.Now()
+	requestID, err := invokeAsync(ctx, f, &input)
+	if err != nil {
+		return err
+	}
+	li.RequestID = requestID
+	inv := &LambdaInvocation{FunctionName: aws.StringValue(input.FunctionName), RequestID: requestID, InvokedAt: invokedAt}
+	logf(li.Logger, "%s: invoked asynchronously request id:%v", inv.FunctionName, requestID)
+	if ls, ok := li.Completion.(interface{ SetLogger(*log.Logger) }); ok {
+		ls.SetLogger(li.Logger)
+	}
+
+	var payload []byte
+	sensor := task.NewSensorTask(func(ctx context.Context) (bool, error) {
+		done, p, err := li.Completion.Check(ctx, li.Session, inv)
+		payload = p
+		return done, err
+	})
+	sensor.PollingTime = li.PollingTime
+	sensor.Timeout = li.Timeout
+	if err := sensor.ExecuteContext(ctx); err == task.ErrSensorTimeout {
+		return fmt.Errorf("cloudflow: lambda function %v request id:%v timed out", inv.FunctionName, requestID)
+	} else if err != nil {
+		return err
+	}
+	return li.setPayload(ctx, payload)
+}
 
+// setPayload keeps the response payload, and passes it to Result and ResultParam.
+func (li *LambdaInvokeTask) setPayload(ctx context.Context, payload []byte) error {
+	li.Payload = payload
+	if li.Result != nil && len(payload) > 0 {
+		if err := json.Unmarshal(payload, li.Result); err != nil {
+			return fmt.Errorf("cloudflow: decode payload of lambda function %v failed: %v", aws.StringValue(li.InvokeInput.FunctionName), err)
+		}
+	}
+	if params := cloudflow.ParamsFromContext(ctx); li.ResultParam != "" && params != nil {
+		params.Set(li.ResultParam, string(payload))
+	}
 	return nil
 }
 
+// logLambdaTail writes the base64 encoded log tail into logger prefixed with the function name.
+func logLambdaTail(logger *log.Logger, name string, logResult *string) {
+	if logger == nil || logResult == nil {
+		return
+	}
+	tail, err := base64.StdEncoding.DecodeString(*logResult)
+	if err != nil {
+		logf(logger, "%s: invalid log tail: %v", name, err)
+		return
+	}
+	scanner := bufio.NewScanner(strings.NewReader(string(tail)))
+	for scanner.Scan() {
+		logf(logger, "%s: %s", name, scanner.Text())
+	}
+}
+
 // for mock testing
-var invoke = func(f *lambda.Lambda, input *lambda.InvokeInput) (*lambda.InvokeOutput, error) {
-	return f.Invoke(input)
+var invoke = func(ctx context.Context, f *lambda.Lambda, input *lambda.InvokeInput) (*lambda.InvokeOutput, error) {
+	return f.InvokeWithContext(ctx, input)
 }
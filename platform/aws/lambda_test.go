@@ -1,18 +1,27 @@
 package aws
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"errors"
+	"log"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/yonekawa/cloudflow"
 )
 
 func TestLambdaInvokeTask_Execute(t *testing.T) {
 	t.Parallel()
 
-	invoke = func(f *lambda.Lambda, input *lambda.InvokeInput) (*lambda.InvokeOutput, error) {
+	invoke = func(ctx context.Context, f *lambda.Lambda, input *lambda.InvokeInput) (*lambda.InvokeOutput, error) {
 		return &lambda.InvokeOutput{StatusCode: aws.Int64(200)}, nil
 	}
 
@@ -25,11 +34,252 @@ func TestLambdaInvokeTask_Execute(t *testing.T) {
 		t.Error(err)
 	}
 
-	invoke = func(f *lambda.Lambda, input *lambda.InvokeInput) (*lambda.InvokeOutput, error) {
+	invoke = func(ctx context.Context, f *lambda.Lambda, input *lambda.InvokeInput) (*lambda.InvokeOutput, error) {
 		return &lambda.InvokeOutput{StatusCode: aws.Int64(500)}, errors.New("error")
 	}
 
 	if err := task.Execute(); err == nil {
 		t.Error("expect to fail task but it succeeded")
 	}
+
+	testLambdaInvokeTaskFunctionError(t, sess)
+	testLambdaInvokeTaskPayload(t, sess)
+}
+
+func testLambdaInvokeTaskFunctionError(t *testing.T, sess *session.Session) {
+	invoke = func(ctx context.Context, f *lambda.Lambda, input *lambda.InvokeInput) (*lambda.InvokeOutput, error) {
+		return &lambda.InvokeOutput{
+			StatusCode:    aws.Int64(200),
+			FunctionError: aws.String("Unhandled"),
+			Payload:       []byte(`{"errorMessage":"division by zero","errorType":"ZeroDivisionError","stackTrace":["handler.py:3"]}`),
+		}, nil
+	}
+
+	task := NewLambdaInvokeTask(sess, &lambda.InvokeInput{FunctionName: aws.String("MyFunc")})
+	err := task.Execute()
+	ferr, ok := err.(*LambdaFunctionError)
+	if !ok {
+		t.Fatalf("lambda: function error must be *LambdaFunctionError but %v", err)
+	}
+	if ferr.FunctionError != "Unhandled" || ferr.ErrorType != "ZeroDivisionError" || ferr.ErrorMessage != "division by zero" || len(ferr.StackTrace) != 1 {
+		t.Errorf("lambda: invalid function error: %+v", ferr)
+	}
+	if expected := "cloudflow: lambda function MyFunc failed by Unhandled error ZeroDivisionError: division by zero"; err.Error() != expected {
+		t.Errorf("lambda: invalid error message: %v", err)
+	}
+}
+
+func testLambdaInvokeTaskPayload(t *testing.T, sess *session.Session) {
+	logTail := base64.StdEncoding.EncodeToString([]byte("START RequestId: 1\nprocessed 3 records\nEND RequestId: 1\n"))
+	invoke = func(ctx context.Context, f *lambda.Lambda, input *lambda.InvokeInput) (*lambda.InvokeOutput, error) {
+		return &lambda.InvokeOutput{
+			StatusCode: aws.Int64(200),
+			Payload:    []byte(`{"records":3,"output":"s3://bucket/out"}`),
+			LogResult:  aws.String(logTail),
+		}, nil
+	}
+
+	var result struct {
+		Records int    `json:"records"`
+		Output  string `json:"output"`
+	}
+	task := NewLambdaInvokeTask(sess, &lambda.InvokeInput{FunctionName: aws.String("MyFunc"), LogType: aws.String("Tail")})
+	task.Result = &result
+	task.ResultParam = "process_result"
+	var buf bytes.Buffer
+	task.SetLogger(log.New(&buf, "", 0))
+
+	params := cloudflow.NewParams(nil)
+	if err := task.ExecuteContext(cloudflow.WithParams(context.Background(), params)); err != nil {
+		t.Fatal(err)
+	}
+	if result.Records != 3 || result.Output != "s3://bucket/out" {
+		t.Errorf("lambda: invalid decoded result: %+v", result)
+	}
+	if value, _ := params.Get("process_result"); value != `{"records":3,"output":"s3://bucket/out"}` {
+		t.Errorf("lambda: payload is not set to param: %v", value)
+	}
+	if logs := buf.String(); logs != "MyFunc: START RequestId: 1\nMyFunc: processed 3 records\nMyFunc: END RequestId: 1\n" {
+		t.Errorf("lambda: invalid log tail: %q", logs)
+	}
+
+	invoke = func(ctx context.Context, f *lambda.Lambda, input *lambda.InvokeInput) (*lambda.InvokeOutput, error) {
+		return &lambda.InvokeOutput{StatusCode: aws.Int64(200), Payload: []byte(`"not object"`)}, nil
+	}
+	if err := task.Execute(); err == nil {
+		t.Error("lambda: payload not decodable into result must be error")
+	}
+}
+
+func TestLambdaInvokeTask_Async(t *testing.T) {
+	defaultInvokeAsync, defaultReceiveMessage, defaultDeleteMessage, defaultChangeMessageVisibility := invokeAsync, receiveMessage, deleteMessage, changeMessageVisibility
+	defaultFilterLogEvents := filterLogEvents
+	defer func() {
+		invokeAsync, receiveMessage, deleteMessage, changeMessageVisibility = defaultInvokeAsync, defaultReceiveMessage, defaultDeleteMessage, defaultChangeMessageVisibility
+		filterLogEvents = defaultFilterLogEvents
+	}()
+
+	// lambda and sqs are mocked, s3 completion reads the test server
+	server := newTestS3Server()
+	defer server.Close()
+	sess := server.session(t)
+	invokeAsync = func(ctx context.Context, f *lambda.Lambda, input *lambda.InvokeInput) (string, error) {
+		if aws.StringValue(input.InvocationType) != lambda.InvocationTypeEvent {
+			t.Errorf("lambda async: invalid invocation type: %v", aws.StringValue(input.InvocationType))
+		}
+		return "request-1", nil
+	}
+	newTask := func(completion LambdaCompletion) *LambdaInvokeTask {
+		task := NewLambdaInvokeTask(sess, &lambda.InvokeInput{FunctionName: aws.String("arn:aws:lambda:us-east-1:000000000000:function:MyFunc:prod")})
+		task.Completion = completion
+		task.PollingTime = 10 * time.Microsecond
+		task.Timeout = time.Second
+		return task
+	}
+
+	testLambdaAsyncSQS(t, newTask)
+	testLambdaAsyncS3(t, newTask, server)
+	testLambdaAsyncLogs(t, newTask)
+
+	timeout := newTask(NewLambdaS3Completion("bucket", "never"))
+	timeout.Timeout = 10 * time.Millisecond
+	if err := timeout.Execute(); err == nil || !strings.Contains(err.Error(), "request id:request-1 timed out") {
+		t.Errorf("lambda async: invalid timeout error: %v", err)
+	}
+}
+
+func testLambdaAsyncSQS(t *testing.T, newTask func(LambdaCompletion) *LambdaInvokeTask) {
+	records := []string{
+		`{"requestContext":{"requestId":"other","condition":"Success"}}`,
+		`{"requestContext":{"requestId":"request-1","condition":"Success"},"responseContext":{"statusCode":200},"responsePayload":{"ok":true}}`,
+	}
+	receiveMessage = func(svc *sqs.SQS, input *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+		if aws.StringValue(input.QueueUrl) != "https://sqs/queue" {
+			t.Errorf("lambda async: invalid queue: %v", input)
+		}
+		if len(records) == 0 {
+			return &sqs.ReceiveMessageOutput{}, nil
+		}
+		body := records[0]
+		records = records[1:]
+		return &sqs.ReceiveMessageOutput{Messages: []*sqs.Message{{Body: aws.String(body), ReceiptHandle: aws.String(body)}}}, nil
+	}
+	var released, deleted []string
+	changeMessageVisibility = func(svc *sqs.SQS, input *sqs.ChangeMessageVisibilityInput) (*sqs.ChangeMessageVisibilityOutput, error) {
+		released = append(released, aws.StringValue(input.ReceiptHandle))
+		return &sqs.ChangeMessageVisibilityOutput{}, nil
+	}
+	deleteMessage = func(svc *sqs.SQS, input *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+		deleted = append(deleted, aws.StringValue(input.ReceiptHandle))
+		return &sqs.DeleteMessageOutput{}, nil
+	}
+
+	var result struct {
+		OK bool `json:"ok"`
+	}
+	task := newTask(NewLambdaSQSCompletion("https://sqs/queue"))
+	task.Result = &result
+	if err := task.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if task.RequestID != "request-1" || !result.OK || string(task.Payload) != `{"ok":true}` {
+		t.Errorf("lambda async: invalid result of sqs completion: %v %s", task.RequestID, task.Payload)
+	}
+	if len(released) != 1 || !strings.Contains(released[0], `"other"`) || len(deleted) != 1 || !strings.Contains(deleted[0], `"request-1"`) {
+		t.Errorf("lambda async: records of other invocations must be released: released:%v deleted:%v", released, deleted)
+	}
+
+	// failure to release is logged
+	records = []string{
+		`{"requestContext":{"requestId":"other","condition":"Success"}}`,
+		`{"requestContext":{"requestId":"request-1","condition":"Success"},"responseContext":{"statusCode":200},"responsePayload":{"ok":true}}`,
+	}
+	changeMessageVisibility = func(svc *sqs.SQS, input *sqs.ChangeMessageVisibilityInput) (*sqs.ChangeMessageVisibilityOutput, error) {
+		return nil, errors.New("access denied")
+	}
+	var buf bytes.Buffer
+	task.SetLogger(log.New(&buf, "", 0))
+	if err := task.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "release sqs message") || !strings.Contains(buf.String(), "access denied") {
+		t.Errorf("lambda async: release failure is not logged: %v", buf.String())
+	}
+	task.SetLogger(nil)
+
+	records = []string{`{"requestContext":{"requestId":"request-1","condition":"RetriesExhausted"},"responseContext":{"functionError":"Unhandled"},"responsePayload":{"errorMessage":"boom","errorType":"Error"}}`}
+	err := task.Execute()
+	if ferr, ok := err.(*LambdaFunctionError); !ok || ferr.ErrorMessage != "boom" {
+		t.Errorf("lambda async: function error must be *LambdaFunctionError: %v", err)
+	}
+}
+
+func testLambdaAsyncS3(t *testing.T, newTask func(LambdaCompletion) *LambdaInvokeTask, server *testS3Server) {
+	gets := 0
+	server.mu.Lock()
+	server.onRequest = func(req testS3Request) {
+		if gets++; gets == 3 {
+			server.objects["results/MyFunc/request-1.json"] = []byte(`{"ok":true}`)
+		}
+	}
+	server.mu.Unlock()
+	defer func() {
+		server.mu.Lock()
+		server.onRequest = nil
+		server.mu.Unlock()
+	}()
+
+	completion := NewLambdaS3Completion("bucket", "results/${function_name}/${request_id}.json")
+	completion.ErrorKey = "errors/${request_id}"
+	task := newTask(completion)
+	if err := task.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if string(task.Payload) != `{"ok":true}` {
+		t.Errorf("lambda async: invalid payload of s3 completion: %s", task.Payload)
+	}
+
+	server.mu.Lock()
+	server.objects["errors/request-1"] = []byte("invalid partition")
+	server.mu.Unlock()
+	if err := task.Execute(); err == nil || !strings.Contains(err.Error(), "failed: invalid partition") {
+		t.Errorf("lambda async: error object must fail the task: %v", err)
+	}
+}
+
+func testLambdaAsyncLogs(t *testing.T, newTask func(LambdaCompletion) *LambdaInvokeTask) {
+	var patterns []string
+	filterLogEvents = func(svc *cloudwatchlogs.CloudWatchLogs, input *cloudwatchlogs.FilterLogEventsInput) (*cloudwatchlogs.FilterLogEventsOutput, error) {
+		if aws.StringValue(input.LogGroupName) != "/aws/lambda/MyFunc" || aws.Int64Value(input.StartTime) == 0 {
+			t.Errorf("lambda async: invalid filter input: %v", input)
+		}
+		pattern := aws.StringValue(input.FilterPattern)
+		patterns = append(patterns, pattern)
+		if pattern != `"REPORT RequestId: request-1"` {
+			return &cloudwatchlogs.FilterLogEventsOutput{}, nil
+		}
+		// the marker is found in the second page
+		if input.NextToken == nil {
+			return &cloudwatchlogs.FilterLogEventsOutput{NextToken: aws.String("next")}, nil
+		}
+		return &cloudwatchlogs.FilterLogEventsOutput{Events: []*cloudwatchlogs.FilteredLogEvent{{Message: aws.String("REPORT RequestId: request-1 Duration: 10 ms")}}}, nil
+	}
+
+	completion := NewLambdaLogsCompletion(`"${request_id}" "ERROR"`)
+	if err := newTask(completion).Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if len(patterns) != 3 || patterns[0] != `"request-1" "ERROR"` {
+		t.Errorf("lambda async: invalid filter patterns: %v", patterns)
+	}
+
+	// the REPORT line is written after failed attempts too
+	patterns = nil
+	completion.ErrorPattern = ""
+	if err := newTask(completion).Execute(); err == nil || !strings.Contains(err.Error(), "error pattern") {
+		t.Errorf("lambda async: logs completion without error pattern must be error: %v", err)
+	}
+	if len(patterns) != 0 {
+		t.Errorf("lambda async: logs are filtered without error pattern: %v", patterns)
+	}
 }
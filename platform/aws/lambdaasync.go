@@ -0,0 +1,261 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/yonekawa/cloudflow/storage"
+)
+
+var defaultLambdaPollingTime = 10 * time.Second
+
+// LambdaInvocation is an asynchronous invocation waiting for completion.
+type LambdaInvocation struct {
+	FunctionName string
+	RequestID    string
+	InvokedAt    time.Time
+}
+
+// expand replaces ${request_id} and ${function_name} in s.
+func (inv *LambdaInvocation) expand(s string) string {
+	return os.Expand(s, func(name string) string {
+		switch name {
+		case "request_id":
+			return inv.RequestID
+		case "function_name":
+			return lambdaFunctionName(inv.FunctionName)
+		}
+		return "${" + name + "}"
+	})
+}
+
+// LambdaCompletion checks the completion of an asynchronous invocation.
+// Check returns done with the result payload, or error when the invocation failed.
+type LambdaCompletion interface {
+	Check(ctx context.Context, sess *session.Session, inv *LambdaInvocation) (done bool, payload []byte, err error)
+}
+
+// LambdaSQSCompletion waits for the record sent to the SQS queue by Lambda destinations.
+// The record of the invocation is deleted, and other records are left in the queue.
+type LambdaSQSCompletion struct {
+	QueueURL string
+	Logger   *log.Logger
+}
+
+// NewLambdaSQSCompletion creates a completion watching the SQS queue of Lambda destinations.
+func NewLambdaSQSCompletion(queueURL string) *LambdaSQSCompletion {
+	return &LambdaSQSCompletion{QueueURL: queueURL}
+}
+
+// SetLogger sets log writer. LambdaInvokeTask passes its logger.
+func (c *LambdaSQSCompletion) SetLogger(logger *log.Logger) {
+	c.Logger = logger
+}
+
+type lambdaDestinationRecord struct {
+	RequestContext struct {
+		RequestID string `json:"requestId"`
+		Condition string `json:"condition"`
+	} `json:"requestContext"`
+	ResponseContext struct {
+		FunctionError string `json:"functionError"`
+	} `json:"responseContext"`
+	ResponsePayload json.RawMessage `json:"responsePayload"`
+}
+
+// Check implement LambdaCompletion.Check.
+func (c *LambdaSQSCompletion) Check(ctx context.Context, sess *session.Session, inv *LambdaInvocation) (bool, []byte, error) {
+	svc := sqs.New(sess)
+	out, err := receiveMessage(svc, &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(c.QueueURL),
+		MaxNumberOfMessages: aws.Int64(10),
+	})
+	if err != nil {
+		return false, nil, err
+	}
+
+	var found *lambdaDestinationRecord
+	for _, msg := range out.Messages {
+		var record lambdaDestinationRecord
+		if err := json.Unmarshal([]byte(aws.StringValue(msg.Body)), &record); err != nil || record.RequestContext.RequestID != inv.RequestID {
+			// release the record of other invocations,
+			// which is received again after the visibility timeout on failure
+			if _, err := changeMessageVisibility(svc, &sqs.ChangeMessageVisibilityInput{
+				QueueUrl:          aws.String(c.QueueURL),
+				ReceiptHandle:     msg.ReceiptHandle,
+				VisibilityTimeout: aws.Int64(0),
+			}); err != nil {
+				logf(c.Logger, "%s: release sqs message %v failed: %v", inv.FunctionName, aws.StringValue(msg.MessageId), err)
+			}
+			continue
+		}
+		if _, err := deleteMessage(svc, &sqs.DeleteMessageInput{QueueUrl: aws.String(c.QueueURL), ReceiptHandle: msg.ReceiptHandle}); err != nil {
+			return false, nil, err
+		}
+		found = &record
+	}
+	if found == nil {
+		return false, nil, nil
+	}
+
+	if found.ResponseContext.FunctionError != "" {
+		return true, nil, newLambdaFunctionError(inv.FunctionName, &lambda.InvokeOutput{
+			FunctionError: aws.String(found.ResponseContext.FunctionError),
+			Payload:       found.ResponsePayload,
+		})
+	}
+	if found.RequestContext.Condition != "Success" {
+		return true, nil, fmt.Errorf("cloudflow: lambda function %v request id:%v failed by %v", inv.FunctionName, inv.RequestID, found.RequestContext.Condition)
+	}
+	return true, found.ResponsePayload, nil
+}
+
+// LambdaS3Completion waits for the function to put the result object into the S3 bucket.
+// Key and ErrorKey can contain ${request_id} and ${function_name}.
+type LambdaS3Completion struct {
+	Bucket string
+	Key    string
+	// ErrorKey is the object put on failure. The content is reported as error.
+	ErrorKey string
+}
+
+// NewLambdaS3Completion creates a completion watching the result object in S3.
+func NewLambdaS3Completion(bucket, key string) *LambdaS3Completion {
+	return &LambdaS3Completion{Bucket: bucket, Key: key}
+}
+
+// Check implement LambdaCompletion.Check.
+func (c *LambdaS3Completion) Check(ctx context.Context, sess *session.Session, inv *LambdaInvocation) (bool, []byte, error) {
+	bucket := NewS3Bucket(sess, c.Bucket)
+	if c.ErrorKey != "" {
+		found, content, err := c.read(ctx, bucket, inv.expand(c.ErrorKey))
+		if err != nil || found {
+			if err == nil {
+				err = fmt.Errorf("cloudflow: lambda function %v request id:%v failed: %s", inv.FunctionName, inv.RequestID, content)
+			}
+			return found, nil, err
+		}
+	}
+	return c.read(ctx, bucket, inv.expand(c.Key))
+}
+
+func (c *LambdaS3Completion) read(ctx context.Context, bucket *S3Bucket, key string) (bool, []byte, error) {
+	r, err := bucket.Open(ctx, key)
+	if err == storage.ErrNotExist {
+		return false, nil, nil
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	defer r.Close()
+	content, err := ioutil.ReadAll(r)
+	return err == nil, content, err
+}
+
+// LambdaLogsCompletion waits for the marker of the request in CloudWatch Logs of the function.
+// Pattern and ErrorPattern are filter patterns, and can contain ${request_id} and ${function_name}.
+//
+// The default pattern is the REPORT line written after each attempt including failed ones,
+// so ErrorPattern is required to tell failures from success.
+type LambdaLogsCompletion struct {
+	// LogGroupName is the log group of the function. Default is /aws/lambda/${function_name}.
+	LogGroupName string
+	Pattern      string
+	ErrorPattern string
+}
+
+// NewLambdaLogsCompletion creates a completion watching the REPORT line of the request,
+// which fails when errorPattern is found.
+func NewLambdaLogsCompletion(errorPattern string) *LambdaLogsCompletion {
+	return &LambdaLogsCompletion{
+		LogGroupName: "/aws/lambda/${function_name}",
+		Pattern:      `"REPORT RequestId: ${request_id}"`,
+		ErrorPattern: errorPattern,
+	}
+}
+
+// Check implement LambdaCompletion.Check.
+func (c *LambdaLogsCompletion) Check(ctx context.Context, sess *session.Session, inv *LambdaInvocation) (bool, []byte, error) {
+	if c.ErrorPattern == "" {
+		return false, nil, fmt.Errorf("cloudflow: error pattern of lambda function %v logs is not set", inv.FunctionName)
+	}
+	svc := cloudwatchlogs.New(sess)
+	message, err := c.find(svc, inv, c.ErrorPattern)
+	if err != nil || message != "" {
+		if err == nil {
+			err = fmt.Errorf("cloudflow: lambda function %v request id:%v failed: %s", inv.FunctionName, inv.RequestID, message)
+		}
+		return message != "", nil, err
+	}
+	message, err = c.find(svc, inv, c.Pattern)
+	return message != "", nil, err
+}
+
+// find returns the first log message matching pattern since the invocation.
+func (c *LambdaLogsCompletion) find(svc *cloudwatchlogs.CloudWatchLogs, inv *LambdaInvocation, pattern string) (string, error) {
+	group := c.LogGroupName
+	if group == "" {
+		group = "/aws/lambda/${function_name}"
+	}
+	input := &cloudwatchlogs.FilterLogEventsInput{
+		LogGroupName:  aws.String(inv.expand(group)),
+		FilterPattern: aws.String(inv.expand(pattern)),
+		StartTime:     aws.Int64(inv.InvokedAt.UnixNano() / int64(time.Millisecond)),
+	}
+	// pages can be empty until all log streams are searched
+	for {
+		out, err := filterLogEvents(svc, input)
+		if err != nil {
+			return "", err
+		}
+		if len(out.Events) > 0 {
+			return aws.StringValue(out.Events[0].Message), nil
+		}
+		if aws.StringValue(out.NextToken) == "" {
+			return "", nil
+		}
+		input.NextToken = out.NextToken
+	}
+}
+
+// lambdaFunctionName returns the function name of name, partial ARN or ARN with version or alias.
+func lambdaFunctionName(name string) string {
+	if i := strings.Index(name, "function:"); i >= 0 {
+		name = name[i+len("function:"):]
+	}
+	if i := strings.Index(name, ":"); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// for mock testing
+var invokeAsync = func(ctx context.Context, f *lambda.Lambda, input *lambda.InvokeInput) (string, error) {
+	req, _ := f.InvokeRequest(input)
+	req.SetContext(ctx)
+	err := req.Send()
+	return req.RequestID, err
+}
+var receiveMessage = func(svc *sqs.SQS, input *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	return svc.ReceiveMessage(input)
+}
+var deleteMessage = func(svc *sqs.SQS, input *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	return svc.DeleteMessage(input)
+}
+var changeMessageVisibility = func(svc *sqs.SQS, input *sqs.ChangeMessageVisibilityInput) (*sqs.ChangeMessageVisibilityOutput, error) {
+	return svc.ChangeMessageVisibility(input)
+}
+var filterLogEvents = func(svc *cloudwatchlogs.CloudWatchLogs, input *cloudwatchlogs.FilterLogEventsInput) (*cloudwatchlogs.FilterLogEventsOutput, error) {
+	return svc.FilterLogEvents(input)
+}
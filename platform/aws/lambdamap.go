@@ -0,0 +1,195 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/yonekawa/cloudflow"
+	"github.com/yonekawa/cloudflow/storage"
+)
+
+var defaultLambdaConcurrency = 10
+var defaultLambdaMaxRetries = 5
+var defaultLambdaRetryInterval = time.Second
+
+// LambdaMapFailure reports the payload failed to invoke.
+type LambdaMapFailure struct {
+	Index   int
+	Payload []byte
+	Err     error
+}
+
+// LambdaMapTask invokes lambda function with each payload by Concurrency invocations at once.
+// Throttled invocations are retried up to MaxRetries with exponential backoff.
+type LambdaMapTask struct {
+	Session      *session.Session
+	FunctionName string
+
+	// Payloads are the static payloads.
+	Payloads [][]byte
+	// PayloadsFunc returns payloads at execution, for example from the result of an earlier task.
+	PayloadsFunc func() ([][]byte, error)
+	// PayloadsParam is the workflow parameter of a json array whose elements are the payloads.
+	PayloadsParam string
+
+	Concurrency   int
+	MaxRetries    int
+	RetryInterval time.Duration
+
+	// ResultParam is the workflow parameter receiving the json array of the responses.
+	ResultParam string
+	Logger      *log.Logger
+
+	// Responses are the response payloads in the order of payloads. Failed payloads have nil.
+	Responses [][]byte
+	// Failed reports the failed payloads in order.
+	Failed []*LambdaMapFailure
+}
+
+// NewLambdaMapTask creates a task invoking lambda function with each payload.
+func NewLambdaMapTask(sess *session.Session, functionName string, payloads [][]byte) *LambdaMapTask {
+	return &LambdaMapTask{
+		Session:       sess,
+		FunctionName:  functionName,
+		Payloads:      payloads,
+		Concurrency:   defaultLambdaConcurrency,
+		MaxRetries:    defaultLambdaMaxRetries,
+		RetryInterval: defaultLambdaRetryInterval,
+	}
+}
+
+// SetLogger sets log writer.
+func (lm *LambdaMapTask) SetLogger(logger *log.Logger) {
+	lm.Logger = logger
+}
+
+// Execute implement Task.Execute.
+func (lm *LambdaMapTask) Execute() error {
+	return lm.ExecuteContext(context.Background())
+}
+
+// ExecuteContext implement ContextTask.ExecuteContext.
+// It returns error when any payload fails, after all payloads are invoked.
+func (lm *LambdaMapTask) ExecuteContext(ctx context.Context) error {
+	payloads, err := lm.payloads(ctx)
+	if err != nil {
+		return err
+	}
+
+	f := lambda.New(lm.Session)
+	lm.Responses = make([][]byte, len(payloads))
+	errs := make([]error, len(payloads))
+	started := make([]bool, len(payloads))
+	var mu sync.Mutex
+	// failed payloads are collected below, so the pool fails only by cancel which skips payloads not started
+	poolErr := storage.ForEach(ctx, len(payloads), lm.Concurrency, func(i int) error {
+		mu.Lock()
+		started[i] = true
+		mu.Unlock()
+		out, err := lm.invoke(ctx, f, payloads[i])
+		if err == nil && out.FunctionError != nil {
+			err = newLambdaFunctionError(lm.FunctionName, out)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			errs[i] = err
+			logf(lm.Logger, "%s: payload %d failed: %v", lm.FunctionName, i, err)
+			return nil
+		}
+		lm.Responses[i] = out.Payload
+		return nil
+	})
+
+	lm.Failed = nil
+	for i, err := range errs {
+		if !started[i] {
+			err = poolErr
+		}
+		if err != nil {
+			lm.Failed = append(lm.Failed, &LambdaMapFailure{Index: i, Payload: payloads[i], Err: err})
+		}
+	}
+
+	if err := lm.setResult(ctx); err != nil {
+		return err
+	}
+	if len(lm.Failed) > 0 {
+		indexes := make([]int, len(lm.Failed))
+		for i, failure := range lm.Failed {
+			indexes[i] = failure.Index
+		}
+		return fmt.Errorf("cloudflow: lambda function %v failed for %d of %d payloads: %v", lm.FunctionName, len(lm.Failed), len(payloads), indexes)
+	}
+	return nil
+}
+
+func (lm *LambdaMapTask) payloads(ctx context.Context) ([][]byte, error) {
+	switch {
+	case lm.PayloadsFunc != nil:
+		return lm.PayloadsFunc()
+	case lm.PayloadsParam != "":
+		value, ok := cloudflow.ParamsFromContext(ctx).Get(lm.PayloadsParam)
+		if !ok {
+			return nil, fmt.Errorf("cloudflow: workflow parameter %v is not set", lm.PayloadsParam)
+		}
+		var elements []json.RawMessage
+		if err := json.Unmarshal([]byte(value), &elements); err != nil {
+			return nil, fmt.Errorf("cloudflow: workflow parameter %v is not json array: %v", lm.PayloadsParam, err)
+		}
+		payloads := make([][]byte, len(elements))
+		for i, e := range elements {
+			payloads[i] = e
+		}
+		return payloads, nil
+	}
+	return lm.Payloads, nil
+}
+
+// invoke retries the invocation while it is throttled.
+func (lm *LambdaMapTask) invoke(ctx context.Context, f *lambda.Lambda, payload []byte) (*lambda.InvokeOutput, error) {
+	interval := lm.RetryInterval
+	for retries := 0; ; retries++ {
+		out, err := invoke(ctx, f, &lambda.InvokeInput{FunctionName: aws.String(lm.FunctionName), Payload: payload})
+		aerr, ok := err.(awserr.Error)
+		if !ok || aerr.Code() != lambda.ErrCodeTooManyRequestsException || retries >= lm.MaxRetries {
+			return out, err
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		interval *= 2
+	}
+}
+
+func (lm *LambdaMapTask) setResult(ctx context.Context) error {
+	params := cloudflow.ParamsFromContext(ctx)
+	if lm.ResultParam == "" || params == nil {
+		return nil
+	}
+	responses := make([]json.RawMessage, len(lm.Responses))
+	for i, r := range lm.Responses {
+		if len(r) > 0 {
+			responses[i] = r
+		}
+	}
+	b, err := json.Marshal(responses)
+	if err != nil {
+		return fmt.Errorf("cloudflow: responses of lambda function %v are not json: %v", lm.FunctionName, err)
+	}
+	params.Set(lm.ResultParam, string(b))
+	return nil
+}
@@ -0,0 +1,115 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/yonekawa/cloudflow"
+)
+
+func TestLambdaMapTask_Execute(t *testing.T) {
+	defaultInvoke := invoke
+	defer func() { invoke = defaultInvoke }()
+
+	sess, err := session.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var running, maxRunning int32
+	var mu sync.Mutex
+	calls := map[string]int{}
+	invoke = func(ctx context.Context, f *lambda.Lambda, input *lambda.InvokeInput) (*lambda.InvokeOutput, error) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+
+		payload := string(input.Payload)
+		mu.Lock()
+		calls[payload]++
+		count := calls[payload]
+		mu.Unlock()
+		switch {
+		case payload == `{"partition":3}` && count <= 2, payload == `{"partition":9}`:
+			return nil, awserr.New(lambda.ErrCodeTooManyRequestsException, "Rate Exceeded.", nil)
+		case payload == `{"partition":7}`:
+			return &lambda.InvokeOutput{FunctionError: aws.String("Unhandled"), Payload: []byte(`{"errorMessage":"bad partition"}`)}, nil
+		}
+		return &lambda.InvokeOutput{Payload: []byte(strings.Replace(payload, "partition", "done", 1))}, nil
+	}
+
+	var payloads []string
+	for i := 0; i < 20; i++ {
+		payloads = append(payloads, fmt.Sprintf(`{"partition":%d}`, i))
+	}
+	params := cloudflow.NewParams(map[string]string{"partitions": "[" + strings.Join(payloads, ",") + "]"})
+	task := NewLambdaMapTask(sess, "MyFunc", nil)
+	task.PayloadsParam = "partitions"
+	task.ResultParam = "results"
+	task.Concurrency = 4
+	task.MaxRetries = 3
+	task.RetryInterval = time.Millisecond
+	err = task.ExecuteContext(cloudflow.WithParams(context.Background(), params))
+	if err == nil || !strings.Contains(err.Error(), "failed for 2 of 20 payloads: [7 9]") {
+		t.Errorf("lambda map: invalid error: %v", err)
+	}
+
+	if maxRunning > 4 {
+		t.Errorf("lambda map: invoked over concurrency: %d", maxRunning)
+	}
+	if calls[`{"partition":3}`] != 3 || calls[`{"partition":9}`] != 4 {
+		t.Errorf("lambda map: throttled invocations must be retried: %v", calls)
+	}
+	for i, r := range task.Responses {
+		expected := fmt.Sprintf(`{"done":%d}`, i)
+		if i == 7 || i == 9 {
+			expected = ""
+		}
+		if string(r) != expected {
+			t.Errorf("lambda map: invalid response of %d: %s", i, r)
+		}
+	}
+	if len(task.Failed) != 2 || task.Failed[0].Index != 7 || task.Failed[1].Index != 9 || string(task.Failed[1].Payload) != `{"partition":9}` {
+		t.Fatalf("lambda map: invalid failures: %v", task.Failed)
+	}
+	if _, ok := task.Failed[0].Err.(*LambdaFunctionError); !ok {
+		t.Errorf("lambda map: function error must be *LambdaFunctionError: %v", task.Failed[0].Err)
+	}
+	if results, _ := params.Get("results"); !strings.HasPrefix(results, `[{"done":0},{"done":1},`) || !strings.Contains(results, `{"done":6},null,{"done":8},null,`) {
+		t.Errorf("lambda map: invalid result param: %v", results)
+	}
+
+	// payloads from an earlier task
+	task = NewLambdaMapTask(sess, "MyFunc", nil)
+	task.PayloadsFunc = func() ([][]byte, error) {
+		return [][]byte{[]byte(`{"partition":1}`), []byte(`{"partition":2}`)}, nil
+	}
+	if err := task.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if len(task.Responses) != 2 || string(task.Responses[1]) != `{"done":2}` {
+		t.Errorf("lambda map: invalid responses: %s", task.Responses)
+	}
+
+	// payloads not invoked before cancel fail
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := task.ExecuteContext(ctx); err == nil || len(task.Failed) != 2 || task.Failed[1].Err != context.Canceled {
+		t.Errorf("lambda map: payloads must fail by cancel: %v %v", err, task.Failed)
+	}
+}
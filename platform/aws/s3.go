@@ -1,27 +1,69 @@
 package aws
 
 import (
-	"io/ioutil"
+	"context"
+	"log"
 	"os"
-	"path"
-
-	"path/filepath"
-	"sync"
-
-	"io"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/hashicorp/go-multierror"
+	"github.com/yonekawa/cloudflow/storage"
+	"github.com/yonekawa/cloudflow/task"
 )
 
+// S3TransferOptions is the settings shared by S3BulkUploadTask, S3BulkDownloadTask and S3SyncTask.
+type S3TransferOptions struct {
+	// Filter selects files by the path relative to the local dir or s3 folder.
+	// Files filtered out in the latest execution are kept in Filtered.
+	Filter   *S3Filter
+	Filtered []S3FilteredFile
+
+	// Files larger than PartSize are transferred by multipart upload or ranged download
+	// with PartConcurrency parts in parallel per file.
+	// Zero values use 16MB and 4.
+	PartSize        int64
+	PartConcurrency int
+
+	// Concurrency limits files transferred in parallel. Zero value uses 10.
+	Concurrency int
+
+	// OnProgress is called whenever a file or a part is transferred.
+	// Progress is also logged once per ProgressInterval, 10 seconds by default.
+	OnProgress       func(S3Progress)
+	ProgressInterval time.Duration
+
+	// Local replaces the local dir and Remote replaces the s3 bucket, e.g. by storage.MemoryBucket in tests.
+	// The settings of s3 requests apply only to the default Remote.
+	Local  storage.Bucket
+	Remote storage.Bucket
+}
+
 // S3BulkUploadTask uploads local files in src dir into s3 dst folder.
 type S3BulkUploadTask struct {
 	Session     *session.Session
 	SrcDir      string
 	S3DstFolder string
 	Bucket      string
+
+	// Recursive uploads files in sub directories keeping relative path as s3 key.
+	// Symbolic links are skipped unless FollowSymlinks.
+	Recursive      bool
+	FollowSymlinks bool
+
+	S3TransferOptions
+
+	// UploadOptions is applied to each uploaded object.
+	UploadOptions *S3UploadOptions
+
+	// Checksum verifies uploaded objects, Content-MD5 by default.
+	// Downloaded objects are always verified by stored SHA-256 or ETag when possible.
+	Checksum S3Checksum
+
+	Logger *log.Logger
 }
 
 // NewS3BulkUploadTask creates a s3 bulk upload task.
@@ -34,85 +76,75 @@ func NewS3BulkUploadTask(sess *session.Session, srcDir, s3DstDir, bucket string)
 	}
 }
 
+// SetLogger sets log writer.
+func (up *S3BulkUploadTask) SetLogger(logger *log.Logger) {
+	up.Logger = logger
+}
+
 // Execute implement Task.Execute
 func (up *S3BulkUploadTask) Execute() error {
-	files, err := readFilesInDir(up.SrcDir)
+	return up.ExecuteContext(context.Background())
+}
+
+// ExecuteContext implement ContextTask.ExecuteContext.
+// Multipart uploads in progress are aborted when ctx is cancelled.
+func (up *S3BulkUploadTask) ExecuteContext(ctx context.Context) error {
+	matcher, err := up.Filter.compile()
 	if err != nil {
 		return err
 	}
 
-	svc := s3.New(up.Session)
-
-	wg := sync.WaitGroup{}
-	errChan := make(chan error)
-	for _, info := range files {
-		wg.Add(1)
-		go func(info os.FileInfo) {
-			defer wg.Done()
-
-			srcFile := filepath.Join(up.SrcDir, info.Name())
-			dstS3Key := path.Join(up.S3DstFolder, info.Name())
-			file, err := os.Open(srcFile)
-			if err != nil {
-				errChan <- err
-				return
-			}
-			defer file.Close()
-
-			_, err = putObject(svc, &s3.PutObjectInput{
-				Key:    aws.String(dstS3Key),
-				Bucket: aws.String(up.Bucket),
-				Body:   file,
-			})
-			if err != nil {
-				errChan <- err
-			}
-		}(info)
-	}
-
-	resultChan := make(chan error)
-	go func() {
-		var result *multierror.Error
-		for err := range errChan {
-			result = multierror.Append(result, err)
+	local := up.Local
+	if local == nil {
+		// listing a missing dir is not an error of buckets
+		if _, err := os.Stat(up.SrcDir); err != nil {
+			return err
 		}
-		resultChan <- result.ErrorOrNil()
-	}()
-
-	wg.Wait()
-	close(errChan)
-
-	return <-resultChan
-}
-
-func readFilesInDir(dir string) ([]os.FileInfo, error) {
-	entries, err := ioutil.ReadDir(dir)
-	if err != nil {
-		return nil, err
+		local = &storage.LocalBucket{Dir: up.SrcDir, FollowSymlinks: up.FollowSymlinks}
 	}
-
-	files := make([]os.FileInfo, 0, len(entries))
-	for _, e := range entries {
-		if e.IsDir() {
-			continue
+	remote := up.Remote
+	if remote == nil {
+		remote = &S3Bucket{
+			Session:         up.Session,
+			Bucket:          up.Bucket,
+			PartSize:        up.PartSize,
+			PartConcurrency: up.PartConcurrency,
+			UploadOptions:   up.UploadOptions,
+			Checksum:        up.Checksum,
 		}
-		files = append(files, e)
 	}
 
-	return files, nil
-}
+	up.Filtered = make([]S3FilteredFile, 0)
+	tt := storage.NewTransferTask(local, "", remote, s3FolderPrefix(up.S3DstFolder))
+	tt.Recursive = up.Recursive
+	tt.Filter = matcher.filterFunc(&up.Filtered, up.Logger, "upload")
+	tt.Concurrency = up.Concurrency
+	tt.Logger = up.Logger
 
-// for mock testing
-var putObject = func(svc *s3.S3, input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
-	return svc.PutObject(input)
+	progress := newS3ProgressTracker("s3 upload", up.Logger, up.OnProgress, up.ProgressInterval)
+	tt.OnProgress = progress.update
+	defer progress.finish()
+
+	return tt.ExecuteContext(ctx)
 }
 
 // S3BulkDownloadTask downloads files in s3 folder into local dst dir.
+// Each object is written to a temp file, verified by stored SHA-256 or ETag, and renamed into DstDir.
 type S3BulkDownloadTask struct {
 	Session     *session.Session
 	S3SrcFolder string
 	DstDir      string
 	Bucket      string
+
+	// Recursive downloads objects in sub folders keeping the folder hierarchy under DstDir.
+	Recursive bool
+
+	S3TransferOptions
+
+	// SSECustomerKey decrypts objects encrypted by SSE-C.
+	SSECustomerKey string
+
+	Logger *log.Logger
 }
 
 // NewS3BulkDownloadTask creates a s3 bulk download task.
@@ -125,69 +157,118 @@ func NewS3BulkDownloadTask(sess *session.Session, s3SrcFolder, dstDir, bucket st
 	}
 }
 
+// SetLogger sets log writer.
+func (down *S3BulkDownloadTask) SetLogger(logger *log.Logger) {
+	down.Logger = logger
+}
+
 // Execute implement Task.Execute.
 func (down *S3BulkDownloadTask) Execute() error {
-	svc := s3.New(down.Session)
+	return down.ExecuteContext(context.Background())
+}
 
-	list, err := listObjectsV2(svc, &s3.ListObjectsV2Input{
-		Bucket:    aws.String(down.Bucket),
-		Delimiter: aws.String("/"),
-		Prefix:    aws.String(down.S3SrcFolder + "/"),
-	})
+// ExecuteContext implement ContextTask.ExecuteContext.
+func (down *S3BulkDownloadTask) ExecuteContext(ctx context.Context) error {
+	matcher, err := down.Filter.compile()
 	if err != nil {
 		return err
 	}
 
-	wg := sync.WaitGroup{}
-	errChan := make(chan error)
-	for _, c := range list.Contents {
-		wg.Add(1)
-		go func(c *s3.Object) {
-			defer wg.Done()
-
-			out, err := getObject(svc, &s3.GetObjectInput{
-				Key:    c.Key,
-				Bucket: aws.String(down.Bucket),
-			})
-			if err != nil {
-				errChan <- err
-				return
-			}
+	local := down.Local
+	if local == nil {
+		local = storage.NewLocalBucket(down.DstDir)
+	}
+	remote := down.Remote
+	if remote == nil {
+		remote = &S3Bucket{
+			Session:         down.Session,
+			Bucket:          down.Bucket,
+			PartSize:        down.PartSize,
+			PartConcurrency: down.PartConcurrency,
+			SSECustomerKey:  down.SSECustomerKey,
+		}
+	}
 
-			dstPath := filepath.Join(down.DstDir, path.Base(*c.Key))
-			file, err := os.Create(dstPath)
-			if err != nil {
-				errChan <- err
-				return
-			}
-			defer file.Close()
+	down.Filtered = make([]S3FilteredFile, 0)
+	tt := storage.NewTransferTask(remote, s3FolderPrefix(down.S3SrcFolder), local, "")
+	tt.Recursive = down.Recursive
+	tt.Filter = matcher.filterFunc(&down.Filtered, down.Logger, "download")
+	tt.Concurrency = down.Concurrency
+	tt.Logger = down.Logger
 
-			_, err = io.Copy(file, out.Body)
-			if err != nil {
-				errChan <- err
-			}
-		}(c)
+	progress := newS3ProgressTracker("s3 download", down.Logger, down.OnProgress, down.ProgressInterval)
+	tt.OnProgress = progress.update
+	defer progress.finish()
+
+	return tt.ExecuteContext(ctx)
+}
+
+// s3FolderPrefix returns the key prefix of objects in folder.
+func s3FolderPrefix(folder string) string {
+	if folder == "" {
+		return ""
+	}
+	return strings.TrimSuffix(folder, "/") + "/"
+}
+
+// listS3Objects lists all objects under prefix following continuation token.
+// Objects in sub folders are listed only when recursive.
+func listS3Objects(ctx context.Context, svc *s3.S3, bucket, prefix string, recursive bool) ([]*s3.Object, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+	if !recursive {
+		input.Delimiter = aws.String("/")
 	}
 
-	resultChan := make(chan error)
-	go func() {
-		var result *multierror.Error
-		for err := range errChan {
-			result = multierror.Append(result, err)
+	objects := make([]*s3.Object, 0)
+	for {
+		list, err := listObjectsV2(ctx, svc, input)
+		if err != nil {
+			return nil, err
 		}
-		resultChan <- result.ErrorOrNil()
-	}()
+		for _, c := range list.Contents {
+			// skip folder placeholder
+			if strings.HasSuffix(*c.Key, "/") {
+				continue
+			}
+			objects = append(objects, c)
+		}
+		if !aws.BoolValue(list.IsTruncated) {
+			return objects, nil
+		}
+		input.ContinuationToken = list.NextContinuationToken
+	}
+}
 
-	wg.Wait()
-	close(errChan)
+// for mock testing
+var listObjectsV2 = func(ctx context.Context, svc *s3.S3, input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	return svc.ListObjectsV2WithContext(ctx, input)
+}
 
-	return <-resultChan
+// NewS3ObjectSensor creates a sensor task waiting for the s3 object to exist.
+func NewS3ObjectSensor(sess *session.Session, bucket, key string) *task.SensorTask {
+	svc := s3.New(sess)
+	return task.NewSensorTask(func(ctx context.Context) (bool, error) {
+		_, err := headObject(ctx, svc, &s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == 404 {
+			return false, nil
+		}
+		return err == nil, err
+	})
 }
 
 // for mock testing
-var getObject = func(svc *s3.S3, input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
-	return svc.GetObject(input)
+var headObject = func(ctx context.Context, svc *s3.S3, input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	return svc.HeadObjectWithContext(ctx, input)
 }
-var listObjectsV2 = func(svc *s3.S3, input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
-	return svc.ListObjectsV2(input)
+
+func logf(logger *log.Logger, format string, v ...interface{}) {
+	if logger != nil {
+		logger.Printf(format, v...)
+	}
 }
@@ -1,73 +1,189 @@
 package aws
 
 import (
-	"testing"
-
+	"context"
 	"errors"
+	"io"
 	"io/ioutil"
-	"strings"
-
+	"os"
 	"path/filepath"
-
-	"path"
-
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
 
-	"io"
-	"os"
-
-	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/yonekawa/cloudflow/storage"
 )
 
-func TestS3BulkUploadTask_Execute(t *testing.T) {
-	t.Parallel()
+// testBucket is a memory bucket failing objects whose key ends with _error.
+// It counts objects created and created in parallel, each taking delay.
+type testBucket struct {
+	*storage.MemoryBucket
+	delay time.Duration
 
-	uploadFiles := make([]string, 0)
-	putObject = func(svc *s3.S3, input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
-		uploadFiles = append(uploadFiles, *input.Key)
-		if strings.HasSuffix(*input.Key, "_error") {
-			return nil, errors.New("error")
-		}
-		return &s3.PutObjectOutput{}, nil
+	mu         sync.Mutex
+	created    int
+	running    int
+	maxRunning int
+}
+
+func newTestBucket() *testBucket {
+	return &testBucket{MemoryBucket: storage.NewMemoryBucket()}
+}
+
+func (b *testBucket) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	if strings.HasSuffix(key, "_error") {
+		return nil, errors.New("error")
 	}
+	return b.MemoryBucket.Open(ctx, key)
+}
+
+func (b *testBucket) Create(ctx context.Context, key string) (io.WriteCloser, error) {
+	if strings.HasSuffix(key, "_error") {
+		return nil, errors.New("error")
+	}
+	w, err := b.MemoryBucket.Create(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.created++
+	b.running++
+	if b.running > b.maxRunning {
+		b.maxRunning = b.running
+	}
+	return &testWriter{WriteCloser: w, bucket: b}, nil
+}
+
+// keys returns keys of all objects.
+func (b *testBucket) keys(t *testing.T) []string {
+	objects, err := b.List(context.Background(), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, len(objects))
+	for i, o := range objects {
+		keys[i] = o.Key
+	}
+	return keys
+}
+
+type testWriter struct {
+	io.WriteCloser
+	bucket *testBucket
+}
+
+func (w *testWriter) Close() error {
+	time.Sleep(w.bucket.delay)
+	w.bucket.mu.Lock()
+	w.bucket.running--
+	w.bucket.mu.Unlock()
+	return w.WriteCloser.Close()
+}
+
+func TestS3BulkUploadTask_Execute(t *testing.T) {
+	t.Parallel()
 
 	srcDir, err := ioutil.TempDir("", "")
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer os.RemoveAll(srcDir)
 	srcFiles := [3]string{"file1", "file2", "file3"}
 	for i, f := range srcFiles {
 		ioutil.WriteFile(filepath.Join(srcDir, f), []byte(strconv.Itoa(i)), 0666)
 	}
 
-	sess, err := session.NewSession()
+	remote := newTestBucket()
+	task := NewS3BulkUploadTask(nil, srcDir, "/dst", "file-bucket")
+	task.Remote = remote
+	if err := task.Execute(); err != nil {
+		t.Error(err)
+	}
+	if keys, expected := remote.keys(t), []string{"/dst/file1", "/dst/file2", "/dst/file3"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("incorrect uploaded keys expect:%v got:%v", expected, keys)
+	}
+
+	ioutil.WriteFile(filepath.Join(srcDir, "file_error"), []byte("error"), 0666)
+	if err := task.Execute(); err == nil {
+		t.Error("expect to fail upload but it succeeded")
+	}
+
+	task = NewS3BulkUploadTask(nil, filepath.Join(srcDir, "none"), "/dst", "file-bucket")
+	task.Remote = remote
+	if err := task.Execute(); err == nil {
+		t.Error("expect to fail upload of missing dir but it succeeded")
+	}
+
+	testS3BulkUploadTaskRecursive(t)
+}
+
+func testS3BulkUploadTaskRecursive(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "")
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer os.RemoveAll(srcDir)
+	otherDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(otherDir)
+	os.MkdirAll(filepath.Join(srcDir, "sub", "deeper"), 0777)
+	ioutil.WriteFile(filepath.Join(srcDir, "a"), []byte("a"), 0666)
+	ioutil.WriteFile(filepath.Join(srcDir, "sub", "b"), []byte("b"), 0666)
+	ioutil.WriteFile(filepath.Join(srcDir, "sub", "deeper", "c"), []byte("c"), 0666)
+	ioutil.WriteFile(filepath.Join(otherDir, "d"), []byte("d"), 0666)
+	os.Symlink(otherDir, filepath.Join(srcDir, "linkdir"))
+	os.Symlink(filepath.Join(otherDir, "d"), filepath.Join(srcDir, "linkfile"))
+	os.Symlink(srcDir, filepath.Join(srcDir, "sub", "loop"))
 
-	task := NewS3BulkUploadTask(sess, srcDir, "/dst", "file-bucket")
+	remote := newTestBucket()
+	task := NewS3BulkUploadTask(nil, srcDir, "/dst", "file-bucket")
+	task.Recursive = true
+	task.Remote = remote
 	if err := task.Execute(); err != nil {
 		t.Error(err)
 	}
+	tests := []string{"/dst/a", "/dst/sub/b", "/dst/sub/deeper/c"}
+	if keys := remote.keys(t); !reflect.DeepEqual(keys, tests) {
+		t.Errorf("incorrect uploaded keys expect:%v got:%v", tests, keys)
+	}
 
-	for _, f := range srcFiles {
-		found := false
-		for _, u := range uploadFiles {
-			if u == path.Join(task.S3DstFolder, f) {
-				found = true
-				break
-			}
-		}
-		if !found {
-			t.Errorf("src file:%v does not uploaded", f)
-		}
+	remote = newTestBucket()
+	task.Remote = remote
+	task.FollowSymlinks = true
+	if err := task.Execute(); err != nil {
+		t.Error(err)
+	}
+	tests = []string{"/dst/a", "/dst/linkdir/d", "/dst/linkfile", "/dst/sub/b", "/dst/sub/deeper/c"}
+	if keys := remote.keys(t); !reflect.DeepEqual(keys, tests) {
+		t.Errorf("incorrect uploaded keys expect:%v got:%v", tests, keys)
 	}
 
-	ioutil.WriteFile(filepath.Join(srcDir, "file_error"), []byte("error"), 0666)
-	if err := task.Execute(); err == nil {
-		t.Error("expect to fail upload but it succeeded")
+	remote = newTestBucket()
+	task.Remote = remote
+	task.Filter = new(S3Filter).Exclude("sub/").Exclude("linkdir/").Exclude("linkfile")
+	if err := task.Execute(); err != nil {
+		t.Error(err)
+	}
+	if keys := remote.keys(t); !reflect.DeepEqual(keys, []string{"/dst/a"}) {
+		t.Errorf("incorrect uploaded keys with filter: %v", keys)
+	}
+	if len(task.Filtered) != 4 {
+		t.Errorf("incorrect filtered files: %v", task.Filtered)
+	}
+	for _, f := range task.Filtered {
+		if f.Reason == "" {
+			t.Errorf("filtered file %v has no reason", f.Path)
+		}
 	}
 }
 
@@ -78,67 +194,132 @@ func TestS3BulkDownloadTask_Execute(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer os.RemoveAll(dstDir)
 
-	srcDir, err := ioutil.TempDir("", "")
-	if err != nil {
-		t.Fatal(err)
-	}
-	readClosers := make(map[string]io.ReadCloser)
+	remote := newTestBucket()
 	srcFiles := [3]string{"file1", "file2", "file3"}
 	for i, f := range srcFiles {
-		p := filepath.Join(srcDir, f)
-		ioutil.WriteFile(p, []byte(strconv.Itoa(i)), 0666)
-		readCloser, err := os.Open(p)
-		if err != nil {
-			t.Fatal(err)
-		}
-		readClosers[f] = readCloser
+		remote.Put("/s3src/"+f, []byte(strconv.Itoa(i)), time.Now())
 	}
-	defer func() {
-		for _, f := range readClosers {
-			f.Close()
+	remote.Put("/s3src/sub/file4", []byte("4"), time.Now())
+
+	task := NewS3BulkDownloadTask(nil, "/s3src", dstDir, "file-bucket")
+	task.Remote = remote
+	if err := task.Execute(); err != nil {
+		t.Error(err)
+	}
+	for i, f := range srcFiles {
+		if b, _ := ioutil.ReadFile(filepath.Join(dstDir, f)); string(b) != strconv.Itoa(i) {
+			t.Errorf("invalid downloaded file:%v got:%v", f, string(b))
 		}
-	}()
+	}
+	if _, err := os.Stat(filepath.Join(dstDir, "sub")); !os.IsNotExist(err) {
+		t.Error("object in sub folder is downloaded without recursive")
+	}
 
-	sess, err := session.NewSession()
+	remote.Put("/s3src/file_error", []byte("error"), time.Now())
+	if err := task.Execute(); err == nil {
+		t.Error("expect to fail download but it succeeded")
+	}
+
+	testS3BulkDownloadTaskRecursive(t)
+}
+
+func testS3BulkDownloadTaskRecursive(t *testing.T) {
+	remote := newTestBucket()
+	for _, key := range []string{"/s3src/a", "/s3src/sub/b", "/s3src/sub/deeper/c"} {
+		remote.Put(key, []byte(key), time.Now())
+	}
+
+	dstDir, err := ioutil.TempDir("", "")
 	if err != nil {
 		t.Fatal(err)
 	}
-	task := NewS3BulkDownloadTask(sess, "/s3src", dstDir, "file-bucket")
-
-	listObjectsV2 = func(svc *s3.S3, input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
-		entries, err := ioutil.ReadDir(srcDir)
+	defer os.RemoveAll(dstDir)
+	task := NewS3BulkDownloadTask(nil, "/s3src", dstDir, "file-bucket")
+	task.Recursive = true
+	task.Remote = remote
+	if err := task.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{"a": "/s3src/a", "sub/b": "/s3src/sub/b", "sub/deeper/c": "/s3src/sub/deeper/c"}
+	for p, key := range tests {
+		b, err := ioutil.ReadFile(filepath.Join(dstDir, filepath.FromSlash(p)))
 		if err != nil {
-			return nil, err
+			t.Error(err)
+		} else if string(b) != key {
+			t.Errorf("invalid downloaded file:%v expect:%v got:%v", p, key, string(b))
 		}
+	}
 
-		contents := make([]*s3.Object, 0, len(entries))
-		for _, e := range entries {
-			if e.IsDir() {
-				continue
-			}
-			contents = append(contents, &s3.Object{Key: aws.String(path.Join(task.S3SrcFolder, e.Name()))})
-		}
-		return &s3.ListObjectsV2Output{Contents: contents}, nil
+	dstDir, err = ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
 	}
-	getObject = func(svc *s3.S3, input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
-		if strings.HasSuffix(*input.Key, "_error") {
-			return nil, errors.New("error")
-		}
+	defer os.RemoveAll(dstDir)
+	task.DstDir = dstDir
+	task.Filter = new(S3Filter).Exclude("*").Include("sub/**")
+	if err := task.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dstDir, "a")); !os.IsNotExist(err) {
+		t.Error("filtered object is downloaded")
+	}
+	if len(task.Filtered) != 1 || task.Filtered[0].Path != "/s3src/a" {
+		t.Errorf("incorrect filtered objects: %v", task.Filtered)
+	}
+	task.Filter = nil
 
-		file := path.Base(*input.Key)
-		if body := readClosers[file]; body != nil {
-			return &s3.GetObjectOutput{Body: body}, nil
+	remote = newTestBucket()
+	remote.Put("/s3src/ok", []byte("ok"), time.Now())
+	remote.Put("/s3src/../../escape", []byte("escape"), time.Now())
+	dstDir, err = ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+	task.DstDir = dstDir
+	task.Remote = remote
+	if err := task.Execute(); err == nil {
+		t.Error("expect to fail download escaping dst dir but it succeeded")
+	}
+	if entries, _ := ioutil.ReadDir(dstDir); len(entries) != 0 {
+		t.Errorf("files are downloaded even though a key escapes dst dir: %v", entries)
+	}
+}
+
+// not parallel: replaces s3 function variables used by other tests
+func TestS3ObjectSensor(t *testing.T) {
+	defer func() {
+		headObject = defaultHeadObject
+	}()
+
+	heads := 0
+	headObject = func(ctx context.Context, svc *s3.S3, input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+		heads++
+		if heads < 3 {
+			return nil, awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), 404, "")
 		}
-		return nil, errors.New("file not found")
+		return &s3.HeadObjectOutput{}, nil
 	}
 
-	if err := task.Execute(); err != nil {
+	sess, err := session.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := NewS3ObjectSensor(sess, "file-bucket", "/output/_SUCCESS")
+	st.PollingTime = time.Millisecond
+	if err := st.Execute(); err != nil {
 		t.Error(err)
 	}
+	if heads != 3 {
+		t.Errorf("sensor: incorrect head count expect:%v got:%v", 3, heads)
+	}
 
-	ioutil.WriteFile(filepath.Join(srcDir, "file_error"), []byte("error"), 0666)
-	if err := task.Execute(); err == nil {
-		t.Error("expect to fail upload but it succeeded")
+	headObject = func(ctx context.Context, svc *s3.S3, input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+		return nil, awserr.NewRequestFailure(awserr.New("Forbidden", "Forbidden", nil), 403, "")
+	}
+	if err := st.Execute(); err == nil {
+		t.Error("expect to fail sensor but it succeeded")
 	}
 }
@@ -0,0 +1,165 @@
+package aws
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/yonekawa/cloudflow/storage"
+)
+
+// S3Bucket is storage.Bucket of a s3 bucket.
+// Objects larger than PartSize are uploaded by multipart upload, and downloaded into local files by ranges in parallel.
+type S3Bucket struct {
+	Session *session.Session
+	Bucket  string
+
+	PartSize        int64
+	PartConcurrency int
+
+	// UploadOptions is applied to each created object.
+	UploadOptions *S3UploadOptions
+	Checksum      S3Checksum
+
+	// SSECustomerKey decrypts objects encrypted by SSE-C.
+	SSECustomerKey string
+}
+
+// NewS3Bucket creates a s3 bucket.
+func NewS3Bucket(sess *session.Session, bucket string) *S3Bucket {
+	return &S3Bucket{Session: sess, Bucket: bucket}
+}
+
+func (b *S3Bucket) transfer() *s3Transfer {
+	t := newS3Transfer(s3.New(b.Session), b.Bucket, b.PartSize, b.PartConcurrency)
+	t.uploadOptions = b.UploadOptions
+	t.checksum = b.Checksum
+	t.sseCustomerKey = b.SSECustomerKey
+	return t
+}
+
+// List implement storage.Bucket.List.
+func (b *S3Bucket) List(ctx context.Context, prefix string, recursive bool) ([]storage.ObjectInfo, error) {
+	objects, err := listS3Objects(ctx, s3.New(b.Session), b.Bucket, prefix, recursive)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]storage.ObjectInfo, len(objects))
+	for i, c := range objects {
+		infos[i] = storage.ObjectInfo{
+			Key:     *c.Key,
+			Size:    aws.Int64Value(c.Size),
+			ModTime: aws.TimeValue(c.LastModified),
+			MD5:     etagMD5(c.ETag),
+		}
+	}
+	return infos, nil
+}
+
+// Open implement storage.Bucket.Open.
+func (b *S3Bucket) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(b.Bucket),
+		Key:    aws.String(key),
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = sseCustomerKey(b.SSECustomerKey)
+	out, err := s3.New(b.Session).GetObjectWithContext(ctx, input)
+	if isS3NotFound(err) {
+		return nil, storage.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// Create implement storage.Bucket.Create.
+// Written data is buffered in a temp file and uploaded on Close.
+func (b *S3Bucket) Create(ctx context.Context, key string) (io.WriteCloser, error) {
+	file, err := ioutil.TempFile("", "cloudflow-s3-")
+	if err != nil {
+		return nil, err
+	}
+	return &s3Writer{File: file, ctx: ctx, bucket: b, key: key}, nil
+}
+
+// Delete implement storage.Bucket.Delete.
+func (b *S3Bucket) Delete(ctx context.Context, key string) error {
+	return deleteS3Keys(ctx, s3.New(b.Session), b.Bucket, []string{key})
+}
+
+// Stat implement storage.Bucket.Stat.
+func (b *S3Bucket) Stat(ctx context.Context, key string) (storage.ObjectInfo, error) {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(b.Bucket),
+		Key:    aws.String(key),
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = sseCustomerKey(b.SSECustomerKey)
+	out, err := headObject(ctx, s3.New(b.Session), input)
+	if isS3NotFound(err) {
+		return storage.ObjectInfo{}, storage.ErrNotExist
+	}
+	if err != nil {
+		return storage.ObjectInfo{}, err
+	}
+	return storage.ObjectInfo{
+		Key:     key,
+		Size:    aws.Int64Value(out.ContentLength),
+		ModTime: aws.TimeValue(out.LastModified),
+		MD5:     etagMD5(out.ETag),
+	}, nil
+}
+
+// UploadFile implement storage.FileUploader.UploadFile.
+func (b *S3Bucket) UploadFile(ctx context.Context, key, path string, progress func(n int64)) error {
+	t := b.transfer()
+	t.progress = progress
+	return t.upload(ctx, key, path)
+}
+
+// DownloadFile implement storage.FileDownloader.DownloadFile.
+// The object is verified by stored SHA-256 or ETag when possible.
+func (b *S3Bucket) DownloadFile(ctx context.Context, src storage.ObjectInfo, path string, progress func(n int64)) error {
+	t := b.transfer()
+	t.progress = progress
+	return t.download(ctx, src.Key, src.Size, path)
+}
+
+// etagMD5 returns hex MD5 of the object from ETag, or empty string for ETag of multipart upload.
+// ETag of objects encrypted by SSE-KMS or SSE-C is not MD5 either, which makes checksum comparison copy them.
+func etagMD5(etag *string) string {
+	e := strings.Trim(aws.StringValue(etag), `"`)
+	if strings.Contains(e, "-") {
+		return ""
+	}
+	return e
+}
+
+func isS3NotFound(err error) bool {
+	reqErr, ok := err.(awserr.RequestFailure)
+	return ok && reqErr.StatusCode() == 404
+}
+
+type s3Writer struct {
+	*os.File
+	ctx    context.Context
+	bucket *S3Bucket
+	key    string
+}
+
+func (w *s3Writer) Close() error {
+	defer os.Remove(w.Name())
+	if err := w.File.Close(); err != nil {
+		return err
+	}
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	return w.bucket.transfer().upload(w.ctx, w.key, w.Name())
+}
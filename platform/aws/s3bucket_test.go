@@ -0,0 +1,105 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/yonekawa/cloudflow/storage/storagetest"
+)
+
+func TestS3Bucket(t *testing.T) {
+	t.Parallel()
+
+	server := newTestS3Server()
+	defer server.Close()
+
+	bucket := NewS3Bucket(server.session(t), "bucket")
+	bucket.PartSize = 2
+	storagetest.TestBucket(t, bucket)
+
+	if server.parts == 0 {
+		t.Error("s3 bucket: large object is not uploaded by multipart")
+	}
+}
+
+func TestS3Bucket_ContentType(t *testing.T) {
+	t.Parallel()
+
+	server := newTestS3Server()
+	defer server.Close()
+
+	bucket := NewS3Bucket(server.session(t), "bucket")
+	bucket.PartSize = 5
+	for key, data := range map[string]string{"dir/small.json": "{}", "dir/large.html": "<html></html>"} {
+		w, err := bucket.Create(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(data))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]string{"dir/small.json": "application/json", "dir/large.html": "text/html; charset=utf-8"}
+	uploads := 0
+	for _, r := range server.requests {
+		isPut := r.Method == "PUT" && r.Query.Get("uploadId") == ""
+		isCreate := r.Method == "POST" && hasQuery(r.Query, "uploads")
+		if !isPut && !isCreate {
+			continue
+		}
+		uploads++
+		if ct := r.Header.Get("Content-Type"); ct != expected[r.Key] {
+			t.Errorf("s3 bucket: content type of %v must be %q but %q", r.Key, expected[r.Key], ct)
+		}
+	}
+	if uploads != 2 {
+		t.Errorf("s3 bucket: invalid number of uploads: %d", uploads)
+	}
+}
+
+// not parallel: replaces s3 function variables used by other tests
+func TestS3Bucket_List(t *testing.T) {
+	defer func() {
+		listObjectsV2 = defaultListObjectsV2
+	}()
+
+	keys := []string{"/s3src/a", "/s3src/sub/", "/s3src/sub/b"}
+	listObjectsV2 = func(ctx context.Context, svc *s3.S3, input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+		if input.Delimiter != nil {
+			return nil, errors.New("delimiter is specified in recursive mode")
+		}
+		// return one object per page
+		i := 0
+		if input.ContinuationToken != nil {
+			i, _ = strconv.Atoi(*input.ContinuationToken)
+		}
+		out := &s3.ListObjectsV2Output{Contents: []*s3.Object{{Key: aws.String(keys[i]), ETag: aws.String(`"md5` + strconv.Itoa(i) + `"`)}}}
+		if i+1 < len(keys) {
+			out.IsTruncated = aws.Bool(true)
+			out.NextContinuationToken = aws.String(strconv.Itoa(i + 1))
+		}
+		return out, nil
+	}
+
+	sess, err := session.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, err := NewS3Bucket(sess, "bucket").List(context.Background(), "/s3src/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 || objects[0].Key != "/s3src/a" || objects[1].Key != "/s3src/sub/b" {
+		t.Errorf("s3 bucket: all pages must be listed without folder placeholder: %v", objects)
+	}
+	if objects[0].MD5 != "md50" {
+		t.Errorf("s3 bucket: md5 is not taken from etag: %v", objects[0].MD5)
+	}
+}
@@ -0,0 +1,105 @@
+package aws
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// S3Checksum selects how uploaded objects are verified.
+type S3Checksum int
+
+const (
+	// S3ChecksumMD5 sends Content-MD5 of each object or part, so s3 rejects corrupted uploads.
+	S3ChecksumMD5 S3Checksum = iota
+	// S3ChecksumSHA256 also stores SHA-256 of the whole file in the object metadata.
+	// Downloads verify it even for objects uploaded by multipart or encrypted by KMS.
+	S3ChecksumSHA256
+	// S3ChecksumNone disables checksums on upload.
+	S3ChecksumNone
+)
+
+// sha256MetadataKey is the user metadata storing hex SHA-256 of the object.
+const sha256MetadataKey = "Cloudflow-Sha256"
+
+// hashReader returns the hash of r and rewinds r.
+func hashReader(r io.ReadSeeker, h hash.Hash) ([]byte, error) {
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func contentMD5(r io.ReadSeeker) (*string, error) {
+	sum, err := hashReader(r, md5.New())
+	if err != nil {
+		return nil, err
+	}
+	return aws.String(base64.StdEncoding.EncodeToString(sum)), nil
+}
+
+// withSHA256Metadata returns a copy of metadata with the checksum.
+func withSHA256Metadata(metadata map[string]*string, sum string) map[string]*string {
+	m := make(map[string]*string, len(metadata)+1)
+	for k, v := range metadata {
+		m[k] = v
+	}
+	m[sha256MetadataKey] = aws.String(sum)
+	return m
+}
+
+// s3ObjectChecksum is the checksum of downloaded object.
+type s3ObjectChecksum struct {
+	etag      string
+	sha256    string
+	encrypted bool
+}
+
+func newS3ObjectChecksum(out *s3.GetObjectOutput) *s3ObjectChecksum {
+	c := &s3ObjectChecksum{
+		etag:      strings.Trim(aws.StringValue(out.ETag), `"`),
+		encrypted: strings.HasPrefix(aws.StringValue(out.ServerSideEncryption), "aws:kms") || out.SSECustomerAlgorithm != nil,
+	}
+	for k, v := range out.Metadata {
+		if strings.EqualFold(k, sha256MetadataKey) {
+			c.sha256 = aws.StringValue(v)
+		}
+	}
+	return c
+}
+
+// verify checks r against stored SHA-256, or ETag which is MD5 of objects
+// uploaded by single request without KMS or customer key.
+// Objects with no usable checksum are not verified.
+func (c *s3ObjectChecksum) verify(key string, r io.ReadSeeker) error {
+	var h hash.Hash
+	var expected string
+	switch {
+	case c.sha256 != "":
+		h, expected = sha256.New(), c.sha256
+	case c.etag != "" && !c.encrypted && !strings.Contains(c.etag, "-"):
+		h, expected = md5.New(), c.etag
+	default:
+		return nil
+	}
+
+	sum, err := hashReader(r, h)
+	if err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(sum); actual != expected {
+		return fmt.Errorf("cloudflow: checksum of s3 object %v mismatch: expected %v but %v", key, expected, actual)
+	}
+	return nil
+}
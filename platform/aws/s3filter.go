@@ -0,0 +1,194 @@
+package aws
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/yonekawa/cloudflow/storage"
+)
+
+// S3FilterRule is an include or exclude glob pattern.
+type S3FilterRule struct {
+	Include bool
+	Pattern string
+}
+
+// S3Filter selects files transferred by s3 tasks.
+//
+// Rules are evaluated in order and the last matching rule decides, all files are included by default.
+// So exclude "*" followed by include "*.parquet" transfers only parquet files.
+// Patterns are matched against slash separated relative path:
+// "*" and "?" do not match "/", "**" matches any path.
+// Pattern without "/" matches the base name in any directory,
+// and pattern ending with "/" matches everything under the directory.
+type S3Filter struct {
+	Rules []S3FilterRule
+
+	// Zero value means no limit.
+	MinSize       int64
+	MaxSize       int64
+	ModifiedSince time.Time
+}
+
+// S3FilteredFile is a file filtered out and why.
+type S3FilteredFile struct {
+	Path   string
+	Reason string
+}
+
+// Include appends include rule.
+func (f *S3Filter) Include(pattern string) *S3Filter {
+	f.Rules = append(f.Rules, S3FilterRule{Include: true, Pattern: pattern})
+	return f
+}
+
+// Exclude appends exclude rule.
+func (f *S3Filter) Exclude(pattern string) *S3Filter {
+	f.Rules = append(f.Rules, S3FilterRule{Include: false, Pattern: pattern})
+	return f
+}
+
+type compiledRule struct {
+	S3FilterRule
+	re       *regexp.Regexp
+	anchored bool
+	dirOnly  bool
+}
+
+type s3FileMatcher struct {
+	filter *S3Filter
+	rules  []*compiledRule
+}
+
+// compile returns matcher of f. Nil filter matches all files.
+func (f *S3Filter) compile() (*s3FileMatcher, error) {
+	m := &s3FileMatcher{filter: f}
+	if f == nil {
+		return m, nil
+	}
+	for _, r := range f.Rules {
+		p := r.Pattern
+		dirOnly := strings.HasSuffix(p, "/")
+		p = strings.TrimSuffix(strings.TrimPrefix(p, "/"), "/")
+		re, err := regexp.Compile(globToRegexp(p))
+		if err != nil {
+			return nil, fmt.Errorf("cloudflow: invalid filter pattern %q: %v", r.Pattern, err)
+		}
+		m.rules = append(m.rules, &compiledRule{
+			S3FilterRule: r,
+			re:           re,
+			anchored:     strings.Contains(p, "/"),
+			dirOnly:      dirOnly,
+		})
+	}
+	return m, nil
+}
+
+// match returns reason when the file is filtered out, or empty string.
+func (m *s3FileMatcher) match(rel string, size int64, modTime time.Time) string {
+	rel = strings.TrimPrefix(rel, "/")
+
+	var decided *compiledRule
+	for _, r := range m.rules {
+		if r.matchPath(rel) {
+			decided = r
+		}
+	}
+	if decided != nil && !decided.Include {
+		return fmt.Sprintf("excluded by pattern %q", decided.Pattern)
+	}
+
+	f := m.filter
+	if f == nil {
+		return ""
+	}
+	if f.MinSize > 0 && size < f.MinSize {
+		return fmt.Sprintf("size %d is smaller than %d", size, f.MinSize)
+	}
+	if f.MaxSize > 0 && size > f.MaxSize {
+		return fmt.Sprintf("size %d is larger than %d", size, f.MaxSize)
+	}
+	if !f.ModifiedSince.IsZero() && modTime.Before(f.ModifiedSince) {
+		return fmt.Sprintf("modified at %v before %v", modTime.Format(time.RFC3339), f.ModifiedSince.Format(time.RFC3339))
+	}
+	return ""
+}
+
+// filterFunc returns storage filter of m, which records objects filtered out for action into filtered.
+// Nil filtered is allowed.
+func (m *s3FileMatcher) filterFunc(filtered *[]S3FilteredFile, logger *log.Logger, action string) func(string, storage.ObjectInfo) bool {
+	return func(rel string, info storage.ObjectInfo) bool {
+		reason := m.match(rel, info.Size, info.ModTime)
+		if reason == "" {
+			return true
+		}
+		if filtered != nil {
+			*filtered = append(*filtered, S3FilteredFile{Path: info.Key, Reason: reason})
+			logf(logger, "s3: skip %s %v: %v", action, info.Key, reason)
+		}
+		return false
+	}
+}
+
+func (r *compiledRule) matchPath(rel string) bool {
+	if !r.dirOnly {
+		if r.anchored {
+			return r.re.MatchString(rel)
+		}
+		return r.re.MatchString(path.Base(rel))
+	}
+
+	// match parent directories of the file
+	segments := strings.Split(rel, "/")
+	for i := 1; i < len(segments); i++ {
+		if r.anchored && r.re.MatchString(strings.Join(segments[:i], "/")) {
+			return true
+		}
+		if !r.anchored && r.re.MatchString(segments[i-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+func globToRegexp(pattern string) string {
+	var buf bytes.Buffer
+	buf.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			// zero or more directories
+			buf.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			buf.WriteString(".*")
+			i++
+		case c == '*':
+			buf.WriteString("[^/]*")
+		case c == '?':
+			buf.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				buf.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			buf.WriteString("[" + class + "]")
+			i += end
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	buf.WriteString("$")
+	return buf.String()
+}
@@ -0,0 +1,51 @@
+package aws
+
+import (
+	"testing"
+	"time"
+)
+
+func TestS3Filter_match(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	tests := []struct {
+		filter   *S3Filter
+		path     string
+		size     int64
+		modTime  time.Time
+		filtered bool
+	}{
+		{nil, "a/b.txt", 1, now, false},
+		{new(S3Filter).Exclude("*").Include("*.parquet"), "part-0000.parquet", 1, now, false},
+		{new(S3Filter).Exclude("*").Include("*.parquet"), "year=2017/part-0000.parquet", 1, now, false},
+		{new(S3Filter).Exclude("*").Include("*.parquet"), "year=2017/_SUCCESS", 1, now, true},
+		{new(S3Filter).Include("*.parquet").Exclude("*"), "part-0000.parquet", 1, now, true},
+		{new(S3Filter).Exclude(".DS_Store"), "a/b/.DS_Store", 1, now, true},
+		{new(S3Filter).Exclude("_temporary/"), "out/_temporary/0/part", 1, now, true},
+		{new(S3Filter).Exclude("_temporary/"), "out/_temporary", 1, now, false},
+		{new(S3Filter).Exclude("out/*.csv"), "out/a.csv", 1, now, true},
+		{new(S3Filter).Exclude("out/*.csv"), "out/sub/a.csv", 1, now, false},
+		{new(S3Filter).Exclude("out/**/*.csv"), "out/sub/a.csv", 1, now, true},
+		{new(S3Filter).Exclude("out/**/*.csv"), "out/a.csv", 1, now, true},
+		{new(S3Filter).Exclude("**/log?.txt"), "a/log1.txt", 1, now, true},
+		{new(S3Filter).Exclude("log[0-9].txt"), "log5.txt", 1, now, true},
+		{new(S3Filter).Exclude("log[!0-9].txt"), "log5.txt", 1, now, false},
+		{&S3Filter{MinSize: 10}, "a", 9, now, true},
+		{&S3Filter{MinSize: 10}, "a", 10, now, false},
+		{&S3Filter{MaxSize: 10}, "a", 11, now, true},
+		{&S3Filter{ModifiedSince: now}, "a", 1, now.Add(-time.Second), true},
+		{&S3Filter{ModifiedSince: now}, "a", 1, now, false},
+	}
+
+	for i, test := range tests {
+		m, err := test.filter.compile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reason := m.match(test.path, test.size, test.modTime)
+		if (reason != "") != test.filtered {
+			t.Errorf("%d: filter %v for %v expect filtered:%v got reason:%q", i, test.filter, test.path, test.filtered, reason)
+		}
+	}
+}
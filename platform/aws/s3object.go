@@ -0,0 +1,450 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/hashicorp/go-multierror"
+	"github.com/yonekawa/cloudflow/storage"
+)
+
+// CopyObject accepts objects up to 5GB, larger objects are copied by UploadPartCopy.
+var maxCopyObjectSize int64 = 5 * 1024 * 1024 * 1024
+var defaultCopyPartSize int64 = 512 * 1024 * 1024
+
+// S3CopyTask copies objects under SrcPrefix to DstPrefix by server-side copy.
+// Key of the copy is DstPrefix followed by the key after SrcPrefix.
+type S3CopyTask struct {
+	Session   *session.Session
+	Bucket    string
+	SrcPrefix string
+	DstPrefix string
+
+	// DstBucket is the bucket copied into, Bucket by default.
+	DstBucket string
+
+	// Recursive copies objects in sub folders of SrcPrefix too.
+	Recursive bool
+
+	// Filter selects objects by the key after SrcPrefix.
+	// Objects filtered out in the latest execution are kept in Filtered.
+	Filter   *S3Filter
+	Filtered []S3FilteredFile
+
+	// Objects larger than 5GB are copied by parts of PartSize, 512MB by default.
+	// Tags of such objects are not copied.
+	PartSize int64
+
+	// Concurrency limits objects copied in parallel. Zero value uses 10.
+	Concurrency int
+
+	Logger *log.Logger
+
+	// Copied is source keys copied in the latest execution.
+	Copied []string
+}
+
+// NewS3CopyTask creates a s3 copy task.
+func NewS3CopyTask(sess *session.Session, bucket, srcPrefix, dstPrefix string) *S3CopyTask {
+	return &S3CopyTask{
+		Session:   sess,
+		Bucket:    bucket,
+		SrcPrefix: srcPrefix,
+		DstPrefix: dstPrefix,
+	}
+}
+
+// SetLogger sets log writer.
+func (cp *S3CopyTask) SetLogger(logger *log.Logger) {
+	cp.Logger = logger
+}
+
+// Execute implement Task.Execute.
+func (cp *S3CopyTask) Execute() error {
+	return cp.ExecuteContext(context.Background())
+}
+
+// ExecuteContext implement ContextTask.ExecuteContext.
+func (cp *S3CopyTask) ExecuteContext(ctx context.Context) error {
+	return cp.copyObjects(ctx, "s3 copy")
+}
+
+func (cp *S3CopyTask) copyObjects(ctx context.Context, name string) error {
+	svc := s3.New(cp.Session)
+	cp.Copied = make([]string, 0)
+
+	objects, filtered, err := listFilteredS3Objects(ctx, svc, cp.Bucket, cp.SrcPrefix, cp.Recursive, cp.Filter, cp.Logger, name)
+	cp.Filtered = filtered
+	if err != nil {
+		return err
+	}
+
+	dstBucket := cp.DstBucket
+	if dstBucket == "" {
+		dstBucket = cp.Bucket
+	}
+
+	mu := sync.Mutex{}
+	return storage.ForEach(ctx, len(objects), cp.Concurrency, func(i int) error {
+		src := *objects[i].Key
+		dst := cp.DstPrefix + strings.TrimPrefix(src, cp.SrcPrefix)
+		if err := cp.copyObject(ctx, svc, objects[i], dstBucket, dst); err != nil {
+			return err
+		}
+		logf(cp.Logger, "%s: %v to %v", name, src, dst)
+
+		mu.Lock()
+		defer mu.Unlock()
+		cp.Copied = append(cp.Copied, src)
+		return nil
+	})
+}
+
+func (cp *S3CopyTask) copyObject(ctx context.Context, svc *s3.S3, src *s3.Object, dstBucket, dst string) error {
+	copySource := url.PathEscape(cp.Bucket + "/" + *src.Key)
+	size := aws.Int64Value(src.Size)
+	if size <= maxCopyObjectSize {
+		_, err := copyObject(ctx, svc, &s3.CopyObjectInput{
+			Bucket:     aws.String(dstBucket),
+			Key:        aws.String(dst),
+			CopySource: aws.String(copySource),
+		})
+		return err
+	}
+
+	// keep content type and metadata as CopyObject does
+	head, err := headObject(ctx, svc, &s3.HeadObjectInput{
+		Bucket: aws.String(cp.Bucket),
+		Key:    src.Key,
+	})
+	if err != nil {
+		return err
+	}
+	created, err := createMultipartUpload(ctx, svc, &s3.CreateMultipartUploadInput{
+		Bucket:       aws.String(dstBucket),
+		Key:          aws.String(dst),
+		ContentType:  head.ContentType,
+		CacheControl: head.CacheControl,
+		Metadata:     head.Metadata,
+	})
+	if err != nil {
+		return err
+	}
+
+	partSize := cp.PartSize
+	if partSize <= 0 {
+		partSize = defaultCopyPartSize
+	}
+	if size > partSize*maxUploadParts {
+		partSize = (size + maxUploadParts - 1) / maxUploadParts
+	}
+	numParts := int((size + partSize - 1) / partSize)
+	parts := make([]*s3.CompletedPart, numParts)
+	err = runParts(ctx, numParts, defaultPartConcurrency, func(i int) error {
+		offset := int64(i) * partSize
+		end := offset + partSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		out, err := uploadPartCopy(ctx, svc, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(dstBucket),
+			Key:             aws.String(dst),
+			UploadId:        created.UploadId,
+			PartNumber:      aws.Int64(int64(i + 1)),
+			CopySource:      aws.String(copySource),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, end)),
+		})
+		if err != nil {
+			return err
+		}
+		parts[i] = &s3.CompletedPart{ETag: out.CopyPartResult.ETag, PartNumber: aws.Int64(int64(i + 1))}
+		return nil
+	})
+	if err == nil {
+		_, err = completeMultipartUpload(ctx, svc, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(dstBucket),
+			Key:             aws.String(dst),
+			UploadId:        created.UploadId,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+		})
+	}
+	if err == nil {
+		return nil
+	}
+
+	_, abortErr := abortMultipartUpload(context.Background(), svc, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(dstBucket),
+		Key:      aws.String(dst),
+		UploadId: created.UploadId,
+	})
+	if abortErr != nil {
+		return multierror.Append(err, fmt.Errorf("cloudflow: abort multipart copy of %v failed: %v", dst, abortErr))
+	}
+	return err
+}
+
+// S3MoveTask moves objects under SrcPrefix to DstPrefix.
+// Source objects are deleted only after they are copied.
+type S3MoveTask struct {
+	S3CopyTask
+}
+
+// NewS3MoveTask creates a s3 move task.
+func NewS3MoveTask(sess *session.Session, bucket, srcPrefix, dstPrefix string) *S3MoveTask {
+	return &S3MoveTask{S3CopyTask: *NewS3CopyTask(sess, bucket, srcPrefix, dstPrefix)}
+}
+
+// Execute implement Task.Execute.
+func (mv *S3MoveTask) Execute() error {
+	return mv.ExecuteContext(context.Background())
+}
+
+// ExecuteContext implement ContextTask.ExecuteContext.
+// Objects copied before an error are still deleted from the source.
+func (mv *S3MoveTask) ExecuteContext(ctx context.Context) error {
+	// deleting sources would delete the copies written under the source prefix
+	if mv.overlaps() {
+		return fmt.Errorf("cloudflow: s3 move src %v and dst %v overlap", mv.SrcPrefix, mv.DstPrefix)
+	}
+
+	var result *multierror.Error
+	if err := mv.copyObjects(ctx, "s3 move"); err != nil {
+		result = multierror.Append(result, err)
+	}
+	// copied sources are deleted even when ctx is cancelled, not to leave them duplicated
+	if err := deleteS3Keys(context.Background(), s3.New(mv.Session), mv.Bucket, mv.Copied); err != nil {
+		result = multierror.Append(result, err)
+	}
+	return result.ErrorOrNil()
+}
+
+// overlaps reports whether keys of the copies can be keys of the source objects.
+// When one prefix extends the other by a folder, only recursive move overlaps,
+// for example staging/ can be moved into the bucket root without Recursive.
+func (mv *S3MoveTask) overlaps() bool {
+	if mv.DstBucket != "" && mv.DstBucket != mv.Bucket {
+		return false
+	}
+	var diff string
+	switch {
+	case strings.HasPrefix(mv.DstPrefix, mv.SrcPrefix):
+		diff = strings.TrimPrefix(mv.DstPrefix, mv.SrcPrefix)
+	case strings.HasPrefix(mv.SrcPrefix, mv.DstPrefix):
+		diff = strings.TrimPrefix(mv.SrcPrefix, mv.DstPrefix)
+	default:
+		return false
+	}
+	return mv.Recursive || !strings.Contains(diff, "/")
+}
+
+// S3DeleteTask deletes objects under Prefix by batched DeleteObjects.
+type S3DeleteTask struct {
+	Session *session.Session
+	Bucket  string
+	Prefix  string
+
+	// Recursive deletes objects in sub folders of Prefix too.
+	Recursive bool
+
+	// Filter selects objects by the key after Prefix.
+	// Objects filtered out in the latest execution are kept in Filtered.
+	Filter   *S3Filter
+	Filtered []S3FilteredFile
+
+	// DryRun only logs what would be deleted, and keeps the keys in Planned.
+	DryRun bool
+
+	Logger *log.Logger
+
+	// Deleted is keys deleted in the latest execution, empty on dry run.
+	Deleted []string
+	// Planned is keys which the latest dry run would delete.
+	Planned []string
+}
+
+// NewS3DeleteTask creates a s3 delete task.
+func NewS3DeleteTask(sess *session.Session, bucket, prefix string) *S3DeleteTask {
+	return &S3DeleteTask{
+		Session: sess,
+		Bucket:  bucket,
+		Prefix:  prefix,
+	}
+}
+
+// SetLogger sets log writer.
+func (del *S3DeleteTask) SetLogger(logger *log.Logger) {
+	del.Logger = logger
+}
+
+// Execute implement Task.Execute.
+func (del *S3DeleteTask) Execute() error {
+	return del.ExecuteContext(context.Background())
+}
+
+// ExecuteContext implement ContextTask.ExecuteContext.
+func (del *S3DeleteTask) ExecuteContext(ctx context.Context) error {
+	svc := s3.New(del.Session)
+	del.Deleted, del.Planned = make([]string, 0), make([]string, 0)
+
+	objects, filtered, err := listFilteredS3Objects(ctx, svc, del.Bucket, del.Prefix, del.Recursive, del.Filter, del.Logger, "s3 delete")
+	del.Filtered = filtered
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, len(objects))
+	for i, c := range objects {
+		keys[i] = *c.Key
+	}
+	if del.DryRun {
+		for _, key := range keys {
+			logf(del.Logger, "s3 delete: (dryrun) %v", key)
+		}
+		del.Planned = keys
+		return nil
+	}
+
+	if err := deleteS3Keys(ctx, svc, del.Bucket, keys); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		logf(del.Logger, "s3 delete: %v", key)
+	}
+	del.Deleted = keys
+	return nil
+}
+
+// S3TagTask sets tags of objects under Prefix.
+type S3TagTask struct {
+	Session *session.Session
+	Bucket  string
+	Prefix  string
+	Tags    map[string]string
+
+	// Merge keeps existing tags not in Tags, otherwise the tag set is replaced.
+	Merge bool
+
+	// Recursive tags objects in sub folders of Prefix too.
+	Recursive bool
+
+	// Filter selects objects by the key after Prefix.
+	// Objects filtered out in the latest execution are kept in Filtered.
+	Filter   *S3Filter
+	Filtered []S3FilteredFile
+
+	// Concurrency limits objects tagged in parallel. Zero value uses 10.
+	Concurrency int
+
+	Logger *log.Logger
+}
+
+// NewS3TagTask creates a s3 tag task.
+func NewS3TagTask(sess *session.Session, bucket, prefix string, tags map[string]string) *S3TagTask {
+	return &S3TagTask{
+		Session: sess,
+		Bucket:  bucket,
+		Prefix:  prefix,
+		Tags:    tags,
+	}
+}
+
+// SetLogger sets log writer.
+func (tag *S3TagTask) SetLogger(logger *log.Logger) {
+	tag.Logger = logger
+}
+
+// Execute implement Task.Execute.
+func (tag *S3TagTask) Execute() error {
+	return tag.ExecuteContext(context.Background())
+}
+
+// ExecuteContext implement ContextTask.ExecuteContext.
+func (tag *S3TagTask) ExecuteContext(ctx context.Context) error {
+	svc := s3.New(tag.Session)
+
+	objects, filtered, err := listFilteredS3Objects(ctx, svc, tag.Bucket, tag.Prefix, tag.Recursive, tag.Filter, tag.Logger, "s3 tag")
+	tag.Filtered = filtered
+	if err != nil {
+		return err
+	}
+
+	return storage.ForEach(ctx, len(objects), tag.Concurrency, func(i int) error {
+		key := objects[i].Key
+		tags := make(map[string]string, len(tag.Tags))
+		if tag.Merge {
+			out, err := getObjectTagging(ctx, svc, &s3.GetObjectTaggingInput{
+				Bucket: aws.String(tag.Bucket),
+				Key:    key,
+			})
+			if err != nil {
+				return err
+			}
+			for _, t := range out.TagSet {
+				tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+			}
+		}
+		for k, v := range tag.Tags {
+			tags[k] = v
+		}
+
+		tagSet := make([]*s3.Tag, 0, len(tags))
+		for k, v := range tags {
+			tagSet = append(tagSet, &s3.Tag{Key: aws.String(k), Value: aws.String(v)})
+		}
+		if _, err := putObjectTagging(ctx, svc, &s3.PutObjectTaggingInput{
+			Bucket:  aws.String(tag.Bucket),
+			Key:     key,
+			Tagging: &s3.Tagging{TagSet: tagSet},
+		}); err != nil {
+			return err
+		}
+		logf(tag.Logger, "s3 tag: %v", *key)
+		return nil
+	})
+}
+
+// listFilteredS3Objects lists objects under prefix selected by filter matching the key after prefix.
+func listFilteredS3Objects(ctx context.Context, svc *s3.S3, bucket, prefix string, recursive bool, filter *S3Filter, logger *log.Logger, name string) ([]*s3.Object, []S3FilteredFile, error) {
+	matcher, err := filter.compile()
+	if err != nil {
+		return nil, nil, err
+	}
+	objects, err := listS3Objects(ctx, svc, bucket, prefix, recursive)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	filtered := make([]S3FilteredFile, 0)
+	selected := make([]*s3.Object, 0, len(objects))
+	for _, c := range objects {
+		rel := strings.TrimPrefix(*c.Key, prefix)
+		if reason := matcher.match(rel, aws.Int64Value(c.Size), aws.TimeValue(c.LastModified)); reason != "" {
+			filtered = append(filtered, S3FilteredFile{Path: *c.Key, Reason: reason})
+			logf(logger, "%s: skip %v: %v", name, *c.Key, reason)
+			continue
+		}
+		selected = append(selected, c)
+	}
+	return selected, filtered, nil
+}
+
+// for mock testing
+var copyObject = func(ctx context.Context, svc *s3.S3, input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	return svc.CopyObjectWithContext(ctx, input)
+}
+var uploadPartCopy = func(ctx context.Context, svc *s3.S3, input *s3.UploadPartCopyInput) (*s3.UploadPartCopyOutput, error) {
+	return svc.UploadPartCopyWithContext(ctx, input)
+}
+var getObjectTagging = func(ctx context.Context, svc *s3.S3, input *s3.GetObjectTaggingInput) (*s3.GetObjectTaggingOutput, error) {
+	return svc.GetObjectTaggingWithContext(ctx, input)
+}
+var putObjectTagging = func(ctx context.Context, svc *s3.S3, input *s3.PutObjectTaggingInput) (*s3.PutObjectTaggingOutput, error) {
+	return svc.PutObjectTaggingWithContext(ctx, input)
+}
@@ -0,0 +1,305 @@
+package aws
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+type testS3Object struct {
+	body    []byte
+	modTime time.Time
+	tags    map[string]string
+}
+
+// default s3 function variables, restored after tests replacing them sequentially
+var (
+	defaultListObjectsV2 = listObjectsV2
+	defaultDeleteObjects = deleteObjects
+	defaultHeadObject    = headObject
+
+	defaultCopyObject       = copyObject
+	defaultGetObjectTagging = getObjectTagging
+	defaultPutObjectTagging = putObjectTagging
+)
+
+// testS3Bucket is an in-memory bucket replacing s3 function variables.
+type testS3Bucket struct {
+	mu      sync.Mutex
+	objects map[string]*testS3Object
+}
+
+func newTestS3Bucket() *testS3Bucket {
+	b := &testS3Bucket{objects: make(map[string]*testS3Object)}
+	listObjectsV2 = func(ctx context.Context, svc *s3.S3, input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		contents := make([]*s3.Object, 0)
+		for key, o := range b.objects {
+			if !strings.HasPrefix(key, *input.Prefix) {
+				continue
+			}
+			if input.Delimiter != nil && strings.Contains(strings.TrimPrefix(key, *input.Prefix), *input.Delimiter) {
+				continue
+			}
+			sum := md5.Sum(o.body)
+			contents = append(contents, &s3.Object{
+				Key:          aws.String(key),
+				Size:         aws.Int64(int64(len(o.body))),
+				LastModified: aws.Time(o.modTime),
+				ETag:         aws.String(`"` + hex.EncodeToString(sum[:]) + `"`),
+			})
+		}
+		sort.Slice(contents, func(i, j int) bool { return *contents[i].Key < *contents[j].Key })
+		return &s3.ListObjectsV2Output{Contents: contents}, nil
+	}
+	deleteObjects = func(ctx context.Context, svc *s3.S3, input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for _, o := range input.Delete.Objects {
+			delete(b.objects, *o.Key)
+		}
+		return &s3.DeleteObjectsOutput{}, nil
+	}
+	copyObject = func(ctx context.Context, svc *s3.S3, input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		src, _ := url.PathUnescape(*input.CopySource)
+		o, ok := b.objects[strings.SplitN(src, "/", 2)[1]]
+		if !ok {
+			return nil, awserr.NewRequestFailure(awserr.New("NoSuchKey", "not found", nil), 404, "")
+		}
+		b.objects[*input.Key] = &testS3Object{body: o.body, modTime: time.Now(), tags: o.tags}
+		return &s3.CopyObjectOutput{}, nil
+	}
+	getObjectTagging = func(ctx context.Context, svc *s3.S3, input *s3.GetObjectTaggingInput) (*s3.GetObjectTaggingOutput, error) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		tagSet := make([]*s3.Tag, 0)
+		for k, v := range b.objects[*input.Key].tags {
+			tagSet = append(tagSet, &s3.Tag{Key: aws.String(k), Value: aws.String(v)})
+		}
+		return &s3.GetObjectTaggingOutput{TagSet: tagSet}, nil
+	}
+	putObjectTagging = func(ctx context.Context, svc *s3.S3, input *s3.PutObjectTaggingInput) (*s3.PutObjectTaggingOutput, error) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		tags := make(map[string]string)
+		for _, t := range input.Tagging.TagSet {
+			tags[*t.Key] = *t.Value
+		}
+		b.objects[*input.Key].tags = tags
+		return &s3.PutObjectTaggingOutput{}, nil
+	}
+	return b
+}
+
+// restore resets s3 function variables to call the real service.
+func (b *testS3Bucket) restore() {
+	listObjectsV2 = defaultListObjectsV2
+	deleteObjects = defaultDeleteObjects
+	copyObject = defaultCopyObject
+	getObjectTagging = defaultGetObjectTagging
+	putObjectTagging = defaultPutObjectTagging
+}
+
+func (b *testS3Bucket) put(key, body string, modTime time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects[key] = &testS3Object{body: []byte(body), modTime: modTime}
+}
+
+func (b *testS3Bucket) keys() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	keys := make([]string, 0, len(b.objects))
+	for k := range b.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// not parallel: replaces s3 function variables used by other tests
+func TestS3ObjectTasks(t *testing.T) {
+	sess, err := session.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket := newTestS3Bucket()
+	defer bucket.restore()
+
+	now := time.Now()
+	bucket.put("staging/a.parquet", "a", now)
+	bucket.put("staging/b.parquet", "b", now)
+	bucket.put("staging/_SUCCESS", "", now)
+	bucket.put("staging/sub/c.parquet", "c", now)
+
+	cp := NewS3CopyTask(sess, "bucket", "staging/", "published/")
+	cp.Filter = new(S3Filter).Exclude("_SUCCESS")
+	if err := cp.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if len(cp.Copied) != 2 || len(cp.Filtered) != 1 {
+		t.Errorf("s3 copy: invalid result copied:%v filtered:%v", cp.Copied, cp.Filtered)
+	}
+	if string(bucket.objects["published/a.parquet"].body) != "a" || bucket.objects["published/sub/c.parquet"] != nil {
+		t.Errorf("s3 copy: invalid objects: %v", bucket.keys())
+	}
+
+	cp.Recursive = true
+	if err := cp.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if bucket.objects["published/sub/c.parquet"] == nil {
+		t.Errorf("s3 copy: objects in sub folders are not copied: %v", bucket.keys())
+	}
+
+	tag := NewS3TagTask(sess, "bucket", "published/", map[string]string{"state": "published"})
+	tag.Recursive = true
+	if err := tag.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	tag.Tags = map[string]string{"team": "data"}
+	tag.Merge = true
+	tag.Filter = new(S3Filter).Exclude("sub/")
+	if err := tag.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if tags := bucket.objects["published/a.parquet"].tags; tags["state"] != "published" || tags["team"] != "data" {
+		t.Errorf("s3 tag: tags are not merged: %v", tags)
+	}
+	if tags := bucket.objects["published/sub/c.parquet"].tags; tags["state"] != "published" || tags["team"] != "" {
+		t.Errorf("s3 tag: filtered object is tagged: %v", tags)
+	}
+
+	mv := NewS3MoveTask(sess, "bucket", "published/", "archive/")
+	mv.Recursive = true
+	if err := mv.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"archive/a.parquet", "archive/b.parquet", "archive/sub/c.parquet", "staging/_SUCCESS", "staging/a.parquet", "staging/b.parquet", "staging/sub/c.parquet"}
+	if keys := bucket.keys(); !reflect.DeepEqual(keys, expected) {
+		t.Errorf("s3 move: invalid objects: %v", keys)
+	}
+	if tags := bucket.objects["archive/a.parquet"].tags; tags["team"] != "data" {
+		t.Errorf("s3 move: tags are not kept: %v", tags)
+	}
+	overlaps := []struct {
+		src, dst  string
+		recursive bool
+	}{
+		{"archive/", "archive/", false},
+		{"archive/", "archive/sub/", true},
+		{"archive/sub/", "archive/", true},
+		{"", "archive/", true},
+		{"archive/", "archive/old-", false},
+		{"archive/old-", "archive/", false},
+	}
+	for _, o := range overlaps {
+		overlap := NewS3MoveTask(sess, "bucket", o.src, o.dst)
+		overlap.Recursive = o.recursive
+		if err := overlap.Execute(); err == nil {
+			t.Errorf("s3 move: overlapping src and dst must be error: %+v", o)
+		}
+	}
+	if keys := bucket.keys(); !reflect.DeepEqual(keys, expected) {
+		t.Errorf("s3 move: objects are changed by rejected moves: %v", keys)
+	}
+
+	// objects directly under the prefix do not overlap the bucket root
+	if err := NewS3MoveTask(sess, "bucket", "archive/", "").Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if bucket.objects["a.parquet"] == nil || bucket.objects["archive/a.parquet"] != nil || bucket.objects["archive/sub/c.parquet"] == nil {
+		t.Errorf("s3 move: invalid move into bucket root: %v", bucket.keys())
+	}
+	if err := NewS3MoveTask(sess, "bucket", "", "archive/").Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if keys := bucket.keys(); !reflect.DeepEqual(keys, expected) {
+		t.Errorf("s3 move: invalid move from bucket root: %v", keys)
+	}
+
+	del := NewS3DeleteTask(sess, "bucket", "staging/")
+	del.Recursive = true
+	del.DryRun = true
+	if err := del.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if len(del.Planned) != 4 || len(del.Deleted) != 0 || len(bucket.objects) != 7 {
+		t.Errorf("s3 delete: dry run deletes objects: %v %v", del.Deleted, bucket.keys())
+	}
+	del.DryRun = false
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := del.ExecuteContext(ctx); err != context.Canceled || len(bucket.objects) != 7 {
+		t.Errorf("s3 delete: cancelled delete must fail: %v %v", err, bucket.keys())
+	}
+	if err := del.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if len(del.Deleted) != 4 || len(del.Planned) != 0 {
+		t.Errorf("s3 delete: invalid result deleted:%v planned:%v", del.Deleted, del.Planned)
+	}
+	if keys := bucket.keys(); len(keys) != 3 || keys[0] != "archive/a.parquet" {
+		t.Errorf("s3 delete: invalid objects: %v", keys)
+	}
+}
+
+// not parallel: replaces maxCopyObjectSize
+func TestS3CopyTask_Multipart(t *testing.T) {
+	server := newTestS3Server()
+	defer server.Close()
+	sess := server.session(t)
+
+	defaultMax := maxCopyObjectSize
+	maxCopyObjectSize = 10
+	defer func() { maxCopyObjectSize = defaultMax }()
+
+	svc := s3.New(sess)
+	large := "0123456789abcdefghijklmnopqrstuvwxyz"
+	for key, body := range map[string]string{"src/large": large, "src/small": "small"} {
+		if _, err := svc.PutObject(&s3.PutObjectInput{
+			Bucket:   aws.String("bucket"),
+			Key:      aws.String(key),
+			Body:     strings.NewReader(body),
+			Metadata: map[string]*string{"Owner": aws.String("cloudflow")},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cp := NewS3CopyTask(sess, "bucket", "src/", "dst/")
+	cp.PartSize = 10
+	if err := cp.ExecuteContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if string(server.objects["dst/large"]) != large {
+		t.Errorf("s3 copy: invalid multipart copy: %q", server.objects["dst/large"])
+	}
+	if server.parts != 4 {
+		t.Errorf("s3 copy: large object must be copied by 4 parts but %d", server.parts)
+	}
+	if string(server.objects["dst/small"]) != "small" {
+		t.Errorf("s3 copy: invalid copy: %q", server.objects["dst/small"])
+	}
+	if server.headers["dst/large"].Get("X-Amz-Meta-Owner") != "cloudflow" {
+		t.Errorf("s3 copy: metadata is not copied: %v", server.headers["dst/large"])
+	}
+}
@@ -0,0 +1,116 @@
+package aws
+
+import (
+	"mime"
+	"net/url"
+	"path"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// S3UploadOptions is a template of options applied to each uploaded object.
+// Empty fields are left to the bucket defaults.
+type S3UploadOptions struct {
+	// ServerSideEncryption is "AES256" or "aws:kms". SSEKMSKeyID selects the KMS key for "aws:kms".
+	ServerSideEncryption string
+	SSEKMSKeyID          string
+
+	// StorageClass such as "STANDARD_IA" and canned ACL such as "bucket-owner-full-control".
+	StorageClass string
+	ACL          string
+
+	// ContentType is detected from the extension of the object key when empty.
+	ContentType  string
+	CacheControl string
+
+	// Metadata is stored as x-amz-meta-* headers.
+	Metadata map[string]string
+	Tagging  map[string]string
+
+	// SSECustomerKey encrypts objects by the 256 bit customer provided key (SSE-C).
+	// Objects must be downloaded with the same key.
+	SSECustomerKey string
+}
+
+const sseCustomerAlgorithm = "AES256"
+
+func (o *S3UploadOptions) applyPutObject(input *s3.PutObjectInput, key string) {
+	input.ContentType = detectContentType(o, key)
+	if o == nil {
+		return
+	}
+	input.ServerSideEncryption = optionalString(o.ServerSideEncryption)
+	input.SSEKMSKeyId = optionalString(o.SSEKMSKeyID)
+	input.StorageClass = optionalString(o.StorageClass)
+	input.ACL = optionalString(o.ACL)
+	input.CacheControl = optionalString(o.CacheControl)
+	input.Metadata = o.metadata()
+	input.Tagging = o.tagging()
+	input.SSECustomerAlgorithm, input.SSECustomerKey = sseCustomerKey(o.SSECustomerKey)
+}
+
+func (o *S3UploadOptions) applyCreateMultipartUpload(input *s3.CreateMultipartUploadInput, key string) {
+	input.ContentType = detectContentType(o, key)
+	if o == nil {
+		return
+	}
+	input.ServerSideEncryption = optionalString(o.ServerSideEncryption)
+	input.SSEKMSKeyId = optionalString(o.SSEKMSKeyID)
+	input.StorageClass = optionalString(o.StorageClass)
+	input.ACL = optionalString(o.ACL)
+	input.CacheControl = optionalString(o.CacheControl)
+	input.Metadata = o.metadata()
+	input.Tagging = o.tagging()
+	input.SSECustomerAlgorithm, input.SSECustomerKey = sseCustomerKey(o.SSECustomerKey)
+}
+
+func (o *S3UploadOptions) applyUploadPart(input *s3.UploadPartInput) {
+	if o == nil {
+		return
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = sseCustomerKey(o.SSECustomerKey)
+}
+
+func (o *S3UploadOptions) metadata() map[string]*string {
+	if len(o.Metadata) == 0 {
+		return nil
+	}
+	return aws.StringMap(o.Metadata)
+}
+
+// tagging returns tags encoded as URL query.
+func (o *S3UploadOptions) tagging() *string {
+	if len(o.Tagging) == 0 {
+		return nil
+	}
+	values := url.Values{}
+	for k, v := range o.Tagging {
+		values.Set(k, v)
+	}
+	return aws.String(values.Encode())
+}
+
+// detectContentType detects from the key rather than the uploaded file, which can be a temp file.
+func detectContentType(o *S3UploadOptions, key string) *string {
+	if o != nil && o.ContentType != "" {
+		return aws.String(o.ContentType)
+	}
+	return optionalString(mime.TypeByExtension(path.Ext(key)))
+}
+
+// sseCustomerKey returns algorithm and key headers of SSE-C.
+// The key MD5 header is computed by the sdk.
+func sseCustomerKey(key string) (*string, *string) {
+	if key == "" {
+		return nil, nil
+	}
+	return aws.String(sseCustomerAlgorithm), aws.String(key)
+}
+
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
+}
@@ -0,0 +1,96 @@
+package aws
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestS3UploadOptions(t *testing.T) {
+	t.Parallel()
+
+	server := newTestS3Server()
+	defer server.Close()
+	sess := server.session(t)
+
+	srcDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	ioutil.WriteFile(filepath.Join(srcDir, "small.json"), []byte("{}"), 0666)
+	ioutil.WriteFile(filepath.Join(srcDir, "large.html"), []byte("<html></html>"), 0666)
+
+	key := "0123456789abcdef0123456789abcdef"
+	up := NewS3BulkUploadTask(sess, srcDir, "dst", "bucket")
+	up.PartSize = 5
+	up.UploadOptions = &S3UploadOptions{
+		ServerSideEncryption: "aws:kms",
+		SSEKMSKeyID:          "kms-key",
+		StorageClass:         "STANDARD_IA",
+		ACL:                  "bucket-owner-full-control",
+		CacheControl:         "max-age=60",
+		Metadata:             map[string]string{"Owner": "cloudflow"},
+		Tagging:              map[string]string{"team": "data", "env": "prod"},
+		SSECustomerKey:       key,
+	}
+	if err := up.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"X-Amz-Server-Side-Encryption":                    "aws:kms",
+		"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id":     "kms-key",
+		"X-Amz-Storage-Class":                             "STANDARD_IA",
+		"X-Amz-Acl":                                       "bucket-owner-full-control",
+		"Cache-Control":                                   "max-age=60",
+		"X-Amz-Meta-Owner":                                "cloudflow",
+		"X-Amz-Tagging":                                   "env=prod&team=data",
+		"X-Amz-Server-Side-Encryption-Customer-Algorithm": "AES256",
+	}
+	uploads := 0
+	for _, r := range server.requests {
+		isPut := r.Method == "PUT" && r.Query.Get("uploadId") == ""
+		isCreate := r.Method == "POST" && hasQuery(r.Query, "uploads")
+		isPart := r.Method == "PUT" && r.Query.Get("uploadId") != ""
+		if isPut || isCreate {
+			uploads++
+			for h, v := range expected {
+				if r.Header.Get(h) != v {
+					t.Errorf("s3 upload options: %v of %v must be %q but %q", h, r.Key, v, r.Header.Get(h))
+				}
+			}
+		}
+		if isPart && r.Header.Get("X-Amz-Server-Side-Encryption-Customer-Key-Md5") == "" {
+			t.Errorf("s3 upload options: sse-c key is not sent with part %v of %v", r.Query.Get("partNumber"), r.Key)
+		}
+		if isPut && r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("s3 upload options: content type of %v is not detected: %v", r.Key, r.Header.Get("Content-Type"))
+		}
+		if isCreate && r.Header.Get("Content-Type") != "text/html; charset=utf-8" {
+			t.Errorf("s3 upload options: content type of %v is not detected: %v", r.Key, r.Header.Get("Content-Type"))
+		}
+	}
+	if uploads != 2 {
+		t.Errorf("s3 upload options: 2 files must be uploaded but %d", uploads)
+	}
+
+	dstDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+	server.requests = nil
+	down := NewS3BulkDownloadTask(sess, "dst", dstDir, "bucket")
+	down.PartSize = 5
+	down.SSECustomerKey = key
+	if err := down.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range server.requests {
+		if r.Key != "" && r.Header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != "AES256" {
+			t.Errorf("s3 download: sse-c key is not sent to get %v", r.Key)
+		}
+	}
+}
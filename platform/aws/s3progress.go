@@ -0,0 +1,98 @@
+package aws
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/yonekawa/cloudflow/storage"
+)
+
+var defaultProgressInterval = 10 * time.Second
+
+// S3Progress is a progress of s3 bulk transfer.
+type S3Progress struct {
+	FilesDone  int
+	FilesTotal int
+	BytesDone  int64
+	BytesTotal int64
+	Elapsed    time.Duration
+}
+
+// Throughput returns transferred bytes per second.
+func (p S3Progress) Throughput() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.BytesDone) / p.Elapsed.Seconds()
+}
+
+func (p S3Progress) String() string {
+	return fmt.Sprintf("%d/%d files, %s/%s, %s/s",
+		p.FilesDone, p.FilesTotal, formatBytes(float64(p.BytesDone)), formatBytes(float64(p.BytesTotal)), formatBytes(p.Throughput()))
+}
+
+func formatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	i := 0
+	for ; n >= 1024 && i < len(units)-1; i++ {
+		n /= 1024
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f%s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f%s", n, units[i])
+}
+
+// s3ProgressTracker converts progress of storage.TransferTask to S3Progress,
+// notifies observer of every update and logs progress at most once per interval.
+type s3ProgressTracker struct {
+	mu       sync.Mutex
+	progress S3Progress
+	lastLog  time.Time
+	interval time.Duration
+	name     string
+	logger   *log.Logger
+	observer func(S3Progress)
+}
+
+func newS3ProgressTracker(name string, logger *log.Logger, observer func(S3Progress), interval time.Duration) *s3ProgressTracker {
+	if interval <= 0 {
+		interval = defaultProgressInterval
+	}
+	return &s3ProgressTracker{
+		lastLog:  time.Now(),
+		interval: interval,
+		name:     name,
+		logger:   logger,
+		observer: observer,
+	}
+}
+
+func (t *s3ProgressTracker) update(p storage.Progress) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.progress = S3Progress{
+		FilesDone:  p.ObjectsDone,
+		FilesTotal: p.ObjectsTotal,
+		BytesDone:  p.BytesDone,
+		BytesTotal: p.BytesTotal,
+		Elapsed:    p.Elapsed,
+	}
+	if t.observer != nil {
+		t.observer(t.progress)
+	}
+	if now := time.Now(); now.Sub(t.lastLog) >= t.interval {
+		t.lastLog = now
+		logf(t.logger, "%s: %v", t.name, t.progress)
+	}
+}
+
+// finish logs the final progress.
+func (t *s3ProgressTracker) finish() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	logf(t.logger, "%s: %v", t.name, t.progress)
+}
@@ -0,0 +1,72 @@
+package aws
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestS3Progress_String(t *testing.T) {
+	t.Parallel()
+
+	p := S3Progress{FilesDone: 1, FilesTotal: 4, BytesDone: 3 << 20, BytesTotal: 12 << 20, Elapsed: 2 * time.Second}
+	if s := p.String(); s != "1/4 files, 3.0MB/12.0MB, 1.5MB/s" {
+		t.Errorf("s3 progress: invalid string: %v", s)
+	}
+}
+
+func TestS3BulkUploadTask_Concurrency(t *testing.T) {
+	t.Parallel()
+
+	srcDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	var total int64
+	for i := 0; i < 20; i++ {
+		body := strings.Repeat("x", i)
+		ioutil.WriteFile(filepath.Join(srcDir, strconv.Itoa(i)), []byte(body), 0666)
+		total += int64(len(body))
+	}
+
+	remote := newTestBucket()
+	remote.delay = 5 * time.Millisecond
+	var buf bytes.Buffer
+	progress := make([]S3Progress, 0)
+	task := NewS3BulkUploadTask(nil, srcDir, "/dst", "bucket")
+	task.Remote = remote
+	task.Concurrency = 3
+	task.SetLogger(log.New(&buf, "", 0))
+	task.OnProgress = func(p S3Progress) {
+		progress = append(progress, p)
+	}
+	if err := task.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	if remote.maxRunning > 3 {
+		t.Errorf("s3 upload: %d files are uploaded in parallel over concurrency 3", remote.maxRunning)
+	}
+	if keys := remote.keys(t); len(keys) != 20 {
+		t.Errorf("s3 upload: %d files are uploaded", len(keys))
+	}
+	last := progress[len(progress)-1]
+	if last.FilesDone != 20 || last.FilesTotal != 20 || last.BytesDone != total || last.BytesTotal != total {
+		t.Errorf("s3 upload: invalid last progress: %+v", last)
+	}
+	for i := 1; i < len(progress); i++ {
+		if progress[i].BytesDone < progress[i-1].BytesDone || progress[i].FilesDone < progress[i-1].FilesDone {
+			t.Errorf("s3 upload: progress goes back: %+v -> %+v", progress[i-1], progress[i])
+		}
+	}
+	if !strings.Contains(buf.String(), "s3 upload: 20/20 files") {
+		t.Errorf("s3 upload: final progress is not logged: %v", buf.String())
+	}
+}
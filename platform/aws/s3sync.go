@@ -0,0 +1,181 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/hashicorp/go-multierror"
+	"github.com/yonekawa/cloudflow/storage"
+)
+
+// S3SyncDirection represents the direction of S3SyncTask.
+type S3SyncDirection int
+
+const (
+	// S3SyncUpload syncs local dir into s3 folder.
+	S3SyncUpload S3SyncDirection = iota
+	// S3SyncDownload syncs s3 folder into local dir.
+	S3SyncDownload
+)
+
+// S3CompareMethod represents how S3SyncTask detects changed files.
+type S3CompareMethod int
+
+const (
+	// S3CompareSizeAndModTime treats files as changed when size differs or source is newer.
+	S3CompareSizeAndModTime S3CompareMethod = iota
+	// S3CompareChecksum treats files of the same size as changed when MD5 differs from ETag.
+	// Objects uploaded by multipart have no MD5 ETag, so they are compared by size and mod time.
+	S3CompareChecksum
+)
+
+// S3SyncResult reports relative paths of files handled by the latest sync.
+type S3SyncResult struct {
+	Copied  []string
+	Skipped []string
+	Deleted []string
+}
+
+// S3SyncTask transfers only changed files between local dir and s3 folder.
+type S3SyncTask struct {
+	Session   *session.Session
+	LocalDir  string
+	S3Folder  string
+	Bucket    string
+	Direction S3SyncDirection
+
+	CompareMethod S3CompareMethod
+
+	// Delete removes files in destination which do not exist in source.
+	Delete bool
+	// DryRun only logs what would be done.
+	DryRun bool
+
+	// Files filtered out by Filter are neither copied nor deleted.
+	S3TransferOptions
+
+	// UploadOptions is applied to each uploaded object.
+	// UploadOptions.SSECustomerKey also decrypts downloaded objects.
+	UploadOptions *S3UploadOptions
+
+	// Checksum verifies uploaded objects, Content-MD5 by default.
+	// Downloaded objects are always verified by stored SHA-256 or ETag when possible.
+	Checksum S3Checksum
+
+	Logger *log.Logger
+
+	// Result of the latest execution.
+	Result *S3SyncResult
+}
+
+// NewS3SyncTask creates a s3 sync task.
+func NewS3SyncTask(sess *session.Session, localDir, s3Folder, bucket string, direction S3SyncDirection) *S3SyncTask {
+	return &S3SyncTask{
+		Session:   sess,
+		LocalDir:  localDir,
+		S3Folder:  s3Folder,
+		Bucket:    bucket,
+		Direction: direction,
+	}
+}
+
+// SetLogger sets log writer.
+func (st *S3SyncTask) SetLogger(logger *log.Logger) {
+	st.Logger = logger
+}
+
+// Execute implement Task.Execute.
+func (st *S3SyncTask) Execute() error {
+	return st.ExecuteContext(context.Background())
+}
+
+// ExecuteContext implement ContextTask.ExecuteContext.
+func (st *S3SyncTask) ExecuteContext(ctx context.Context) error {
+	matcher, err := st.Filter.compile()
+	if err != nil {
+		return err
+	}
+
+	local := st.Local
+	if local == nil {
+		// uploading a missing dir would delete all objects
+		if _, err := os.Stat(st.LocalDir); err != nil && st.Direction == S3SyncUpload {
+			return err
+		}
+		local = storage.NewLocalBucket(st.LocalDir)
+	}
+	remote := st.Remote
+	if remote == nil {
+		b := &S3Bucket{
+			Session:         st.Session,
+			Bucket:          st.Bucket,
+			PartSize:        st.PartSize,
+			PartConcurrency: st.PartConcurrency,
+			UploadOptions:   st.UploadOptions,
+			Checksum:        st.Checksum,
+		}
+		if st.UploadOptions != nil {
+			b.SSECustomerKey = st.UploadOptions.SSECustomerKey
+		}
+		remote = b
+	}
+
+	tt := storage.NewTransferTask(local, "", remote, s3FolderPrefix(st.S3Folder))
+	if st.Direction == S3SyncDownload {
+		tt = storage.NewTransferTask(remote, s3FolderPrefix(st.S3Folder), local, "")
+	}
+	tt.Recursive = true
+	tt.Sync = true
+	tt.CompareChecksum = st.CompareMethod == S3CompareChecksum
+	tt.Delete = st.Delete
+	tt.DryRun = st.DryRun
+	st.Filtered = make([]S3FilteredFile, 0)
+	tt.Filter = matcher.filterFunc(&st.Filtered, st.Logger, "sync")
+	tt.Concurrency = st.Concurrency
+	tt.Logger = st.Logger
+
+	progress := newS3ProgressTracker("s3 sync", st.Logger, st.OnProgress, st.ProgressInterval)
+	tt.OnProgress = progress.update
+	defer progress.finish()
+
+	err = tt.ExecuteContext(ctx)
+	st.Result = &S3SyncResult{Copied: tt.Copied, Skipped: tt.Skipped, Deleted: tt.Deleted}
+	return err
+}
+
+// deleteS3Keys deletes keys by DeleteObjects in batches of 1000.
+func deleteS3Keys(ctx context.Context, svc *s3.S3, bucket string, keys []string) error {
+	var result *multierror.Error
+	for start := 0; start < len(keys); start += 1000 {
+		end := start + 1000
+		if end > len(keys) {
+			end = len(keys)
+		}
+		objects := make([]*s3.ObjectIdentifier, 0, end-start)
+		for _, key := range keys[start:end] {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+
+		out, err := deleteObjects(ctx, svc, &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return err
+		}
+		for _, e := range out.Errors {
+			result = multierror.Append(result, fmt.Errorf("cloudflow: s3 delete %v failed: %v", aws.StringValue(e.Key), aws.StringValue(e.Message)))
+		}
+	}
+	return result.ErrorOrNil()
+}
+
+// for mock testing
+var deleteObjects = func(ctx context.Context, svc *s3.S3, input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	return svc.DeleteObjectsWithContext(ctx, input)
+}
@@ -0,0 +1,122 @@
+package aws
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestS3SyncTask_Execute(t *testing.T) {
+	t.Parallel()
+
+	remote := newTestBucket()
+	localDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(localDir)
+	os.MkdirAll(filepath.Join(localDir, "sub"), 0777)
+	ioutil.WriteFile(filepath.Join(localDir, "a"), []byte("a"), 0666)
+	ioutil.WriteFile(filepath.Join(localDir, "sub", "b"), []byte("b"), 0666)
+	remote.Put("/dst/stale", []byte("stale"), time.Now())
+
+	up := NewS3SyncTask(nil, localDir, "/dst", "bucket", S3SyncUpload)
+	up.Remote = remote
+	up.Delete = true
+	up.DryRun = true
+	if err := up.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if len(up.Result.Copied) != 2 || len(up.Result.Deleted) != 1 || remote.created != 0 || len(remote.keys(t)) != 1 {
+		t.Errorf("sync: dry run changes bucket or invalid result: %+v", up.Result)
+	}
+
+	up.DryRun = false
+	if err := up.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if len(up.Result.Copied) != 2 || len(up.Result.Deleted) != 1 {
+		t.Errorf("sync: invalid result: %+v", up.Result)
+	}
+	if _, err := remote.Stat(context.Background(), "/dst/sub/b"); err != nil {
+		t.Errorf("sync: file is not uploaded: %v", err)
+	}
+	if _, err := remote.Stat(context.Background(), "/dst/stale"); err == nil {
+		t.Error("sync: object not in source is not deleted")
+	}
+
+	// nothing changed
+	if err := up.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if len(up.Result.Copied) != 0 || len(up.Result.Skipped) != 2 || remote.created != 2 {
+		t.Errorf("sync: unchanged files are copied: %+v", up.Result)
+	}
+
+	// same size but different content
+	ioutil.WriteFile(filepath.Join(localDir, "a"), []byte("A"), 0666)
+	os.Chtimes(filepath.Join(localDir, "a"), time.Now().Add(-time.Hour), time.Now().Add(-time.Hour))
+	if err := up.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if len(up.Result.Copied) != 0 {
+		t.Errorf("sync: older file is copied by size and mod time: %+v", up.Result)
+	}
+	up.CompareMethod = S3CompareChecksum
+	if err := up.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if len(up.Result.Copied) != 1 || up.Result.Copied[0] != "a" {
+		t.Errorf("sync: changed file is not copied by checksum: %+v", up.Result)
+	}
+
+	missing := NewS3SyncTask(nil, filepath.Join(localDir, "none"), "/dst", "bucket", S3SyncUpload)
+	missing.Remote = remote
+	missing.Delete = true
+	if err := missing.Execute(); err == nil {
+		t.Error("sync: expect to fail upload of missing dir but it succeeded")
+	}
+
+	// download
+	dstDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+	ioutil.WriteFile(filepath.Join(dstDir, "local-only"), []byte("x"), 0666)
+	down := NewS3SyncTask(nil, dstDir, "/dst", "bucket", S3SyncDownload)
+	down.Remote = remote
+	down.Delete = true
+	if err := down.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if len(down.Result.Copied) != 2 || len(down.Result.Deleted) != 1 {
+		t.Errorf("sync: invalid result: %+v", down.Result)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dstDir, "sub", "b")); string(b) != "b" {
+		t.Errorf("sync: invalid downloaded file: %v", string(b))
+	}
+	if _, err := os.Stat(filepath.Join(dstDir, "local-only")); !os.IsNotExist(err) {
+		t.Error("sync: file not in source is not deleted")
+	}
+
+	down.Filter = new(S3Filter).Exclude("sub/")
+	if err := down.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if len(down.Filtered) != 2 || len(down.Result.Deleted) != 0 {
+		t.Errorf("sync: filtered files must be neither copied nor deleted: %+v %v", down.Result, down.Filtered)
+	}
+	down.Filter = nil
+
+	remote.Put("/dst/sub/b", []byte("bb"), time.Now().Add(time.Hour))
+	if err := down.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if len(down.Result.Copied) != 1 || len(down.Result.Skipped) != 1 {
+		t.Errorf("sync: invalid result: %+v", down.Result)
+	}
+}
@@ -0,0 +1,324 @@
+package aws
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/hashicorp/go-multierror"
+)
+
+var defaultPartSize int64 = 16 * 1024 * 1024
+var defaultPartConcurrency = 4
+
+// s3 allows 10000 parts at most in a multipart upload
+var maxUploadParts int64 = 10000
+
+// s3Transfer uploads and downloads files larger than partSize by parts in parallel.
+type s3Transfer struct {
+	svc             *s3.S3
+	bucket          string
+	partSize        int64
+	partConcurrency int
+
+	// progress is notified of transferred bytes by parts, nil is allowed
+	progress func(n int64)
+
+	uploadOptions *S3UploadOptions
+	checksum      S3Checksum
+	// sseCustomerKey decrypts downloaded objects encrypted by SSE-C
+	sseCustomerKey string
+}
+
+func newS3Transfer(svc *s3.S3, bucket string, partSize int64, partConcurrency int) *s3Transfer {
+	if partSize <= 0 {
+		partSize = defaultPartSize
+	}
+	if partConcurrency <= 0 {
+		partConcurrency = defaultPartConcurrency
+	}
+	return &s3Transfer{svc: svc, bucket: bucket, partSize: partSize, partConcurrency: partConcurrency}
+}
+
+func (t *s3Transfer) upload(ctx context.Context, key, srcPath string) error {
+	file, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	var sha256Sum string
+	if t.checksum == S3ChecksumSHA256 {
+		sum, err := hashReader(file, sha256.New())
+		if err != nil {
+			return err
+		}
+		sha256Sum = hex.EncodeToString(sum)
+	}
+
+	if info.Size() <= t.partSize {
+		input := &s3.PutObjectInput{
+			Key:    aws.String(key),
+			Bucket: aws.String(t.bucket),
+			Body:   file,
+		}
+		t.uploadOptions.applyPutObject(input, key)
+		if t.checksum != S3ChecksumNone {
+			if input.ContentMD5, err = contentMD5(file); err != nil {
+				return err
+			}
+		}
+		if sha256Sum != "" {
+			input.Metadata = withSHA256Metadata(input.Metadata, sha256Sum)
+		}
+		if _, err := t.svc.PutObjectWithContext(ctx, input); err != nil {
+			return err
+		}
+		t.addBytes(info.Size())
+		return nil
+	}
+	return t.uploadMultipart(ctx, key, sha256Sum, file, info.Size())
+}
+
+// uploadMultipart aborts the upload when any part fails or ctx is cancelled.
+func (t *s3Transfer) uploadMultipart(ctx context.Context, key, sha256Sum string, file *os.File, size int64) error {
+	partSize := t.partSize
+	if size > partSize*maxUploadParts {
+		partSize = (size + maxUploadParts - 1) / maxUploadParts
+	}
+
+	input := &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(t.bucket),
+		Key:    aws.String(key),
+	}
+	t.uploadOptions.applyCreateMultipartUpload(input, key)
+	if sha256Sum != "" {
+		input.Metadata = withSHA256Metadata(input.Metadata, sha256Sum)
+	}
+	created, err := createMultipartUpload(ctx, t.svc, input)
+	if err != nil {
+		return err
+	}
+
+	numParts := int((size + partSize - 1) / partSize)
+	parts := make([]*s3.CompletedPart, numParts)
+	err = runParts(ctx, numParts, t.partConcurrency, func(i int) error {
+		offset := int64(i) * partSize
+		n := partSize
+		if offset+n > size {
+			n = size - offset
+		}
+		body := io.NewSectionReader(file, offset, n)
+		input := &s3.UploadPartInput{
+			Bucket:        aws.String(t.bucket),
+			Key:           aws.String(key),
+			UploadId:      created.UploadId,
+			PartNumber:    aws.Int64(int64(i + 1)),
+			Body:          body,
+			ContentLength: aws.Int64(n),
+		}
+		t.uploadOptions.applyUploadPart(input)
+		if t.checksum != S3ChecksumNone {
+			var err error
+			if input.ContentMD5, err = contentMD5(body); err != nil {
+				return err
+			}
+		}
+		out, err := uploadPart(ctx, t.svc, input)
+		if err != nil {
+			return err
+		}
+		parts[i] = &s3.CompletedPart{ETag: out.ETag, PartNumber: aws.Int64(int64(i + 1))}
+		t.addBytes(n)
+		return nil
+	})
+	if err == nil {
+		_, err = completeMultipartUpload(ctx, t.svc, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(t.bucket),
+			Key:             aws.String(key),
+			UploadId:        created.UploadId,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+		})
+	}
+	if err == nil {
+		return nil
+	}
+
+	// abort even when ctx is cancelled, since incomplete parts are charged until aborted
+	_, abortErr := abortMultipartUpload(context.Background(), t.svc, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(t.bucket),
+		Key:      aws.String(key),
+		UploadId: created.UploadId,
+	})
+	if abortErr != nil {
+		return multierror.Append(err, fmt.Errorf("cloudflow: abort multipart upload of %v failed: %v", key, abortErr))
+	}
+	return err
+}
+
+// download gets the object by ranges in parallel when size is larger than partSize.
+// Negative size means unknown size.
+// The object is written to a temp file in the dst dir, verified by checksum
+// and renamed to dstPath, so failed downloads never leave a truncated file.
+func (t *s3Transfer) download(ctx context.Context, key string, size int64, dstPath string) (err error) {
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0777); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(dstPath), "."+filepath.Base(dstPath)+".")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		file.Close()
+		if err != nil {
+			os.Remove(file.Name())
+		}
+	}()
+
+	var checksum *s3ObjectChecksum
+	if size <= t.partSize {
+		if checksum, err = t.getRange(ctx, key, "", file, 0); err != nil {
+			return err
+		}
+	} else {
+		numParts := int((size + t.partSize - 1) / t.partSize)
+		checksums := make([]*s3ObjectChecksum, numParts)
+		err = runParts(ctx, numParts, t.partConcurrency, func(i int) error {
+			offset := int64(i) * t.partSize
+			end := offset + t.partSize - 1
+			if end >= size {
+				end = size - 1
+			}
+			var err error
+			checksums[i], err = t.getRange(ctx, key, fmt.Sprintf("bytes=%d-%d", offset, end), file, offset)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for _, c := range checksums[1:] {
+			if c.etag != checksums[0].etag {
+				return fmt.Errorf("cloudflow: s3 object %v is changed while downloading", key)
+			}
+		}
+		checksum = checksums[0]
+	}
+
+	if err = checksum.verify(key, file); err != nil {
+		return err
+	}
+	if err = file.Chmod(0644); err != nil {
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), dstPath)
+}
+
+func (t *s3Transfer) getRange(ctx context.Context, key, byteRange string, file *os.File, offset int64) (*s3ObjectChecksum, error) {
+	input := &s3.GetObjectInput{
+		Key:    aws.String(key),
+		Bucket: aws.String(t.bucket),
+	}
+	if byteRange != "" {
+		input.Range = aws.String(byteRange)
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = sseCustomerKey(t.sseCustomerKey)
+	out, err := t.svc.GetObjectWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+
+	n, err := io.Copy(&offsetWriter{file: file, offset: offset}, out.Body)
+	t.addBytes(n)
+	if err != nil {
+		return nil, err
+	}
+	return newS3ObjectChecksum(out), nil
+}
+
+func (t *s3Transfer) addBytes(n int64) {
+	if t.progress != nil {
+		t.progress(n)
+	}
+}
+
+type offsetWriter struct {
+	file   *os.File
+	offset int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.file.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
+
+// runParts calls fn for each part by concurrency workers.
+// It stops scheduling parts at the first error or when ctx is cancelled.
+func runParts(ctx context.Context, numParts, concurrency int, fn func(i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	indexes := make(chan int)
+	var once sync.Once
+	var firstErr error
+
+	wg := sync.WaitGroup{}
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if err := fn(i); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < numParts && ctx.Err() == nil; i++ {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// for mock testing
+var createMultipartUpload = func(ctx context.Context, svc *s3.S3, input *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	return svc.CreateMultipartUploadWithContext(ctx, input)
+}
+var uploadPart = func(ctx context.Context, svc *s3.S3, input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	return svc.UploadPartWithContext(ctx, input)
+}
+var completeMultipartUpload = func(ctx context.Context, svc *s3.S3, input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	return svc.CompleteMultipartUploadWithContext(ctx, input)
+}
+var abortMultipartUpload = func(ctx context.Context, svc *s3.S3, input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	return svc.AbortMultipartUploadWithContext(ctx, input)
+}
@@ -0,0 +1,407 @@
+package aws
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+type testS3Request struct {
+	Method string
+	Key    string
+	Query  url.Values
+	Header http.Header
+}
+
+// testS3Server is a s3 compatible https server supporting multipart upload and ranged get.
+// https is required to send SSE-C keys.
+type testS3Server struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	// etag and x-amz-meta-* headers of objects
+	headers map[string]http.Header
+	uploads map[string]map[int][]byte
+	parts   int
+	ranges  int
+	aborted []string
+	// requests received, keys are empty for bucket requests
+	requests []testS3Request
+
+	// onPart is called with part number before storing the part, and fails it by returning false.
+	onPart func(n int) bool
+	// onRequest is called with each request before handling it, and can change objects.
+	onRequest func(req testS3Request)
+}
+
+func newTestS3Server() *testS3Server {
+	s := &testS3Server{
+		objects: make(map[string][]byte),
+		headers: make(map[string]http.Header),
+		uploads: make(map[string]map[int][]byte),
+	}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+func (s *testS3Server) session(t *testing.T) *session.Session {
+	// trust the test server even if AWS_CA_BUNDLE is set
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config: aws.Config{
+			Endpoint:         aws.String(s.URL),
+			Region:           aws.String("us-east-1"),
+			S3ForcePathStyle: aws.Bool(true),
+			Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+			MaxRetries:       aws.Int(0),
+		},
+		CustomCABundle: bytes.NewReader(ca),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sess
+}
+
+func (s *testS3Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	// path style: /bucket/key
+	key := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	q := r.URL.Query()
+	body, _ := ioutil.ReadAll(r.Body)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	req := testS3Request{Method: r.Method, Query: q, Header: r.Header}
+	if len(key) == 2 {
+		req.Key = key[1]
+	}
+	s.requests = append(s.requests, req)
+	if s.onRequest != nil {
+		s.onRequest(req)
+	}
+
+	if m := r.Header.Get("Content-Md5"); m != "" {
+		sum := md5.Sum(body)
+		if m != base64.StdEncoding.EncodeToString(sum[:]) {
+			http.Error(w, "<Error><Code>BadDigest</Code></Error>", http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch {
+	case len(key) == 1 && r.Method == "GET":
+		s.list(w, q.Get("prefix"), q.Get("delimiter"))
+	case r.Method == "POST" && hasQuery(q, "delete"):
+		var del struct {
+			Objects []struct {
+				Key string
+			} `xml:"Object"`
+		}
+		xml.Unmarshal(body, &del)
+		for _, o := range del.Objects {
+			delete(s.objects, o.Key)
+			delete(s.headers, o.Key)
+		}
+		fmt.Fprint(w, "<DeleteResult></DeleteResult>")
+	case r.Method == "POST" && hasQuery(q, "uploads"):
+		id := strconv.Itoa(len(s.requests))
+		s.uploads[id] = make(map[int][]byte)
+		s.headers[key[1]] = objectHeader(r.Header, "multipart-"+id)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", key[1], id)
+	case r.Method == "PUT" && q.Get("uploadId") != "":
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		if s.onPart != nil {
+			s.mu.Unlock()
+			ok := s.onPart(n)
+			s.mu.Lock()
+			if !ok {
+				http.Error(w, "<Error><Code>InternalError</Code></Error>", http.StatusInternalServerError)
+				return
+			}
+		}
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			// UploadPartCopy
+			src, _ = url.PathUnescape(src)
+			var start, end int
+			fmt.Sscanf(r.Header.Get("X-Amz-Copy-Source-Range"), "bytes=%d-%d", &start, &end)
+			body = s.objects[strings.SplitN(src, "/", 2)[1]][start : end+1]
+			fmt.Fprintf(w, `<CopyPartResult><ETag>"etag-%d"</ETag></CopyPartResult>`, n)
+		} else {
+			w.Header().Set("ETag", fmt.Sprintf(`"etag-%d"`, n))
+		}
+		s.parts++
+		s.uploads[q.Get("uploadId")][n] = body
+	case r.Method == "POST" && q.Get("uploadId") != "":
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+			} `xml:"Part"`
+		}
+		xml.Unmarshal(body, &complete)
+		var buf bytes.Buffer
+		for _, p := range complete.Parts {
+			buf.Write(s.uploads[q.Get("uploadId")][p.PartNumber])
+		}
+		s.objects[key[1]] = buf.Bytes()
+		delete(s.uploads, q.Get("uploadId"))
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Key>%s</Key></CompleteMultipartUploadResult>", key[1])
+	case r.Method == "DELETE" && q.Get("uploadId") != "":
+		s.aborted = append(s.aborted, key[1])
+		delete(s.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "PUT" && r.Header.Get("X-Amz-Copy-Source") != "":
+		src, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		srcKey := strings.SplitN(src, "/", 2)[1]
+		s.objects[key[1]] = s.objects[srcKey]
+		s.headers[key[1]] = s.headers[srcKey]
+		fmt.Fprintf(w, "<CopyObjectResult><ETag>%s</ETag></CopyObjectResult>", s.headers[srcKey].Get("ETag"))
+	case r.Method == "PUT":
+		s.objects[key[1]] = body
+		sum := md5.Sum(body)
+		s.headers[key[1]] = objectHeader(r.Header, hex.EncodeToString(sum[:]))
+		w.Header().Set("ETag", s.headers[key[1]].Get("ETag"))
+	case r.Method == "GET" || r.Method == "HEAD":
+		o, ok := s.objects[key[1]]
+		if !ok {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("Range") != "" {
+			s.ranges++
+		}
+		for k, v := range s.headers[key[1]] {
+			w.Header()[k] = v
+		}
+		http.ServeContent(w, r, key[1], time.Time{}, bytes.NewReader(o))
+	default:
+		http.Error(w, "<Error><Code>NotImplemented</Code></Error>", http.StatusNotImplemented)
+	}
+}
+
+// objectHeader returns headers stored with the object.
+func objectHeader(req http.Header, etag string) http.Header {
+	h := http.Header{}
+	h.Set("ETag", `"`+etag+`"`)
+	h.Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+	for k, v := range req {
+		if strings.HasPrefix(k, "X-Amz-Meta-") {
+			h[k] = v
+		}
+	}
+	return h
+}
+
+func hasQuery(q url.Values, name string) bool {
+	_, ok := q[name]
+	return ok
+}
+
+func (s *testS3Server) list(w http.ResponseWriter, prefix, delimiter string) {
+	keys := make([]string, 0)
+	for k := range s.objects {
+		if delimiter != "" && strings.Contains(strings.TrimPrefix(k, prefix), delimiter) {
+			continue
+		}
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	fmt.Fprint(w, "<ListBucketResult><IsTruncated>false</IsTruncated>")
+	for _, k := range keys {
+		modTime, _ := http.ParseTime(s.headers[k].Get("Last-Modified"))
+		fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>%s</LastModified><ETag>%s</ETag></Contents>",
+			k, len(s.objects[k]), modTime.Format(time.RFC3339), html.EscapeString(s.headers[k].Get("ETag")))
+	}
+	fmt.Fprint(w, "</ListBucketResult>")
+}
+
+func TestS3Transfer_Multipart(t *testing.T) {
+	t.Parallel()
+
+	server := newTestS3Server()
+	defer server.Close()
+	sess := server.session(t)
+
+	srcDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	large := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	ioutil.WriteFile(filepath.Join(srcDir, "large"), large, 0666)
+	ioutil.WriteFile(filepath.Join(srcDir, "small"), []byte("small"), 0666)
+
+	up := NewS3BulkUploadTask(sess, srcDir, "dst", "bucket")
+	up.PartSize = 5
+	up.PartConcurrency = 3
+	if err := up.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if string(server.objects["dst/large"]) != string(large) || string(server.objects["dst/small"]) != "small" {
+		t.Errorf("s3 transfer: invalid uploaded objects: %q %q", server.objects["dst/large"], server.objects["dst/small"])
+	}
+	if server.parts != 8 {
+		t.Errorf("s3 transfer: large file must be uploaded by 8 parts but %d", server.parts)
+	}
+
+	dstDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+	down := NewS3BulkDownloadTask(sess, "dst", dstDir, "bucket")
+	down.PartSize = 5
+	down.PartConcurrency = 3
+	if err := down.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dstDir, "large")); string(b) != string(large) {
+		t.Errorf("s3 transfer: invalid downloaded file: %q", b)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dstDir, "small")); string(b) != "small" {
+		t.Errorf("s3 transfer: invalid downloaded file: %q", b)
+	}
+	if server.ranges != 8 {
+		t.Errorf("s3 transfer: large object must be downloaded by 8 ranges but %d", server.ranges)
+	}
+
+	// failed part aborts the upload
+	server.onPart = func(n int) bool { return n != 2 }
+	up.S3DstFolder = "failed"
+	if err := up.Execute(); err == nil {
+		t.Error("s3 transfer: failed part must be error")
+	}
+	if len(server.aborted) != 1 || server.aborted[0] != "failed/large" || len(server.uploads) != 0 {
+		t.Errorf("s3 transfer: failed upload is not aborted: %v", server.aborted)
+	}
+	if _, ok := server.objects["failed/large"]; ok {
+		t.Error("s3 transfer: failed upload must not be completed")
+	}
+
+	// cancel aborts the upload without waiting for the part in flight
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	server.onPart = func(n int) bool {
+		cancel()
+		<-release
+		return false
+	}
+	up.S3DstFolder = "cancelled"
+	up.PartConcurrency = 1
+	done := make(chan error, 1)
+	go func() { done <- up.ExecuteContext(ctx) }()
+	select {
+	case err := <-done:
+		done <- err
+	case <-time.After(5 * time.Second):
+		t.Error("s3 transfer: cancelled upload waits for the part in flight")
+	}
+	close(release)
+	if err := <-done; err == nil {
+		t.Error("s3 transfer: cancelled upload must be error")
+	}
+	if len(server.aborted) != 2 || server.aborted[1] != "cancelled/large" || len(server.uploads) != 0 {
+		t.Errorf("s3 transfer: cancelled upload is not aborted: %v", server.aborted)
+	}
+}
+
+func TestS3Transfer_Integrity(t *testing.T) {
+	t.Parallel()
+
+	server := newTestS3Server()
+	defer server.Close()
+	sess := server.session(t)
+
+	srcDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	ioutil.WriteFile(filepath.Join(srcDir, "large"), []byte("0123456789abcdefghijklmnopqrstuvwxyz"), 0666)
+	ioutil.WriteFile(filepath.Join(srcDir, "small"), []byte("small"), 0666)
+
+	up := NewS3BulkUploadTask(sess, srcDir, "dst", "bucket")
+	up.PartSize = 5
+	up.Checksum = S3ChecksumSHA256
+	if err := up.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range server.requests {
+		if r.Method == "PUT" && r.Header.Get("Content-Md5") == "" {
+			t.Errorf("s3 upload: Content-MD5 is not sent for %v", r.Key)
+		}
+	}
+	for _, key := range []string{"dst/large", "dst/small"} {
+		if server.headers[key].Get("X-Amz-Meta-Cloudflow-Sha256") == "" {
+			t.Errorf("s3 upload: sha256 is not stored in metadata of %v", key)
+		}
+	}
+
+	download := func() (string, error) {
+		dstDir, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		down := NewS3BulkDownloadTask(sess, "dst", dstDir, "bucket")
+		down.PartSize = 5
+		return dstDir, down.Execute()
+	}
+
+	dstDir, err := download()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(dstDir)
+
+	// corrupted multipart object is detected by stored sha256
+	server.objects["dst/large"][0] = 'X'
+	dstDir, err = download()
+	if err == nil || !strings.Contains(err.Error(), "checksum of s3 object dst/large mismatch") {
+		t.Errorf("s3 download: corrupted object must be error: %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dstDir); len(files) != 1 || files[0].Name() != "small" {
+		t.Errorf("s3 download: failed download leaves files: %v", files)
+	}
+	os.RemoveAll(dstDir)
+
+	// corrupted object without sha256 is detected by etag
+	up.Checksum = S3ChecksumMD5
+	if err := up.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	server.objects["dst/small"][0] = 'X'
+	dstDir, err = download()
+	if err == nil || !strings.Contains(err.Error(), "checksum of s3 object dst/small mismatch") {
+		t.Errorf("s3 download: corrupted object must be error: %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dstDir); len(files) != 1 || files[0].Name() != "large" {
+		t.Errorf("s3 download: failed download leaves files: %v", files)
+	}
+	os.RemoveAll(dstDir)
+}
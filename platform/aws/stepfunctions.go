@@ -0,0 +1,142 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sfn"
+	"github.com/yonekawa/cloudflow"
+	"github.com/yonekawa/cloudflow/task"
+)
+
+// StepFunctionsStartExecutionTask starts AWS Step Functions execution and waits for it to finish.
+// The execution is stopped when the task times out or the context is cancelled.
+type StepFunctionsStartExecutionTask struct {
+	Session             *session.Session
+	StartExecutionInput *sfn.StartExecutionInput
+	PollingTime         time.Duration
+	Timeout             time.Duration
+
+	// InputParam is the workflow parameter used as the input json instead of StartExecutionInput.Input.
+	InputParam string
+	// Result receives the output decoded as json if not nil.
+	Result interface{}
+	// ResultParam is the workflow parameter receiving the output json.
+	ResultParam string
+	Logger      *log.Logger
+
+	// ExecutionArn and Output of the latest execution.
+	ExecutionArn string
+	Output       string
+}
+
+// NewStepFunctionsStartExecutionTask creates a task starting Step Functions execution.
+func NewStepFunctionsStartExecutionTask(sess *session.Session, input *sfn.StartExecutionInput) *StepFunctionsStartExecutionTask {
+	return &StepFunctionsStartExecutionTask{
+		Session:             sess,
+		StartExecutionInput: input,
+		PollingTime:         defaultPollingTime,
+		Timeout:             defaultTimeout,
+	}
+}
+
+// SetLogger sets log writer.
+func (st *StepFunctionsStartExecutionTask) SetLogger(logger *log.Logger) {
+	st.Logger = logger
+}
+
+// Execute implement Task.Execute.
+func (st *StepFunctionsStartExecutionTask) Execute() error {
+	return st.ExecuteContext(context.Background())
+}
+
+// ExecuteContext implement ContextTask.ExecuteContext.
+func (st *StepFunctionsStartExecutionTask) ExecuteContext(ctx context.Context) error {
+	svc := sfn.New(st.Session)
+	input := *st.StartExecutionInput
+	if st.InputParam != "" {
+		value, ok := cloudflow.ParamsFromContext(ctx).Get(st.InputParam)
+		if !ok {
+			return fmt.Errorf("cloudflow: workflow parameter %v is not set", st.InputParam)
+		}
+		input.Input = aws.String(value)
+	}
+
+	st.ExecutionArn, st.Output = "", ""
+	start, err := startExecution(svc, &input)
+	if err != nil {
+		return err
+	}
+	st.ExecutionArn = aws.StringValue(start.ExecutionArn)
+	logf(st.Logger, "cloudflow: started step functions execution %v", st.ExecutionArn)
+
+	var output *string
+	sensor := task.NewSensorTask(func(ctx context.Context) (bool, error) {
+		describe, err := describeExecution(svc, &sfn.DescribeExecutionInput{ExecutionArn: start.ExecutionArn})
+		if err != nil {
+			return false, err
+		}
+		switch status := aws.StringValue(describe.Status); status {
+		case sfn.ExecutionStatusSucceeded:
+			output = describe.Output
+			return true, nil
+		case sfn.ExecutionStatusFailed, sfn.ExecutionStatusTimedOut, sfn.ExecutionStatusAborted:
+			return false, fmt.Errorf("cloudflow: step functions execution %v %v by error:%v cause:%v",
+				st.ExecutionArn, status, aws.StringValue(describe.Error), aws.StringValue(describe.Cause))
+		}
+		return false, nil
+	})
+	sensor.PollingTime = st.PollingTime
+	sensor.Timeout = st.Timeout
+
+	err = sensor.ExecuteContext(ctx)
+	switch {
+	case err == task.ErrSensorTimeout:
+		return st.stopExecution(svc, "timed out")
+	case err != nil && ctx.Err() != nil:
+		return st.stopExecution(svc, "cancelled")
+	case err != nil:
+		return err
+	}
+
+	st.Output = aws.StringValue(output)
+	logf(st.Logger, "cloudflow: step functions execution %v succeeded", st.ExecutionArn)
+	if st.Result != nil && st.Output != "" {
+		if err := json.Unmarshal([]byte(st.Output), st.Result); err != nil {
+			return fmt.Errorf("cloudflow: decode output of step functions execution %v failed: %v", st.ExecutionArn, err)
+		}
+	}
+	if params := cloudflow.ParamsFromContext(ctx); st.ResultParam != "" && params != nil {
+		params.Set(st.ResultParam, st.Output)
+	}
+	return nil
+}
+
+// stopExecution stops the execution, and returns error reporting why and whether the execution was stopped.
+func (st *StepFunctionsStartExecutionTask) stopExecution(svc *sfn.SFN, cause string) error {
+	_, err := stopExecution(svc, &sfn.StopExecutionInput{
+		ExecutionArn: aws.String(st.ExecutionArn),
+		Error:        aws.String("cloudflow.Stopped"),
+		Cause:        aws.String(defaultTerminateReason),
+	})
+	if err != nil {
+		return fmt.Errorf("cloudflow: step functions execution %v %s, and stopping the execution failed: %v", st.ExecutionArn, cause, err)
+	}
+	return fmt.Errorf("cloudflow: step functions execution %v %s, and the execution was stopped", st.ExecutionArn, cause)
+}
+
+// for mock testing
+var startExecution = func(svc *sfn.SFN, input *sfn.StartExecutionInput) (*sfn.StartExecutionOutput, error) {
+	return svc.StartExecution(input)
+}
+var describeExecution = func(svc *sfn.SFN, input *sfn.DescribeExecutionInput) (*sfn.DescribeExecutionOutput, error) {
+	return svc.DescribeExecution(input)
+}
+var stopExecution = func(svc *sfn.SFN, input *sfn.StopExecutionInput) (*sfn.StopExecutionOutput, error) {
+	return svc.StopExecution(input)
+}
@@ -0,0 +1,104 @@
+package aws
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sfn"
+	"github.com/yonekawa/cloudflow"
+)
+
+func TestStepFunctionsStartExecutionTask_Execute(t *testing.T) {
+	t.Parallel()
+
+	sess, err := session.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var started *sfn.StartExecutionInput
+	startExecution = func(svc *sfn.SFN, input *sfn.StartExecutionInput) (*sfn.StartExecutionOutput, error) {
+		started = input
+		return &sfn.StartExecutionOutput{ExecutionArn: aws.String("arn:execution:1")}, nil
+	}
+	statuses := []string{"RUNNING", "RUNNING", "SUCCEEDED"}
+	describeExecution = func(svc *sfn.SFN, input *sfn.DescribeExecutionInput) (*sfn.DescribeExecutionOutput, error) {
+		if aws.StringValue(input.ExecutionArn) != "arn:execution:1" {
+			t.Errorf("step functions: invalid execution arn: %v", input)
+		}
+		status := statuses[0]
+		if len(statuses) > 1 {
+			statuses = statuses[1:]
+		}
+		out := &sfn.DescribeExecutionOutput{Status: aws.String(status)}
+		if status == "SUCCEEDED" {
+			out.Output = aws.String(`{"rows":42}`)
+		}
+		return out, nil
+	}
+
+	var result struct {
+		Rows int `json:"rows"`
+	}
+	task := NewStepFunctionsStartExecutionTask(sess, &sfn.StartExecutionInput{StateMachineArn: aws.String("arn:state-machine"), Input: aws.String(`{}`)})
+	task.PollingTime = 10 * time.Microsecond
+	task.InputParam = "input"
+	task.Result = &result
+	task.ResultParam = "output"
+	params := cloudflow.NewParams(map[string]string{"input": `{"date":"2017-01-01"}`})
+	if err := task.ExecuteContext(cloudflow.WithParams(context.Background(), params)); err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(started.Input) != `{"date":"2017-01-01"}` || aws.StringValue(started.StateMachineArn) != "arn:state-machine" {
+		t.Errorf("step functions: invalid start input: %v", started)
+	}
+	if task.ExecutionArn != "arn:execution:1" || task.Output != `{"rows":42}` || result.Rows != 42 {
+		t.Errorf("step functions: invalid result: %v %v %+v", task.ExecutionArn, task.Output, result)
+	}
+	if output, _ := params.Get("output"); output != `{"rows":42}` {
+		t.Errorf("step functions: output is not set to param: %v", output)
+	}
+
+	// failed execution
+	task.InputParam = ""
+	describeExecution = func(svc *sfn.SFN, input *sfn.DescribeExecutionInput) (*sfn.DescribeExecutionOutput, error) {
+		return &sfn.DescribeExecutionOutput{Status: aws.String("FAILED"), Error: aws.String("States.TaskFailed"), Cause: aws.String("bad input")}, nil
+	}
+	if err := task.Execute(); err == nil || !strings.Contains(err.Error(), "FAILED by error:States.TaskFailed cause:bad input") {
+		t.Errorf("step functions: invalid failure: %v", err)
+	}
+
+	// cancelled execution is stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	describeExecution = func(svc *sfn.SFN, input *sfn.DescribeExecutionInput) (*sfn.DescribeExecutionOutput, error) {
+		cancel()
+		return &sfn.DescribeExecutionOutput{Status: aws.String("RUNNING")}, nil
+	}
+	var stopped *sfn.StopExecutionInput
+	stopExecution = func(svc *sfn.SFN, input *sfn.StopExecutionInput) (*sfn.StopExecutionOutput, error) {
+		stopped = input
+		return &sfn.StopExecutionOutput{}, nil
+	}
+	task.PollingTime = time.Minute
+	if err := task.ExecuteContext(ctx); err == nil || !strings.Contains(err.Error(), "cancelled, and the execution was stopped") {
+		t.Errorf("step functions: invalid cancel error: %v", err)
+	}
+	if stopped == nil || aws.StringValue(stopped.ExecutionArn) != "arn:execution:1" {
+		t.Errorf("step functions: cancelled execution is not stopped: %v", stopped)
+	}
+
+	// timed out execution is stopped
+	stopped = nil
+	task.PollingTime = time.Millisecond
+	task.Timeout = 10 * time.Millisecond
+	if err := task.Execute(); err == nil || !strings.Contains(err.Error(), "timed out, and the execution was stopped") {
+		t.Errorf("step functions: invalid timeout error: %v", err)
+	}
+	if stopped == nil {
+		t.Error("step functions: timed out execution is not stopped")
+	}
+}
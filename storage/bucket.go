@@ -0,0 +1,65 @@
+// Package storage abstracts object stores used by transfer tasks.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrNotExist is returned when the object does not exist.
+var ErrNotExist = errors.New("storage: object does not exist")
+
+// ObjectInfo describes an object in a bucket.
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+	// MD5 is hex MD5 of the content, or empty when the bucket does not know it without reading the object.
+	MD5 string
+}
+
+// Bucket is a store of objects named by slash separated keys.
+type Bucket interface {
+	// List returns objects whose key starts with prefix sorted by key.
+	// Objects in sub folders of prefix are listed only when recursive.
+	List(ctx context.Context, prefix string, recursive bool) ([]ObjectInfo, error)
+	// Open returns reader of the object, or ErrNotExist.
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// Create returns writer of the object, which is visible only after Close succeeds.
+	// Closing the writer after ctx is cancelled discards the object.
+	Create(ctx context.Context, key string) (io.WriteCloser, error)
+	// Delete deletes the object. Deleting an object which does not exist is not an error.
+	Delete(ctx context.Context, key string) error
+	// Stat returns info of the object, or ErrNotExist.
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+}
+
+// FileUploader is implemented by buckets which store a local file faster than by Create,
+// for example by uploading parts of the file in parallel.
+// progress is called with the bytes uploaded.
+type FileUploader interface {
+	UploadFile(ctx context.Context, key, path string, progress func(n int64)) error
+}
+
+// FileDownloader is implemented by buckets which write an object into a local file faster than by Open,
+// for example by downloading ranges of the object in parallel.
+// The file is replaced only after the whole object is written, and progress is called with the bytes downloaded.
+type FileDownloader interface {
+	DownloadFile(ctx context.Context, src ObjectInfo, path string, progress func(n int64)) error
+}
+
+// inFolder reports whether key is listed under prefix.
+func inFolder(key, prefix string, recursive bool) bool {
+	if !strings.HasPrefix(key, prefix) {
+		return false
+	}
+	return recursive || !strings.Contains(key[len(prefix):], "/")
+}
+
+func sortObjects(objects []ObjectInfo) {
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+}
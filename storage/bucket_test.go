@@ -0,0 +1,78 @@
+package storage_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/yonekawa/cloudflow/storage"
+	"github.com/yonekawa/cloudflow/storage/storagetest"
+)
+
+func TestMemoryBucket(t *testing.T) {
+	t.Parallel()
+	storagetest.TestBucket(t, storage.NewMemoryBucket())
+}
+
+func TestLocalBucket(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storagetest.TestBucket(t, storage.NewLocalBucket(dir))
+
+	if _, err := storage.NewLocalBucket(filepath.Join(dir, "dir")).Open(context.Background(), "../other"); err == nil {
+		t.Error("local bucket: key escaping dir must be error")
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "dir")); len(files) != 2 {
+		t.Errorf("local bucket: temp files are left: %v", files)
+	}
+}
+
+func TestLocalBucket_Symlinks(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	other, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(other)
+
+	os.MkdirAll(filepath.Join(dir, "sub"), 0777)
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("a"), 0666)
+	ioutil.WriteFile(filepath.Join(other, "d"), []byte("d"), 0666)
+	os.Symlink(other, filepath.Join(dir, "linkdir"))
+	os.Symlink(filepath.Join(other, "d"), filepath.Join(dir, "linkfile"))
+	os.Symlink(dir, filepath.Join(dir, "sub", "loop"))
+
+	listKeys := func(b *storage.LocalBucket) []string {
+		objects, err := b.List(context.Background(), "", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := make([]string, len(objects))
+		for i, o := range objects {
+			keys[i] = o.Key
+		}
+		return keys
+	}
+	if keys := listKeys(storage.NewLocalBucket(dir)); !reflect.DeepEqual(keys, []string{"a"}) {
+		t.Errorf("local bucket: symlinks must be skipped: %v", keys)
+	}
+	b := storage.NewLocalBucket(dir)
+	b.FollowSymlinks = true
+	if keys := listKeys(b); !reflect.DeepEqual(keys, []string{"a", "linkdir/d", "linkfile"}) {
+		t.Errorf("local bucket: invalid keys following symlinks: %v", keys)
+	}
+}
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"context"
+	"sync"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+var defaultConcurrency = 10
+
+// ForEach calls fn for each of n items by concurrency workers and collects all errors.
+// Items not started yet are skipped when ctx is cancelled. Zero concurrency uses 10.
+func ForEach(ctx context.Context, n, concurrency int, fn func(i int) error) error {
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+
+	indexes := make(chan int)
+	errChan := make(chan error)
+	wg := sync.WaitGroup{}
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if err := fn(i); err != nil {
+					errChan <- err
+				}
+			}
+		}()
+	}
+
+	resultChan := make(chan error)
+	go func() {
+		var result *multierror.Error
+		for err := range errChan {
+			result = multierror.Append(result, err)
+		}
+		resultChan <- result.ErrorOrNil()
+	}()
+
+	for i := 0; i < n && ctx.Err() == nil; i++ {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+		}
+	}
+	close(indexes)
+	wg.Wait()
+	close(errChan)
+
+	if err := <-resultChan; err != nil {
+		return err
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestForEach(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	running, maxRunning, done := 0, 0, 0
+	err := ForEach(context.Background(), 20, 3, func(i int) error {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+		running--
+		done++
+		if i%10 == 0 {
+			return errors.New("error")
+		}
+		return nil
+	})
+	if err == nil {
+		t.Error("foreach: errors are not returned")
+	}
+	if done != 20 || maxRunning > 3 {
+		t.Errorf("foreach: invalid run done:%v max running:%v", done, maxRunning)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := ForEach(ctx, 20, 3, func(i int) error {
+		t.Error("foreach: item started after cancel")
+		return nil
+	}); err != context.Canceled {
+		t.Errorf("foreach: expect to be cancelled but got: %v", err)
+	}
+}
@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// LocalBucket is a bucket of files under Dir. Keys are slash separated paths relative to Dir.
+type LocalBucket struct {
+	Dir string
+	// FollowSymlinks lists files and dirs linked by symbolic links, which are skipped by default.
+	// Dirs already listed are skipped to avoid loops.
+	FollowSymlinks bool
+}
+
+// NewLocalBucket creates a local bucket.
+func NewLocalBucket(dir string) *LocalBucket {
+	return &LocalBucket{Dir: dir}
+}
+
+// path returns file path of key and rejects keys escaping Dir.
+func (b *LocalBucket) path(key string) (string, error) {
+	p := filepath.Join(b.Dir, filepath.FromSlash(key))
+	r, err := filepath.Rel(b.Dir, p)
+	if err != nil || r == "." || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("storage: key %v escapes dir %v", key, b.Dir)
+	}
+	return p, nil
+}
+
+// List implement Bucket.List.
+func (b *LocalBucket) List(ctx context.Context, prefix string, recursive bool) ([]ObjectInfo, error) {
+	objects := make([]ObjectInfo, 0)
+	if _, err := os.Stat(b.Dir); os.IsNotExist(err) {
+		return objects, nil
+	}
+
+	if err := b.walk("", prefix, recursive, make(map[string]bool), &objects); err != nil {
+		return nil, err
+	}
+	sortObjects(objects)
+	return objects, nil
+}
+
+// walk appends files in the dir of key rel to objects.
+func (b *LocalBucket) walk(rel, prefix string, recursive bool, visited map[string]bool, objects *[]ObjectInfo) error {
+	dir := filepath.Join(b.Dir, filepath.FromSlash(rel))
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	if visited[real] {
+		return nil
+	}
+	visited[real] = true
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range entries {
+		key := path.Join(rel, info.Name())
+		if info.Mode()&os.ModeSymlink != 0 {
+			if !b.FollowSymlinks {
+				continue
+			}
+			if info, err = os.Stat(filepath.Join(dir, info.Name())); err != nil {
+				return err
+			}
+		}
+
+		if info.IsDir() {
+			// skip folders not containing keys with prefix
+			if strings.HasPrefix(prefix, key+"/") || recursive && strings.HasPrefix(key+"/", prefix) {
+				if err := b.walk(key, prefix, recursive, visited, objects); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if info.Mode().IsRegular() && inFolder(key, prefix, recursive) {
+			*objects = append(*objects, ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		}
+	}
+	return nil
+}
+
+// Open implement Bucket.Open.
+func (b *LocalBucket) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := b.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, ErrNotExist
+	}
+	return file, err
+}
+
+// Create implement Bucket.Create.
+// The file is written to a temp file in the same dir and renamed on Close.
+func (b *LocalBucket) Create(ctx context.Context, key string) (io.WriteCloser, error) {
+	p, err := b.path(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+		return nil, err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p)+".")
+	if err != nil {
+		return nil, err
+	}
+	return &localWriter{File: file, ctx: ctx, path: p}, nil
+}
+
+// Delete implement Bucket.Delete.
+func (b *LocalBucket) Delete(ctx context.Context, key string) error {
+	p, err := b.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Stat implement Bucket.Stat.
+func (b *LocalBucket) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	p, err := b.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := os.Stat(p)
+	if os.IsNotExist(err) || err == nil && info.IsDir() {
+		return ObjectInfo{}, ErrNotExist
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+type localWriter struct {
+	*os.File
+	ctx  context.Context
+	path string
+}
+
+func (w *localWriter) Close() error {
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+	if err := w.ctx.Err(); err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+	if err := os.Chmod(w.Name(), 0644); err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+	return os.Rename(w.Name(), w.path)
+}
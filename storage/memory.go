@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+func (o *memoryObject) info(key string) ObjectInfo {
+	sum := md5.Sum(o.data)
+	return ObjectInfo{Key: key, Size: int64(len(o.data)), ModTime: o.modTime, MD5: hex.EncodeToString(sum[:])}
+}
+
+// MemoryBucket is an in-memory bucket mainly for tests.
+type MemoryBucket struct {
+	mu      sync.Mutex
+	objects map[string]*memoryObject
+}
+
+// NewMemoryBucket creates an empty memory bucket.
+func NewMemoryBucket() *MemoryBucket {
+	return &MemoryBucket{objects: make(map[string]*memoryObject)}
+}
+
+// Put stores data as the object.
+func (b *MemoryBucket) Put(key string, data []byte, modTime time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects[key] = &memoryObject{data: append([]byte(nil), data...), modTime: modTime}
+}
+
+// List implement Bucket.List.
+func (b *MemoryBucket) List(ctx context.Context, prefix string, recursive bool) ([]ObjectInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	objects := make([]ObjectInfo, 0)
+	for key, o := range b.objects {
+		if inFolder(key, prefix, recursive) {
+			objects = append(objects, o.info(key))
+		}
+	}
+	sortObjects(objects)
+	return objects, nil
+}
+
+// Open implement Bucket.Open.
+func (b *MemoryBucket) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	o, ok := b.objects[key]
+	if !ok {
+		return nil, ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(o.data)), nil
+}
+
+// Create implement Bucket.Create.
+func (b *MemoryBucket) Create(ctx context.Context, key string) (io.WriteCloser, error) {
+	return &memoryWriter{ctx: ctx, bucket: b, key: key}, nil
+}
+
+// Delete implement Bucket.Delete.
+func (b *MemoryBucket) Delete(ctx context.Context, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.objects, key)
+	return nil
+}
+
+// Stat implement Bucket.Stat.
+func (b *MemoryBucket) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	o, ok := b.objects[key]
+	if !ok {
+		return ObjectInfo{}, ErrNotExist
+	}
+	return o.info(key), nil
+}
+
+type memoryWriter struct {
+	bytes.Buffer
+	ctx    context.Context
+	bucket *MemoryBucket
+	key    string
+}
+
+func (w *memoryWriter) Close() error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	w.bucket.Put(w.key, w.Bytes(), time.Now())
+	return nil
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Progress is a progress of TransferTask.
+type Progress struct {
+	ObjectsDone  int
+	ObjectsTotal int
+	BytesDone    int64
+	BytesTotal   int64
+	Elapsed      time.Duration
+}
+
+// progressTracker notifies observer of every update. nil observer is allowed.
+type progressTracker struct {
+	mu       sync.Mutex
+	progress Progress
+	start    time.Time
+	observer func(Progress)
+}
+
+func newProgressTracker(observer func(Progress), objectsTotal int, bytesTotal int64) *progressTracker {
+	return &progressTracker{
+		progress: Progress{ObjectsTotal: objectsTotal, BytesTotal: bytesTotal},
+		start:    time.Now(),
+		observer: observer,
+	}
+}
+
+func (t *progressTracker) addBytes(n int64) {
+	t.update(func(p *Progress) { p.BytesDone += n })
+}
+
+func (t *progressTracker) objectDone() {
+	t.update(func(p *Progress) { p.ObjectsDone++ })
+}
+
+func (t *progressTracker) update(fn func(p *Progress)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fn(&t.progress)
+	t.progress.Elapsed = time.Since(t.start)
+	if t.observer != nil {
+		t.observer(t.progress)
+	}
+}
+
+// progressReader passes the bytes read to progress.
+type progressReader struct {
+	io.Reader
+	progress func(n int64)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 && r.progress != nil {
+		r.progress(int64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,115 @@
+// Package storagetest tests implementations of storage.Bucket.
+package storagetest
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/yonekawa/cloudflow/storage"
+)
+
+// TestBucket checks b behaves as storage.Bucket. b must be empty.
+func TestBucket(t *testing.T, b storage.Bucket) {
+	ctx := context.Background()
+
+	for key, data := range map[string]string{"dir/a": "a", "dir/b": "bb", "dir/sub/c": "ccc", "other": "o"} {
+		if err := put(ctx, b, key, data); err != nil {
+			t.Fatalf("create %v: %v", key, err)
+		}
+	}
+
+	listKeys := func(prefix string, recursive bool) []string {
+		objects, err := b.List(ctx, prefix, recursive)
+		if err != nil {
+			t.Fatalf("list %v: %v", prefix, err)
+		}
+		keys := make([]string, len(objects))
+		for i, o := range objects {
+			keys[i] = o.Key
+		}
+		return keys
+	}
+	if keys := listKeys("dir/", false); !reflect.DeepEqual(keys, []string{"dir/a", "dir/b"}) {
+		t.Errorf("list: invalid keys: %v", keys)
+	}
+	if keys := listKeys("dir/", true); !reflect.DeepEqual(keys, []string{"dir/a", "dir/b", "dir/sub/c"}) {
+		t.Errorf("list recursive: invalid keys: %v", keys)
+	}
+	if keys := listKeys("none/", true); len(keys) != 0 {
+		t.Errorf("list: objects under no prefix: %v", keys)
+	}
+
+	info, err := b.Stat(ctx, "dir/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Key != "dir/b" || info.Size != 2 || info.ModTime.IsZero() {
+		t.Errorf("stat: invalid info: %+v", info)
+	}
+	if sum := md5.Sum([]byte("bb")); info.MD5 != "" && info.MD5 != hex.EncodeToString(sum[:]) {
+		t.Errorf("stat: invalid md5: %v", info.MD5)
+	}
+	if _, err := b.Stat(ctx, "dir/none"); err != storage.ErrNotExist {
+		t.Errorf("stat: must be ErrNotExist but %v", err)
+	}
+
+	r, err := b.Open(ctx, "dir/sub/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(data) != "ccc" {
+		t.Errorf("open: invalid data: %q %v", data, err)
+	}
+	if _, err := b.Open(ctx, "dir/none"); err != storage.ErrNotExist {
+		t.Errorf("open: must be ErrNotExist but %v", err)
+	}
+
+	// overwrite
+	if err := put(ctx, b, "dir/a", "aaaa"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := b.Stat(ctx, "dir/a"); err != nil || info.Size != 4 {
+		t.Errorf("create: object is not overwritten: %+v %v", info, err)
+	}
+
+	// cancelled create
+	cctx, cancel := context.WithCancel(ctx)
+	w, err := b.Create(cctx, "dir/cancelled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("partial"))
+	cancel()
+	w.Close()
+	if _, err := b.Stat(ctx, "dir/cancelled"); err != storage.ErrNotExist {
+		t.Errorf("create: cancelled object must not exist: %v", err)
+	}
+
+	if err := b.Delete(ctx, "dir/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Stat(ctx, "dir/a"); err != storage.ErrNotExist {
+		t.Errorf("delete: object is not deleted: %v", err)
+	}
+	if err := b.Delete(ctx, "dir/a"); err != nil {
+		t.Errorf("delete: deleting object not exist must not be error: %v", err)
+	}
+}
+
+func put(ctx context.Context, b storage.Bucket, key, data string) error {
+	w, err := b.Create(ctx, key)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(data)); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,274 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+)
+
+// TransferTask copies objects under SrcPrefix of Src into DstPrefix of Dst.
+// Key of the copy is DstPrefix followed by the key after SrcPrefix,
+// so upload, download and copy between any buckets are the same task.
+type TransferTask struct {
+	Src       Bucket
+	SrcPrefix string
+	Dst       Bucket
+	DstPrefix string
+
+	// Recursive transfers objects in sub folders of SrcPrefix too.
+	Recursive bool
+
+	// Sync copies only objects whose size differs or which are newer than the destination.
+	Sync bool
+	// CompareChecksum makes Sync compare MD5 of objects of the same size instead of modification time.
+	// The object is read to compute MD5 unknown to its bucket, and modification time is compared
+	// when neither bucket knows MD5.
+	CompareChecksum bool
+	// Delete removes objects in DstPrefix which do not exist in SrcPrefix.
+	Delete bool
+	// DryRun only logs objects which would be copied and deleted.
+	DryRun bool
+
+	// Filter selects objects by the key after SrcPrefix, all objects are selected when nil.
+	Filter func(rel string, info ObjectInfo) bool
+
+	// Concurrency limits objects copied in parallel. Zero value uses 10.
+	Concurrency int
+
+	// OnProgress is called whenever bytes or an object are copied.
+	OnProgress func(Progress)
+
+	Logger *log.Logger
+
+	// Relative keys handled by the latest execution.
+	Copied  []string
+	Skipped []string
+	Deleted []string
+}
+
+// NewTransferTask creates a transfer task.
+func NewTransferTask(src Bucket, srcPrefix string, dst Bucket, dstPrefix string) *TransferTask {
+	return &TransferTask{
+		Src:       src,
+		SrcPrefix: srcPrefix,
+		Dst:       dst,
+		DstPrefix: dstPrefix,
+	}
+}
+
+// SetLogger sets log writer.
+func (tt *TransferTask) SetLogger(logger *log.Logger) {
+	tt.Logger = logger
+}
+
+// Execute implement Task.Execute.
+func (tt *TransferTask) Execute() error {
+	return tt.ExecuteContext(context.Background())
+}
+
+// ExecuteContext implement ContextTask.ExecuteContext.
+func (tt *TransferTask) ExecuteContext(ctx context.Context) error {
+	tt.Copied, tt.Skipped, tt.Deleted = make([]string, 0), make([]string, 0), make([]string, 0)
+
+	src, err := tt.list(ctx, tt.Src, tt.SrcPrefix)
+	if err != nil {
+		return err
+	}
+	var dst map[string]ObjectInfo
+	if tt.Sync || tt.Delete {
+		if dst, err = tt.list(ctx, tt.Dst, tt.DstPrefix); err != nil {
+			return err
+		}
+	}
+
+	var bytesTotal int64
+	for _, rel := range sortedKeys(src) {
+		// check all keys before copying
+		if escapes(rel) {
+			return fmt.Errorf("storage: key %v escapes dst prefix %v", tt.SrcPrefix+rel, tt.DstPrefix)
+		}
+		if d, ok := dst[rel]; ok && tt.Sync {
+			changed, err := tt.changed(ctx, src[rel], d)
+			if err != nil {
+				return err
+			}
+			if !changed {
+				tt.Skipped = append(tt.Skipped, rel)
+				continue
+			}
+		}
+		tt.Copied = append(tt.Copied, rel)
+		bytesTotal += src[rel].Size
+	}
+	if tt.Delete {
+		for _, rel := range sortedKeys(dst) {
+			if _, ok := src[rel]; !ok {
+				tt.Deleted = append(tt.Deleted, rel)
+			}
+		}
+	}
+
+	if tt.DryRun {
+		for _, rel := range tt.Copied {
+			tt.logf("storage: (dryrun) copy %v to %v", tt.SrcPrefix+rel, tt.DstPrefix+rel)
+		}
+		for _, rel := range tt.Deleted {
+			tt.logf("storage: (dryrun) delete %v", tt.DstPrefix+rel)
+		}
+		return nil
+	}
+
+	progress := newProgressTracker(tt.OnProgress, len(tt.Copied), bytesTotal)
+	err = ForEach(ctx, len(tt.Copied), tt.Concurrency, func(i int) error {
+		rel := tt.Copied[i]
+		if err := copyObject(ctx, tt.Src, src[rel], tt.Dst, tt.DstPrefix+rel, progress.addBytes); err != nil {
+			return err
+		}
+		progress.objectDone()
+		tt.logf("storage: copy %v to %v", tt.SrcPrefix+rel, tt.DstPrefix+rel)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = ForEach(ctx, len(tt.Deleted), tt.Concurrency, func(i int) error {
+		rel := tt.Deleted[i]
+		if err := tt.Dst.Delete(ctx, tt.DstPrefix+rel); err != nil {
+			return err
+		}
+		tt.logf("storage: delete %v", tt.DstPrefix+rel)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	tt.logf("storage: copied %d, skipped %d, deleted %d", len(tt.Copied), len(tt.Skipped), len(tt.Deleted))
+	return nil
+}
+
+// list returns selected objects by the key after prefix.
+func (tt *TransferTask) list(ctx context.Context, b Bucket, prefix string) (map[string]ObjectInfo, error) {
+	objects, err := b.List(ctx, prefix, tt.Recursive)
+	if err != nil {
+		return nil, err
+	}
+	selected := make(map[string]ObjectInfo, len(objects))
+	for _, o := range objects {
+		rel := strings.TrimPrefix(o.Key, prefix)
+		if tt.Filter == nil || tt.Filter(rel, o) {
+			selected[rel] = o
+		}
+	}
+	return selected, nil
+}
+
+// changed reports whether src must be copied over dst in sync.
+func (tt *TransferTask) changed(ctx context.Context, src, dst ObjectInfo) (bool, error) {
+	if src.Size != dst.Size {
+		return true, nil
+	}
+	if !tt.CompareChecksum || src.MD5 == "" && dst.MD5 == "" {
+		return src.ModTime.After(dst.ModTime), nil
+	}
+	srcMD5, err := objectMD5(ctx, tt.Src, src)
+	if err != nil {
+		return false, err
+	}
+	dstMD5, err := objectMD5(ctx, tt.Dst, dst)
+	if err != nil {
+		return false, err
+	}
+	return srcMD5 != dstMD5, nil
+}
+
+func (tt *TransferTask) logf(format string, v ...interface{}) {
+	if tt.Logger != nil {
+		tt.Logger.Printf(format, v...)
+	}
+}
+
+// objectMD5 returns MD5 known to the bucket, or reads the object to compute it.
+func objectMD5(ctx context.Context, b Bucket, info ObjectInfo) (string, error) {
+	if info.MD5 != "" {
+		return info.MD5, nil
+	}
+	r, err := b.Open(ctx, info.Key)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copyObject copies src into key of dst, passing the bytes copied to progress.
+// Local files are uploaded by FileUploader and downloaded by FileDownloader.
+func copyObject(ctx context.Context, srcBucket Bucket, src ObjectInfo, dst Bucket, key string, progress func(n int64)) error {
+	if local, ok := srcBucket.(*LocalBucket); ok {
+		if uploader, ok := dst.(FileUploader); ok {
+			p, err := local.path(src.Key)
+			if err != nil {
+				return err
+			}
+			return uploader.UploadFile(ctx, key, p, progress)
+		}
+	}
+	if local, ok := dst.(*LocalBucket); ok {
+		if downloader, ok := srcBucket.(FileDownloader); ok {
+			p, err := local.path(key)
+			if err != nil {
+				return err
+			}
+			return downloader.DownloadFile(ctx, src, p, progress)
+		}
+	}
+
+	r, err := srcBucket.Open(ctx, src.Key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// cancel discards the partial object
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w, err := dst.Create(ctx, key)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, &progressReader{Reader: r, progress: progress}); err != nil {
+		cancel()
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// escapes reports whether rel contains .. segments, which would be copied out of the destination prefix.
+func escapes(rel string) bool {
+	for _, s := range strings.Split(rel, "/") {
+		if s == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(objects map[string]ObjectInfo) []string {
+	keys := make([]string, 0, len(objects))
+	for k := range objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransferTask_Execute(t *testing.T) {
+	t.Parallel()
+
+	src := NewMemoryBucket()
+	now := time.Now()
+	src.Put("src/a", []byte("a"), now)
+	src.Put("src/b.tmp", []byte("b"), now)
+	src.Put("src/sub/c", []byte("c"), now)
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dst := NewLocalBucket(dir)
+
+	task := NewTransferTask(src, "src/", dst, "dst/")
+	task.Recursive = true
+	task.Filter = func(rel string, info ObjectInfo) bool {
+		return !strings.HasSuffix(rel, ".tmp")
+	}
+	if err := task.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(task.Copied, []string{"a", "sub/c"}) {
+		t.Errorf("transfer: invalid copied: %v", task.Copied)
+	}
+	if b, _ := ioutil.ReadFile(dir + "/dst/sub/c"); string(b) != "c" {
+		t.Errorf("transfer: invalid copy: %q", b)
+	}
+
+	// sync copies only changed objects and deletes objects not in source
+	src.Put("src/a", []byte("aa"), now)
+	ioutil.WriteFile(dir+"/dst/stale", []byte("x"), 0666)
+	task.Sync = true
+	task.Delete = true
+	if err := task.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(task.Copied, []string{"a"}) || !reflect.DeepEqual(task.Skipped, []string{"sub/c"}) || !reflect.DeepEqual(task.Deleted, []string{"stale"}) {
+		t.Errorf("transfer: invalid sync result copied:%v skipped:%v deleted:%v", task.Copied, task.Skipped, task.Deleted)
+	}
+	if _, err := os.Stat(dir + "/dst/stale"); !os.IsNotExist(err) {
+		t.Error("transfer: object not in source is not deleted")
+	}
+}
+
+type failingBucket struct {
+	*MemoryBucket
+}
+
+func (b *failingBucket) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	r, err := b.MemoryBucket.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(io.MultiReader(r, &failingReader{})), nil
+}
+
+type failingReader struct{}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("read error")
+}
+
+func TestTransferTask_Failure(t *testing.T) {
+	t.Parallel()
+
+	src := &failingBucket{NewMemoryBucket()}
+	src.Put("a", []byte("partial"), time.Now())
+	dst := NewMemoryBucket()
+
+	if err := NewTransferTask(src, "", dst, "").Execute(); err == nil {
+		t.Error("transfer: read error must be error")
+	}
+	if _, err := dst.Stat(context.Background(), "a"); err != ErrNotExist {
+		t.Errorf("transfer: partial object must not be created: %v", err)
+	}
+}
+
+func TestTransferTask_Sync(t *testing.T) {
+	t.Parallel()
+
+	src := NewMemoryBucket()
+	dst := NewMemoryBucket()
+	now := time.Now()
+	src.Put("a", []byte("A"), now.Add(-time.Hour))
+	src.Put("b", []byte("bb"), now)
+	dst.Put("a", []byte("a"), now)
+	dst.Put("stale", []byte("x"), now)
+
+	// dry run copies and deletes nothing
+	task := NewTransferTask(src, "", dst, "")
+	task.Sync = true
+	task.Delete = true
+	task.DryRun = true
+	if err := task.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(task.Copied, []string{"b"}) || !reflect.DeepEqual(task.Deleted, []string{"stale"}) {
+		t.Errorf("transfer: invalid dry run result copied:%v deleted:%v", task.Copied, task.Deleted)
+	}
+	if _, err := dst.Stat(context.Background(), "stale"); err != nil {
+		t.Errorf("transfer: dry run deleted object: %v", err)
+	}
+
+	// checksum detects the older object of the same size
+	var progress []Progress
+	task.DryRun = false
+	task.CompareChecksum = true
+	task.Concurrency = 1
+	task.OnProgress = func(p Progress) {
+		progress = append(progress, p)
+	}
+	if err := task.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(task.Copied, []string{"a", "b"}) {
+		t.Errorf("transfer: invalid copied by checksum: %v", task.Copied)
+	}
+	last := progress[len(progress)-1]
+	if last.ObjectsDone != 2 || last.ObjectsTotal != 2 || last.BytesDone != 3 || last.BytesTotal != 3 {
+		t.Errorf("transfer: invalid last progress: %+v", last)
+	}
+
+	if err := task.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(task.Skipped, []string{"a", "b"}) {
+		t.Errorf("transfer: unchanged objects are not skipped: %v", task.Skipped)
+	}
+}
+
+func TestTransferTask_Escape(t *testing.T) {
+	t.Parallel()
+
+	src := NewMemoryBucket()
+	src.Put("src/a", []byte("a"), time.Now())
+	src.Put("src/../../escape", []byte("x"), time.Now())
+	dst := NewMemoryBucket()
+
+	task := NewTransferTask(src, "src/", dst, "dst/")
+	task.Recursive = true
+	if err := task.Execute(); err == nil {
+		t.Error("transfer: key escaping dst prefix must be error")
+	}
+	if objects, _ := dst.List(context.Background(), "", true); len(objects) != 0 {
+		t.Errorf("transfer: objects are copied before error: %v", objects)
+	}
+}
@@ -1,6 +1,9 @@
 package cloudflow
 
 import (
+	"context"
+	"log"
+	"reflect"
 	"sync"
 
 	multierror "github.com/hashicorp/go-multierror"
@@ -11,6 +14,51 @@ type Task interface {
 	Execute() error
 }
 
+// ContextTask is implemented by tasks which can be cancelled by context.
+type ContextTask interface {
+	Task
+	ExecuteContext(ctx context.Context) error
+}
+
+func executeTask(ctx context.Context, task Task) error {
+	if ct, ok := task.(ContextTask); ok {
+		return ct.ExecuteContext(ctx)
+	}
+	return task.Execute()
+}
+
+// loggerSetter is implemented by tasks which write logs into the workflow logger.
+type loggerSetter interface {
+	SetLogger(logger *log.Logger)
+}
+
+// setTaskLogger passes logger to task.
+// Nested workflow keeps its own logger, and so does task whose Logger field is already set.
+func setTaskLogger(task Task, logger *log.Logger) {
+	if logger == nil || hasLogger(task) {
+		return
+	}
+	if _, ok := task.(*Workflow); ok {
+		return
+	}
+	if ls, ok := task.(loggerSetter); ok {
+		ls.SetLogger(logger)
+	}
+}
+
+// hasLogger reports whether task keeps non-nil logger in its Logger field.
+func hasLogger(task Task) bool {
+	v := reflect.ValueOf(task)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return false
+	}
+	f := v.FieldByName("Logger")
+	return f.IsValid() && f.Type() == reflect.TypeOf((*log.Logger)(nil)) && !f.IsNil()
+}
+
 type namedTask struct {
 	name string
 	task Task
@@ -36,15 +84,27 @@ func (pt *ParallelTask) Summary() string {
 	return buildTaskSummary(pt.tasks, ", ", false)
 }
 
+// SetLogger sets log writer of parallel tasks.
+func (pt *ParallelTask) SetLogger(logger *log.Logger) {
+	for _, nt := range pt.tasks {
+		setTaskLogger(nt.task, logger)
+	}
+}
+
 // Execute implement Task.Execute.
 func (pt *ParallelTask) Execute() error {
+	return pt.ExecuteContext(context.Background())
+}
+
+// ExecuteContext implement ContextTask.ExecuteContext.
+func (pt *ParallelTask) ExecuteContext(ctx context.Context) error {
 	errChan := make(chan error)
 	var wg sync.WaitGroup
 
 	for _, nt := range pt.tasks {
 		wg.Add(1)
 		go func(t Task) {
-			if err := t.Execute(); err != nil {
+			if err := executeTask(ctx, t); err != nil {
 				errChan <- err
 			}
 			wg.Done()
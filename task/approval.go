@@ -0,0 +1,434 @@
+package task
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ApprovalRequest represents a request waiting for approval.
+type ApprovalRequest struct {
+	ID          string
+	Message     string
+	RequestedAt time.Time
+}
+
+// ApprovalDecision represents who approved or rejected the request and when.
+type ApprovalDecision struct {
+	Approved  bool
+	Approver  string
+	DecidedAt time.Time
+}
+
+// ApprovalSource waits for the decision of the request.
+type ApprovalSource interface {
+	WaitDecision(ctx context.Context, req *ApprovalRequest) (*ApprovalDecision, error)
+}
+
+// ApprovalState is a persisted state of ApprovalTask.
+// Decision is nil while waiting for approval.
+type ApprovalState struct {
+	Request  *ApprovalRequest
+	Decision *ApprovalDecision
+}
+
+// ApprovalStore persists approval state so that paused approval survives restart.
+// Load returns nil state when no state is stored.
+type ApprovalStore interface {
+	Load(id string) (*ApprovalState, error)
+	Save(id string, state *ApprovalState) error
+	Delete(id string) error
+}
+
+// ApprovalTask pauses workflow until the request is approved or rejected.
+type ApprovalTask struct {
+	ID      string
+	Message string
+	Source  ApprovalSource
+
+	// Timeout decides DefaultApproved when no decision is made in time.
+	Timeout         time.Duration
+	DefaultApproved bool
+
+	// Store keeps waiting state across restarts when set.
+	Store ApprovalStore
+
+	Logger *log.Logger
+
+	// Decision of the latest execution.
+	Decision *ApprovalDecision
+}
+
+// NewApprovalTask creates an approval task.
+func NewApprovalTask(id, message string, source ApprovalSource) *ApprovalTask {
+	return &ApprovalTask{ID: id, Message: message, Source: source}
+}
+
+// SetLogger sets log writer.
+func (at *ApprovalTask) SetLogger(logger *log.Logger) {
+	at.Logger = logger
+}
+
+// Execute implement Task.Execute.
+func (at *ApprovalTask) Execute() error {
+	return at.ExecuteContext(context.Background())
+}
+
+// ExecuteContext implement ContextTask.ExecuteContext.
+// It returns error when the request is rejected.
+func (at *ApprovalTask) ExecuteContext(ctx context.Context) error {
+	state, err := at.loadState()
+	if err != nil {
+		return err
+	}
+
+	decision := state.Decision
+	if decision == nil {
+		at.logf("approval: waiting for approval of %v: %v", at.ID, at.Message)
+		if decision, err = at.waitDecision(ctx, state.Request); err != nil {
+			return err
+		}
+		state.Decision = decision
+		if err := at.saveState(state); err != nil {
+			return err
+		}
+	}
+	at.Decision = decision
+
+	if at.Store != nil {
+		if err := at.Store.Delete(at.ID); err != nil {
+			return err
+		}
+	}
+
+	if !decision.Approved {
+		at.logf("approval: %v rejected by %v at %v", at.ID, decision.Approver, decision.DecidedAt)
+		return fmt.Errorf("cloudflow: approval %v rejected by %v", at.ID, decision.Approver)
+	}
+	at.logf("approval: %v approved by %v at %v", at.ID, decision.Approver, decision.DecidedAt)
+	return nil
+}
+
+func (at *ApprovalTask) loadState() (*ApprovalState, error) {
+	if at.Store != nil {
+		state, err := at.Store.Load(at.ID)
+		if err != nil {
+			return nil, err
+		}
+		if state != nil {
+			return state, nil
+		}
+	}
+
+	state := &ApprovalState{
+		Request: &ApprovalRequest{ID: at.ID, Message: at.Message, RequestedAt: time.Now()},
+	}
+	return state, at.saveState(state)
+}
+
+func (at *ApprovalTask) saveState(state *ApprovalState) error {
+	if at.Store == nil {
+		return nil
+	}
+	return at.Store.Save(at.ID, state)
+}
+
+func (at *ApprovalTask) waitDecision(ctx context.Context, req *ApprovalRequest) (*ApprovalDecision, error) {
+	parent := ctx
+	if at.Timeout > 0 {
+		var cancel context.CancelFunc
+		// timeout counts from the first request even after restart
+		ctx, cancel = context.WithDeadline(ctx, req.RequestedAt.Add(at.Timeout))
+		defer cancel()
+	}
+
+	decision, err := at.Source.WaitDecision(ctx, req)
+	if err != nil && ctx.Err() != nil && parent.Err() == nil {
+		return &ApprovalDecision{Approved: at.DefaultApproved, Approver: "timeout", DecidedAt: time.Now()}, nil
+	}
+	return decision, err
+}
+
+func (at *ApprovalTask) logf(format string, v ...interface{}) {
+	if at.Logger != nil {
+		at.Logger.Printf(format, v...)
+	}
+}
+
+// CLIApprovalSource asks the decision by prompt.
+// All requests read answers from one reader of In,
+// so a line typed after a request timed out answers the next request.
+type CLIApprovalSource struct {
+	In  io.Reader
+	Out io.Writer
+
+	once    sync.Once
+	answers chan string
+	err     error
+}
+
+// NewCLIApprovalSource creates an approval source prompting on stdin and stdout.
+func NewCLIApprovalSource() *CLIApprovalSource {
+	return &CLIApprovalSource{In: os.Stdin, Out: os.Stdout}
+}
+
+// WaitDecision implement ApprovalSource.WaitDecision.
+func (src *CLIApprovalSource) WaitDecision(ctx context.Context, req *ApprovalRequest) (*ApprovalDecision, error) {
+	src.once.Do(func() {
+		src.answers = make(chan string)
+		go src.readAnswers()
+	})
+	fmt.Fprintf(src.Out, "%v\nApprove %v? [y/N]: ", req.Message, req.ID)
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case a, ok := <-src.answers:
+		if !ok {
+			return nil, src.err
+		}
+		return &ApprovalDecision{
+			Approved:  a == "y" || a == "yes",
+			Approver:  os.Getenv("USER"),
+			DecidedAt: time.Now(),
+		}, nil
+	}
+}
+
+// readAnswers sends lines of In until it fails, and closes answers with the error.
+func (src *CLIApprovalSource) readAnswers() {
+	r := bufio.NewReader(src.In)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && line == "" {
+			src.err = err
+			close(src.answers)
+			return
+		}
+		src.answers <- strings.ToLower(strings.TrimSpace(line))
+	}
+}
+
+// FileApprovalSource waits for a file dropped into Dir.
+// <ID>.approve approves and <ID>.reject rejects the request.
+// The file content is recorded as approver.
+type FileApprovalSource struct {
+	Dir         string
+	PollingTime time.Duration
+}
+
+// NewFileApprovalSource creates an approval source watching dir.
+func NewFileApprovalSource(dir string) *FileApprovalSource {
+	return &FileApprovalSource{Dir: dir, PollingTime: 5 * time.Second}
+}
+
+// WaitDecision implement ApprovalSource.WaitDecision.
+func (src *FileApprovalSource) WaitDecision(ctx context.Context, req *ApprovalRequest) (*ApprovalDecision, error) {
+	var decision *ApprovalDecision
+	sensor := NewSensorTask(func(ctx context.Context) (bool, error) {
+		for _, approved := range []bool{true, false} {
+			ext := ".reject"
+			if approved {
+				ext = ".approve"
+			}
+			p := filepath.Join(src.Dir, req.ID+ext)
+			b, err := ioutil.ReadFile(p)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return false, err
+			}
+			decision = &ApprovalDecision{
+				Approved:  approved,
+				Approver:  strings.TrimSpace(string(b)),
+				DecidedAt: time.Now(),
+			}
+			return true, os.Remove(p)
+		}
+		return false, nil
+	})
+	sensor.PollingTime = src.PollingTime
+	sensor.Timeout = 0
+
+	if err := sensor.ExecuteContext(ctx); err != nil {
+		return nil, err
+	}
+	return decision, nil
+}
+
+// HTTPApprovalSource serves callback endpoint on Addr while waiting.
+// POST /approvals/<ID>/approve or /approvals/<ID>/reject decides the request, where ID is path escaped.
+// The callback must send one of the approver tokens by Authorization: Bearer <token> header,
+// and the approver of the token is recorded.
+type HTTPApprovalSource struct {
+	Addr string
+	// Approvers maps secret token to approver name.
+	Approvers map[string]string
+}
+
+// NewHTTPApprovalSource creates an approval source serving on addr for approvers keyed by secret token.
+func NewHTTPApprovalSource(addr string, approvers map[string]string) *HTTPApprovalSource {
+	return &HTTPApprovalSource{Addr: addr, Approvers: approvers}
+}
+
+// WaitDecision implement ApprovalSource.WaitDecision.
+func (src *HTTPApprovalSource) WaitDecision(ctx context.Context, req *ApprovalRequest) (*ApprovalDecision, error) {
+	if len(src.Approvers) == 0 {
+		return nil, fmt.Errorf("cloudflow: http approval of %v has no approver token", req.ID)
+	}
+	decisionChan := make(chan *ApprovalDecision, 1)
+	prefix := "/approvals/" + url.PathEscape(req.ID) + "/"
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.EscapedPath()
+		if !strings.HasPrefix(path, prefix) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		approver, ok := src.approver(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var approved bool
+		switch strings.TrimPrefix(path, prefix) {
+		case "approve":
+			approved = true
+		case "reject":
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		select {
+		case decisionChan <- &ApprovalDecision{
+			Approved:  approved,
+			Approver:  approver,
+			DecidedAt: time.Now(),
+		}:
+			w.Write([]byte("ok\n"))
+		default:
+			w.WriteHeader(http.StatusConflict)
+		}
+	})
+
+	l, err := net.Listen("tcp", src.Addr)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: handler}
+	go server.Serve(l)
+	defer func() {
+		// let the callback deciding the request receive its response
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			server.Close()
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case decision := <-decisionChan:
+		return decision, nil
+	}
+}
+
+// approver returns the approver of the bearer token in the request.
+func (src *HTTPApprovalSource) approver(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+	token := []byte(strings.TrimPrefix(auth, "Bearer "))
+	for t, approver := range src.Approvers {
+		if t != "" && subtle.ConstantTimeCompare(token, []byte(t)) == 1 {
+			return approver, true
+		}
+	}
+	return "", false
+}
+
+// FileApprovalStore stores approval state as json files in Dir.
+type FileApprovalStore struct {
+	Dir string
+}
+
+// NewFileApprovalStore creates an approval store in dir.
+func NewFileApprovalStore(dir string) *FileApprovalStore {
+	return &FileApprovalStore{Dir: dir}
+}
+
+// Load implement ApprovalStore.Load.
+func (s *FileApprovalStore) Load(id string) (*ApprovalState, error) {
+	p, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var state ApprovalState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// Save implement ApprovalStore.Save.
+func (s *FileApprovalStore) Save(id string, state *ApprovalState) error {
+	p, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// Delete implement ApprovalStore.Delete.
+func (s *FileApprovalStore) Delete(id string) error {
+	p, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// path returns the file of id, which must be a single path element not to escape Dir.
+func (s *FileApprovalStore) path(id string) (string, error) {
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, `/\`) {
+		return "", fmt.Errorf("cloudflow: approval id %v is not a valid file name in %v", id, s.Dir)
+	}
+	return filepath.Join(s.Dir, id+".approval.json"), nil
+}
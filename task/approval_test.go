@@ -0,0 +1,253 @@
+package task
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testApprovalSource struct {
+	decision *ApprovalDecision
+	waits    int
+}
+
+func (src *testApprovalSource) WaitDecision(ctx context.Context, req *ApprovalRequest) (*ApprovalDecision, error) {
+	src.waits++
+	if src.decision == nil {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return src.decision, nil
+}
+
+func TestApprovalTask_Execute(t *testing.T) {
+	t.Parallel()
+
+	src := &testApprovalSource{decision: &ApprovalDecision{Approved: true, Approver: "alice", DecidedAt: time.Now()}}
+	at := NewApprovalTask("deploy", "deploy to production", src)
+	if err := at.Execute(); err != nil {
+		t.Error(err)
+	}
+	if at.Decision.Approver != "alice" {
+		t.Errorf("approval: invalid approver expect:%v got:%v", "alice", at.Decision.Approver)
+	}
+
+	src.decision = &ApprovalDecision{Approved: false, Approver: "bob", DecidedAt: time.Now()}
+	if err := at.Execute(); err == nil {
+		t.Error("expect to be rejected but it succeeded")
+	}
+
+	src.decision = nil
+	at.Timeout = 10 * time.Millisecond
+	at.DefaultApproved = true
+	if err := at.Execute(); err != nil {
+		t.Error(err)
+	}
+	at.DefaultApproved = false
+	if err := at.Execute(); err == nil {
+		t.Error("expect to be rejected on timeout but it succeeded")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	at.Timeout = time.Hour
+	if err := at.ExecuteContext(ctx); err != context.Canceled {
+		t.Errorf("approval: expect to be cancelled but got: %v", err)
+	}
+}
+
+func TestApprovalTask_ExecuteWithStore(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewFileApprovalStore(dir)
+
+	// process stops while waiting for approval
+	src := &testApprovalSource{}
+	at := NewApprovalTask("deploy", "deploy to production", src)
+	at.Store = store
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := at.ExecuteContext(ctx); err == nil {
+		t.Fatal("expect to be interrupted but it succeeded")
+	}
+	state, err := store.Load("deploy")
+	if err != nil || state == nil || state.Decision != nil {
+		t.Fatalf("approval: waiting state is not stored: %v %v", state, err)
+	}
+	requestedAt := state.Request.RequestedAt
+
+	// decision is stored before restart
+	state.Decision = &ApprovalDecision{Approved: true, Approver: "alice", DecidedAt: time.Now()}
+	if err := store.Save("deploy", state); err != nil {
+		t.Fatal(err)
+	}
+	src = &testApprovalSource{}
+	at = NewApprovalTask("deploy", "deploy to production", src)
+	at.Store = store
+	if err := at.Execute(); err != nil {
+		t.Error(err)
+	}
+	if src.waits != 0 || at.Decision.Approver != "alice" {
+		t.Errorf("approval: stored decision is not used: waits:%v decision:%v", src.waits, at.Decision)
+	}
+	if state, _ := store.Load("deploy"); state != nil {
+		t.Error("approval: state is not deleted after decision")
+	}
+
+	// timeout counts from the first request
+	state = &ApprovalState{Request: &ApprovalRequest{ID: "deploy", RequestedAt: requestedAt.Add(-time.Hour)}}
+	store.Save("deploy", state)
+	at.Timeout = time.Hour
+	if err := at.Execute(); err == nil {
+		t.Error("expect to be rejected on timeout but it succeeded")
+	}
+
+	for _, id := range []string{"", ".", "..", "../deploy", "releases/deploy", `releases\deploy`} {
+		if err := store.Save(id, state); err == nil {
+			t.Errorf("approval: id %q escaping store dir must be error", id)
+		}
+		if _, err := store.Load(id); err == nil {
+			t.Errorf("approval: id %q escaping store dir must be error on load", id)
+		}
+	}
+}
+
+func TestCLIApprovalSource_WaitDecision(t *testing.T) {
+	t.Parallel()
+
+	out := new(bytes.Buffer)
+	src := &CLIApprovalSource{In: strings.NewReader("y\nn\n"), Out: out}
+	decision, err := src.WaitDecision(context.Background(), &ApprovalRequest{ID: "deploy", Message: "deploy to production"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decision.Approved || !strings.Contains(out.String(), "deploy to production") {
+		t.Errorf("approval: invalid decision:%v prompt:%v", decision, out.String())
+	}
+
+	if decision, err := src.WaitDecision(context.Background(), &ApprovalRequest{ID: "deploy"}); err != nil || decision.Approved {
+		t.Errorf("approval: expect to be rejected but got: %v %v", decision, err)
+	}
+	if _, err := src.WaitDecision(context.Background(), &ApprovalRequest{ID: "deploy"}); err != io.EOF {
+		t.Errorf("approval: expect to fail at end of input but got: %v", err)
+	}
+
+	// the line typed after timeout answers the next request
+	r, w := io.Pipe()
+	defer w.Close()
+	src = &CLIApprovalSource{In: r, Out: ioutil.Discard}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := src.WaitDecision(ctx, &ApprovalRequest{ID: "first"}); err != context.DeadlineExceeded {
+		t.Fatalf("approval: expect to time out but got: %v", err)
+	}
+	go w.Write([]byte("yes\n"))
+	if decision, err := src.WaitDecision(context.Background(), &ApprovalRequest{ID: "second"}); err != nil || !decision.Approved {
+		t.Errorf("approval: the next request must receive the answer: %v %v", decision, err)
+	}
+}
+
+func TestFileApprovalSource_WaitDecision(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := NewFileApprovalSource(dir)
+	src.PollingTime = time.Millisecond
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		ioutil.WriteFile(filepath.Join(dir, "deploy.reject"), []byte("carol\n"), 0666)
+	}()
+	decision, err := src.WaitDecision(context.Background(), &ApprovalRequest{ID: "deploy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.Approved || decision.Approver != "carol" {
+		t.Errorf("approval: invalid decision: %v", decision)
+	}
+}
+
+func TestHTTPApprovalSource_WaitDecision(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	post := func(path, token string) (int, error) {
+		req, err := http.NewRequest("POST", "http://"+addr+path, nil)
+		if err != nil {
+			return 0, err
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		res.Body.Close()
+		return res.StatusCode, nil
+	}
+
+	statuses := make(chan []int, 1)
+	go func() {
+		for i := 0; i < 100; i++ {
+			if _, err := post("/", ""); err != nil {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			var codes []int
+			for _, c := range []struct{ path, token string }{
+				{"/approvals/deploy%2Fprod/approve", ""},
+				{"/approvals/deploy%2Fprod/approve", "wrong"},
+				{"/approvals/deploy/approve", "dave-token"},
+				{"/approvals/deploy%2Fprod/approve", "dave-token"},
+			} {
+				code, _ := post(c.path, c.token)
+				codes = append(codes, code)
+			}
+			statuses <- codes
+			return
+		}
+		statuses <- nil
+	}()
+
+	src := NewHTTPApprovalSource(addr, map[string]string{"dave-token": "dave"})
+	decision, err := src.WaitDecision(context.Background(), &ApprovalRequest{ID: "deploy/prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes := <-statuses
+	if codes == nil {
+		t.Fatal("approval endpoint is not served")
+	}
+	if expected := []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusNotFound, http.StatusOK}; !reflect.DeepEqual(codes, expected) {
+		t.Errorf("approval: invalid callback status expect:%v got:%v", expected, codes)
+	}
+	if !decision.Approved || decision.Approver != "dave" {
+		t.Errorf("approval: invalid decision: %v", decision)
+	}
+
+	if _, err := NewHTTPApprovalSource(addr, nil).WaitDecision(context.Background(), &ApprovalRequest{ID: "deploy"}); err == nil {
+		t.Error("approval: http source without approver token must be error")
+	}
+}
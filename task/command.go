@@ -1,16 +1,30 @@
 package task
 
-import "os/exec"
+import (
+	"io"
+	"os/exec"
+)
 
+// CommandTask executes local command.
 type CommandTask struct {
 	name string
 	args []string
+
+	// Stdout and Stderr receive the command output when set.
+	Stdout io.Writer
+	Stderr io.Writer
 }
 
+// NewCommandTask creates a local command task.
 func NewCommandTask(name string, args ...string) *CommandTask {
 	return &CommandTask{name: name, args: args}
 }
 
+// Execute implement Task.Execute.
+// It returns *exec.ExitError when the command exits with non-zero status.
 func (cmd *CommandTask) Execute() error {
-	return exec.Command(cmd.name, cmd.args...).Run()
+	c := exec.Command(cmd.name, cmd.args...)
+	c.Stdout = cmd.Stdout
+	c.Stderr = cmd.Stderr
+	return c.Run()
 }
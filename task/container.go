@@ -0,0 +1,295 @@
+package task
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// PullPolicy represents when ContainerTask pulls the image.
+type PullPolicy string
+
+const (
+	// PullIfNotPresent pulls the image only when it does not exist locally.
+	PullIfNotPresent PullPolicy = "IfNotPresent"
+	// PullAlways pulls the image every execution.
+	PullAlways PullPolicy = "Always"
+	// PullNever never pulls the image.
+	PullNever PullPolicy = "Never"
+)
+
+var defaultContainerSocket = "/var/run/docker.sock"
+
+// ContainerExitError reports non-zero exit code of the container.
+type ContainerExitError struct {
+	Image      string
+	StatusCode int
+}
+
+func (e *ContainerExitError) Error() string {
+	return fmt.Sprintf("cloudflow: container %v exited with status %v", e.Image, e.StatusCode)
+}
+
+// ContainerTask runs command in a container by Docker compatible Engine API.
+type ContainerTask struct {
+	Image   string
+	Command []string
+
+	// Env is a list of KEY=VALUE.
+	Env []string
+	// Volumes is a list of host-path:container-path[:ro].
+	Volumes []string
+	Network string
+
+	PullPolicy PullPolicy
+
+	// Socket is a unix socket path of the engine.
+	Socket string
+
+	// Logger receives container logs.
+	Logger *log.Logger
+
+	client *http.Client
+}
+
+// NewContainerTask creates a container task.
+func NewContainerTask(image string, command ...string) *ContainerTask {
+	return &ContainerTask{
+		Image:      image,
+		Command:    command,
+		PullPolicy: PullIfNotPresent,
+		Socket:     defaultContainerSocket,
+	}
+}
+
+// SetLogger sets log writer.
+func (ct *ContainerTask) SetLogger(logger *log.Logger) {
+	ct.Logger = logger
+}
+
+// Execute implement Task.Execute.
+// It returns *ContainerExitError when the container exits with non-zero status.
+func (ct *ContainerTask) Execute() error {
+	ct.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", ct.Socket)
+			},
+		},
+	}
+
+	if err := ct.pullImage(); err != nil {
+		return err
+	}
+
+	id, err := ct.createContainer()
+	if err != nil {
+		return err
+	}
+	defer ct.removeContainer(id)
+
+	if err := ct.request("POST", "/containers/"+id+"/start", nil, nil); err != nil {
+		return err
+	}
+
+	logDone := make(chan struct{})
+	go func() {
+		defer close(logDone)
+		ct.streamLogs(id)
+	}()
+
+	var wait struct {
+		StatusCode int
+	}
+	if err := ct.request("POST", "/containers/"+id+"/wait", nil, &wait); err != nil {
+		return err
+	}
+	<-logDone
+
+	if wait.StatusCode != 0 {
+		return &ContainerExitError{Image: ct.Image, StatusCode: wait.StatusCode}
+	}
+	return nil
+}
+
+func (ct *ContainerTask) pullImage() error {
+	switch ct.PullPolicy {
+	case PullNever:
+		return nil
+	case PullAlways:
+	default:
+		res, err := ct.do("GET", "/images/"+ct.Image+"/json", nil)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode == http.StatusOK {
+			return nil
+		}
+	}
+
+	image, tag := splitImageTag(ct.Image)
+	query := url.Values{"fromImage": {image}, "tag": {tag}}
+	res, err := ct.do("POST", "/images/create?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if err := checkEngineResponse(res); err != nil {
+		return err
+	}
+
+	// pull progress is streamed as json messages
+	dec := json.NewDecoder(res.Body)
+	for {
+		var msg struct {
+			Error string `json:"error"`
+		}
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("cloudflow: pull image %v failed: %v", ct.Image, msg.Error)
+		}
+	}
+}
+
+func (ct *ContainerTask) createContainer() (string, error) {
+	body := map[string]interface{}{
+		"Image": ct.Image,
+		"Cmd":   ct.Command,
+		"Env":   ct.Env,
+		"HostConfig": map[string]interface{}{
+			"Binds":       ct.Volumes,
+			"NetworkMode": ct.Network,
+		},
+	}
+	var created struct {
+		ID string `json:"Id"`
+	}
+	if err := ct.request("POST", "/containers/create", body, &created); err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+func (ct *ContainerTask) removeContainer(id string) error {
+	return ct.request("DELETE", "/containers/"+id+"?force=1&v=1", nil, nil)
+}
+
+func (ct *ContainerTask) streamLogs(id string) {
+	res, err := ct.do("GET", "/containers/"+id+"/logs?follow=1&stdout=1&stderr=1", nil)
+	if err != nil {
+		ct.logf("container: failed to read logs: %v", err)
+		return
+	}
+	defer res.Body.Close()
+	if err := checkEngineResponse(res); err != nil {
+		ct.logf("container: failed to read logs: %v", err)
+		return
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(demuxContainerLogs(pw, res.Body))
+	}()
+	scanner := bufio.NewScanner(pr)
+	for scanner.Scan() {
+		ct.logf("container %v: %v", ct.Image, scanner.Text())
+	}
+	pr.Close()
+}
+
+func (ct *ContainerTask) logf(format string, v ...interface{}) {
+	if ct.Logger != nil {
+		ct.Logger.Printf(format, v...)
+	}
+}
+
+func (ct *ContainerTask) request(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	res, err := ct.do(method, path, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if err := checkEngineResponse(res); err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+func (ct *ContainerTask) do(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, "http://engine"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return ct.client.Do(req)
+}
+
+func checkEngineResponse(res *http.Response) error {
+	if res.StatusCode < 300 {
+		return nil
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	var msg struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(b, &msg) == nil && msg.Message != "" {
+		return fmt.Errorf("cloudflow: container engine error (%v): %v", res.StatusCode, msg.Message)
+	}
+	return fmt.Errorf("cloudflow: container engine error (%v): %s", res.StatusCode, bytes.TrimSpace(b))
+}
+
+// demuxContainerLogs writes payloads of multiplexed stdout/stderr stream into w.
+func demuxContainerLogs(w io.Writer, r io.Reader) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.CopyN(w, r, size); err != nil {
+			return err
+		}
+	}
+}
+
+func splitImageTag(image string) (string, string) {
+	if i := strings.LastIndex(image, "@"); i >= 0 {
+		return image[:i], image[i+1:]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i], image[i+1:]
+	}
+	return image, "latest"
+}
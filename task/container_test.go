@@ -0,0 +1,149 @@
+package task
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testContainerEngine is a fake engine which runs containers exiting with given status.
+type testContainerEngine struct {
+	mu       sync.Mutex
+	images   map[string]bool
+	pulled   []string
+	created  []map[string]interface{}
+	removed  []string
+	status   int
+	logLines []string
+}
+
+func (e *testContainerEngine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	switch {
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/images/"):
+		image := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/images/"), "/json")
+		if !e.images[image] {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"no such image"}`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	case r.URL.Path == "/images/create":
+		image := r.URL.Query().Get("fromImage") + ":" + r.URL.Query().Get("tag")
+		e.pulled = append(e.pulled, image)
+		e.images[image] = true
+		w.Write([]byte(`{"status":"Pulling"}` + "\n" + `{"status":"Downloaded"}`))
+	case r.URL.Path == "/containers/create":
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		e.created = append(e.created, body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"Id":"c1"}`))
+	case r.URL.Path == "/containers/c1/start":
+		w.WriteHeader(http.StatusNoContent)
+	case r.URL.Path == "/containers/c1/logs":
+		for i, line := range e.logLines {
+			header := make([]byte, 8)
+			header[0] = byte(1 + i%2)
+			binary.BigEndian.PutUint32(header[4:], uint32(len(line)+1))
+			w.Write(header)
+			w.Write([]byte(line + "\n"))
+		}
+	case r.URL.Path == "/containers/c1/wait":
+		json.NewEncoder(w).Encode(map[string]int{"StatusCode": e.status})
+	case r.Method == "DELETE" && r.URL.Path == "/containers/c1":
+		e.removed = append(e.removed, "c1")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestContainerTask_Execute(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "engine.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := &testContainerEngine{
+		images:   map[string]bool{},
+		logLines: []string{"stdout line", "stderr line"},
+	}
+	server := httptest.NewUnstartedServer(engine)
+	server.Listener = l
+	server.Start()
+	defer server.Close()
+
+	buf := new(bytes.Buffer)
+	ct := NewContainerTask("alpine:3.6", "echo", "hello")
+	ct.Socket = socket
+	ct.Env = []string{"FOO=bar"}
+	ct.Volumes = []string{"/tmp:/data:ro"}
+	ct.Network = "host"
+	ct.SetLogger(log.New(buf, "", 0))
+	if err := ct.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(engine.pulled) != 1 || engine.pulled[0] != "alpine:3.6" {
+		t.Errorf("container: image is not pulled: %v", engine.pulled)
+	}
+	created := engine.created[0]
+	if created["Image"] != "alpine:3.6" || created["Env"].([]interface{})[0] != "FOO=bar" {
+		t.Errorf("container: invalid create request: %v", created)
+	}
+	hostConfig := created["HostConfig"].(map[string]interface{})
+	if hostConfig["NetworkMode"] != "host" || hostConfig["Binds"].([]interface{})[0] != "/tmp:/data:ro" {
+		t.Errorf("container: invalid host config: %v", hostConfig)
+	}
+	for _, line := range engine.logLines {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("container: log %q is not streamed into logger: %v", line, buf.String())
+		}
+	}
+	if len(engine.removed) != 1 {
+		t.Error("container: container is not removed")
+	}
+
+	// image already exists
+	engine.status = 2
+	if err := ct.Execute(); err == nil {
+		t.Error("expect to fail container but it succeeded")
+	} else if exitErr, ok := err.(*ContainerExitError); !ok || exitErr.StatusCode != 2 {
+		t.Errorf("container: expect exit status 2 but got: %v", err)
+	}
+	if len(engine.pulled) != 1 {
+		t.Errorf("container: image is pulled even though it exists: %v", engine.pulled)
+	}
+	if len(engine.removed) != 2 {
+		t.Error("container: failed container is not removed")
+	}
+
+	ct = NewContainerTask("busybox", "true")
+	ct.Socket = socket
+	ct.PullPolicy = PullNever
+	engine.status = 0
+	if err := ct.Execute(); err != nil {
+		t.Error(err)
+	}
+	if len(engine.pulled) != 1 {
+		t.Errorf("container: image is pulled with never policy: %v", engine.pulled)
+	}
+}
@@ -0,0 +1,222 @@
+package task
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JSONAssertion checks a value in json response.
+// Path is dot separated keys and [index], e.g. "items[0].name".
+// Expect nil only checks the value exists.
+type JSONAssertion struct {
+	Path   string
+	Expect interface{}
+}
+
+// HTTPTask sends http request and checks the response.
+type HTTPTask struct {
+	Method string
+	URL    string
+	Header http.Header
+
+	// Request body is read from one of Body, BodyFile or BodyFunc.
+	// BodyFunc is called on execution, so that it can read the result of earlier task.
+	Body     string
+	BodyFile string
+	BodyFunc func() ([]byte, error)
+
+	Timeout time.Duration
+
+	// CertFile and KeyFile are client certificate for TLS.
+	// CAFile is used to verify server certificate instead of system roots.
+	CertFile string
+	KeyFile  string
+	CAFile   string
+
+	// ExpectedStatus defaults to any 2xx status.
+	ExpectedStatus []int
+	Assertions     []JSONAssertion
+
+	// Response of the latest execution.
+	StatusCode     int
+	ResponseHeader http.Header
+	ResponseBody   []byte
+}
+
+// NewHTTPTask creates a http request task.
+func NewHTTPTask(method, url string) *HTTPTask {
+	return &HTTPTask{
+		Method: method,
+		URL:    url,
+		Header: make(http.Header),
+	}
+}
+
+// Execute implement Task.Execute.
+func (ht *HTTPTask) Execute() error {
+	body, err := ht.requestBody()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(ht.Method, ht.URL, body)
+	if err != nil {
+		return err
+	}
+	for k, v := range ht.Header {
+		req.Header[k] = v
+	}
+
+	client, err := ht.httpClient()
+	if err != nil {
+		return err
+	}
+	// the transport is built on each execution, so its connections must not be left open
+	defer client.CloseIdleConnections()
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	ht.StatusCode = res.StatusCode
+	ht.ResponseHeader = res.Header
+	ht.ResponseBody = b
+
+	if !ht.isExpectedStatus(res.StatusCode) {
+		return fmt.Errorf("cloudflow: http %v %v returns unexpected status:%v", ht.Method, ht.URL, res.StatusCode)
+	}
+	return ht.assertJSON(b)
+}
+
+func (ht *HTTPTask) requestBody() (io.Reader, error) {
+	switch {
+	case ht.BodyFunc != nil:
+		b, err := ht.BodyFunc()
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(b), nil
+	case ht.BodyFile != "":
+		b, err := ioutil.ReadFile(ht.BodyFile)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(b), nil
+	case ht.Body != "":
+		return strings.NewReader(ht.Body), nil
+	}
+	return nil, nil
+}
+
+func (ht *HTTPTask) httpClient() (*http.Client, error) {
+	config := &tls.Config{}
+	if ht.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(ht.CertFile, ht.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if ht.CAFile != "" {
+		pem, err := ioutil.ReadFile(ht.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("cloudflow: no certificate found in %v", ht.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	return &http.Client{
+		Timeout:   ht.Timeout,
+		Transport: &http.Transport{TLSClientConfig: config, Proxy: http.ProxyFromEnvironment},
+	}, nil
+}
+
+func (ht *HTTPTask) isExpectedStatus(code int) bool {
+	if len(ht.ExpectedStatus) == 0 {
+		return code >= 200 && code < 300
+	}
+	for _, c := range ht.ExpectedStatus {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (ht *HTTPTask) assertJSON(body []byte) error {
+	if len(ht.Assertions) == 0 {
+		return nil
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return fmt.Errorf("cloudflow: http response is not json: %v", err)
+	}
+	for _, a := range ht.Assertions {
+		v, ok := lookupJSONPath(doc, a.Path)
+		if !ok {
+			return fmt.Errorf("cloudflow: http response has no value at %v", a.Path)
+		}
+		if a.Expect == nil {
+			continue
+		}
+		// normalize expected value into json types
+		var expect interface{}
+		b, err := json.Marshal(a.Expect)
+		if err != nil {
+			return err
+		}
+		json.Unmarshal(b, &expect)
+		if !reflect.DeepEqual(v, expect) {
+			return fmt.Errorf("cloudflow: http response value at %v expect:%v got:%v", a.Path, expect, v)
+		}
+	}
+	return nil
+}
+
+func lookupJSONPath(doc interface{}, path string) (interface{}, bool) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	path = strings.Replace(path, "[", ".[", -1)
+
+	v := doc
+	for _, key := range strings.Split(path, ".") {
+		if key == "" {
+			continue
+		}
+		if strings.HasPrefix(key, "[") && strings.HasSuffix(key, "]") {
+			i, err := strconv.Atoi(key[1 : len(key)-1])
+			list, ok := v.([]interface{})
+			if err != nil || !ok || i < 0 || i >= len(list) {
+				return nil, false
+			}
+			v = list[i]
+			continue
+		}
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = obj[key]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
@@ -0,0 +1,207 @@
+package task
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHTTPTask_Execute(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Request-Token", r.Header.Get("X-Token"))
+		switch r.URL.Path {
+		case "/echo":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"method":"` + r.Method + `","body":"` + string(b) + `","items":[{"id":1},{"id":2}]}`))
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ht := NewHTTPTask("POST", server.URL+"/echo")
+	ht.Header.Set("X-Token", "secret")
+	ht.Body = "hello"
+	ht.Assertions = []JSONAssertion{
+		{Path: "$.method", Expect: "POST"},
+		{Path: "body", Expect: "hello"},
+		{Path: "items[1].id", Expect: 2},
+		{Path: "items[0]"},
+	}
+	if err := ht.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if ht.StatusCode != http.StatusOK || ht.ResponseHeader.Get("X-Request-Token") != "secret" {
+		t.Errorf("http: invalid response status:%v header:%v", ht.StatusCode, ht.ResponseHeader)
+	}
+
+	// body from file and from earlier task output
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodyFile := filepath.Join(dir, "body")
+	ioutil.WriteFile(bodyFile, []byte("from-file"), 0666)
+	ht2 := NewHTTPTask("PUT", server.URL+"/echo")
+	ht2.BodyFile = bodyFile
+	ht2.Assertions = []JSONAssertion{{Path: "body", Expect: "from-file"}}
+	if err := ht2.Execute(); err != nil {
+		t.Error(err)
+	}
+	ht3 := NewHTTPTask("PUT", server.URL+"/echo")
+	ht3.BodyFunc = func() ([]byte, error) { return []byte(ht.ResponseHeader.Get("X-Request-Token")), nil }
+	ht3.Assertions = []JSONAssertion{{Path: "body", Expect: "secret"}}
+	if err := ht3.Execute(); err != nil {
+		t.Error(err)
+	}
+
+	ht.Assertions = []JSONAssertion{{Path: "items[1].id", Expect: 3}}
+	if err := ht.Execute(); err == nil {
+		t.Error("expect to fail json assertion but it succeeded")
+	}
+	ht.Assertions = []JSONAssertion{{Path: "items[5]"}}
+	if err := ht.Execute(); err == nil {
+		t.Error("expect to fail json assertion but it succeeded")
+	}
+
+	notFound := NewHTTPTask("GET", server.URL+"/unknown")
+	if err := notFound.Execute(); err == nil {
+		t.Error("expect to fail by status but it succeeded")
+	}
+	notFound.ExpectedStatus = []int{http.StatusNotFound}
+	if err := notFound.Execute(); err != nil {
+		t.Error(err)
+	}
+
+	slow := NewHTTPTask("GET", server.URL+"/slow")
+	slow.Timeout = 10 * time.Millisecond
+	if err := slow.Execute(); err == nil {
+		t.Error("expect to time out but it succeeded")
+	}
+}
+
+func TestHTTPTask_CloseIdleConnections(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	open := 0
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch state {
+		case http.StateNew:
+			open++
+		case http.StateClosed, http.StateHijacked:
+			open--
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	ht := NewHTTPTask("GET", server.URL)
+	for i := 0; i < 3; i++ {
+		if err := ht.Execute(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; ; i++ {
+		mu.Lock()
+		n := open
+		mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("http: %d connections are left open", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHTTPTask_ExecuteTLS(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile, clientCert := writeTestClientCert(t, dir)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+
+	ht := NewHTTPTask("GET", server.URL)
+	ht.CAFile = caFile
+	if err := ht.Execute(); err == nil {
+		t.Error("expect to fail without client certificate but it succeeded")
+	}
+
+	ht.CertFile = certFile
+	ht.KeyFile = keyFile
+	if err := ht.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if string(ht.ResponseBody) != "cloudflow" {
+		t.Errorf("http: invalid response body expect:%v got:%v", "cloudflow", string(ht.ResponseBody))
+	}
+}
+
+func writeTestClientCert(t *testing.T, dir string) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "cloudflow"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile, cert
+}
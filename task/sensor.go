@@ -0,0 +1,135 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+var defaultSensorTimeout = 30 * time.Minute
+var defaultSensorPollingTime = 30 * time.Second
+
+// ErrSensorTimeout is returned when the sensor condition is not satisfied within timeout.
+var ErrSensorTimeout = errors.New("cloudflow: sensor timed out")
+
+// PokeFunc checks the sensor condition.
+// Returning done finishes the sensor, returning error fails it.
+type PokeFunc func(ctx context.Context) (done bool, err error)
+
+// SensorTask waits until the condition checked by Poke is satisfied.
+type SensorTask struct {
+	Poke        PokeFunc
+	PollingTime time.Duration
+	Timeout     time.Duration
+
+	// Backoff multiplies polling time after each poke up to MaxPollingTime.
+	// Backoff less than or equal to 1 polls at constant interval.
+	Backoff        float64
+	MaxPollingTime time.Duration
+}
+
+// NewSensorTask creates a sensor task.
+func NewSensorTask(poke PokeFunc) *SensorTask {
+	return &SensorTask{
+		Poke:        poke,
+		PollingTime: defaultSensorPollingTime,
+		Timeout:     defaultSensorTimeout,
+	}
+}
+
+// Execute implement Task.Execute.
+func (st *SensorTask) Execute() error {
+	return st.ExecuteContext(context.Background())
+}
+
+// ExecuteContext implement ContextTask.ExecuteContext.
+// It returns ErrSensorTimeout when Timeout is elapsed.
+func (st *SensorTask) ExecuteContext(ctx context.Context) error {
+	parent := ctx
+	if st.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, st.Timeout)
+		defer cancel()
+	}
+
+	interval := st.PollingTime
+	for {
+		done, err := st.Poke(ctx)
+		if err != nil {
+			if ctx.Err() != nil && parent.Err() == nil {
+				return ErrSensorTimeout
+			}
+			return err
+		}
+		if done {
+			return nil
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			if parent.Err() != nil {
+				return parent.Err()
+			}
+			return ErrSensorTimeout
+		case <-timer.C:
+		}
+		interval = st.nextPollingTime(interval)
+	}
+}
+
+func (st *SensorTask) nextPollingTime(interval time.Duration) time.Duration {
+	if st.Backoff <= 1 {
+		return interval
+	}
+	next := time.Duration(float64(interval) * st.Backoff)
+	if st.MaxPollingTime > 0 && next > st.MaxPollingTime {
+		return st.MaxPollingTime
+	}
+	return next
+}
+
+// NewFileSensor creates a sensor task waiting for the file to exist.
+func NewFileSensor(path string) *SensorTask {
+	return NewSensorTask(func(ctx context.Context) (bool, error) {
+		_, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+}
+
+// NewHTTPSensor creates a sensor task waiting for the url to return 200.
+func NewHTTPSensor(url string) *SensorTask {
+	return NewSensorTask(func(ctx context.Context) (bool, error) {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return false, err
+		}
+		res, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			// the endpoint may not be up yet
+			return false, nil
+		}
+		res.Body.Close()
+		return res.StatusCode == http.StatusOK, nil
+	})
+}
+
+// NewTCPSensor creates a sensor task waiting for the tcp port to open.
+func NewTCPSensor(addr string) *SensorTask {
+	return NewSensorTask(func(ctx context.Context) (bool, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return false, nil
+		}
+		conn.Close()
+		return true, nil
+	})
+}
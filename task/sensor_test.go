@@ -0,0 +1,146 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSensorTask_Execute(t *testing.T) {
+	t.Parallel()
+
+	pokes := 0
+	st := NewSensorTask(func(ctx context.Context) (bool, error) {
+		pokes++
+		return pokes == 3, nil
+	})
+	st.PollingTime = time.Millisecond
+	if err := st.Execute(); err != nil {
+		t.Error(err)
+	}
+	if pokes != 3 {
+		t.Errorf("sensor: incorrect poke count expect:%v got:%v", 3, pokes)
+	}
+
+	st = NewSensorTask(func(ctx context.Context) (bool, error) {
+		return false, nil
+	})
+	st.PollingTime = time.Millisecond
+	st.Timeout = 20 * time.Millisecond
+	if err := st.Execute(); err != ErrSensorTimeout {
+		t.Errorf("sensor: expect to time out but got: %v", err)
+	}
+
+	pokeErr := errors.New("poke error")
+	st = NewSensorTask(func(ctx context.Context) (bool, error) {
+		return false, pokeErr
+	})
+	if err := st.Execute(); err != pokeErr {
+		t.Errorf("sensor: expect poke error but got: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	st = NewSensorTask(func(ctx context.Context) (bool, error) {
+		cancel()
+		return false, nil
+	})
+	if err := st.ExecuteContext(ctx); err != context.Canceled {
+		t.Errorf("sensor: expect to be cancelled but got: %v", err)
+	}
+}
+
+func TestSensorTask_Backoff(t *testing.T) {
+	t.Parallel()
+
+	st := NewSensorTask(nil)
+	st.PollingTime = time.Second
+	if st.nextPollingTime(time.Second) != time.Second {
+		t.Error("sensor: polling time changes without backoff")
+	}
+
+	st.Backoff = 2
+	st.MaxPollingTime = 5 * time.Second
+	tests := []time.Duration{2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	interval := st.PollingTime
+	for _, test := range tests {
+		interval = st.nextPollingTime(interval)
+		if interval != test {
+			t.Errorf("sensor: invalid polling time expect:%v got:%v", test, interval)
+		}
+	}
+}
+
+func TestFileSensor(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, "_SUCCESS")
+
+	st := NewFileSensor(p)
+	st.PollingTime = time.Millisecond
+	st.Timeout = 10 * time.Millisecond
+	if err := st.Execute(); err != ErrSensorTimeout {
+		t.Errorf("sensor: expect to time out but got: %v", err)
+	}
+
+	ioutil.WriteFile(p, []byte{}, 0666)
+	if err := st.Execute(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHTTPSensor(t *testing.T) {
+	t.Parallel()
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	st := NewHTTPSensor(server.URL)
+	st.PollingTime = time.Millisecond
+	if err := st.Execute(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTCPSensor(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	st := NewTCPSensor(addr)
+	st.PollingTime = time.Millisecond
+	st.Timeout = 10 * time.Millisecond
+	if err := st.Execute(); err != ErrSensorTimeout {
+		t.Errorf("sensor: expect to time out but got: %v", err)
+	}
+
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	st.Timeout = time.Second
+	if err := st.Execute(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,248 @@
+package task
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSHHost represents a ssh server and how to authenticate on it.
+type SSHHost struct {
+	// Addr is host:port of the ssh server.
+	Addr string
+	User string
+
+	// PrivateKeyFile is a path of the private key used for authentication.
+	PrivateKeyFile string
+
+	// UseAgent authenticates with the keys of ssh-agent.
+	// AgentSocket defaults to $SSH_AUTH_SOCK.
+	UseAgent    bool
+	AgentSocket string
+}
+
+// SSHFile represents a file transferred between local and remote host.
+type SSHFile struct {
+	Local  string
+	Remote string
+}
+
+// SSHCommandTask executes command on remote host over ssh.
+type SSHCommandTask struct {
+	Host    *SSHHost
+	Command string
+
+	// JumpHost is used to reach Host when set.
+	JumpHost *SSHHost
+
+	// KnownHostsFile defaults to ~/.ssh/known_hosts.
+	// InsecureIgnoreHostKey disables host key checking.
+	KnownHostsFile        string
+	InsecureIgnoreHostKey bool
+
+	// Uploads are copied to remote host before command.
+	// Downloads are copied from remote host after command succeeded.
+	Uploads   []SSHFile
+	Downloads []SSHFile
+
+	// Stdout and Stderr receive the command output when set.
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// NewSSHCommandTask creates a ssh command task.
+func NewSSHCommandTask(host *SSHHost, command string) *SSHCommandTask {
+	return &SSHCommandTask{Host: host, Command: command}
+}
+
+// Execute implement Task.Execute.
+// It returns *ssh.ExitError when the command exits with non-zero status.
+func (st *SSHCommandTask) Execute() error {
+	client, err := st.dial()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	for _, f := range st.Uploads {
+		if err := uploadFile(client, f); err != nil {
+			return fmt.Errorf("cloudflow: ssh upload %v failed: %v", f.Local, err)
+		}
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	session.Stdout = st.Stdout
+	session.Stderr = st.Stderr
+	if err := session.Run(st.Command); err != nil {
+		return err
+	}
+
+	for _, f := range st.Downloads {
+		if err := downloadFile(client, f); err != nil {
+			return fmt.Errorf("cloudflow: ssh download %v failed: %v", f.Remote, err)
+		}
+	}
+	return nil
+}
+
+func (st *SSHCommandTask) dial() (*ssh.Client, error) {
+	hostKeyCallback, err := st.hostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+
+	config, closeAgent, err := st.Host.clientConfig(hostKeyCallback)
+	if err != nil {
+		return nil, err
+	}
+	defer closeAgent()
+
+	if st.JumpHost == nil {
+		return ssh.Dial("tcp", st.Host.Addr, config)
+	}
+
+	jumpConfig, closeJumpAgent, err := st.JumpHost.clientConfig(hostKeyCallback)
+	if err != nil {
+		return nil, err
+	}
+	defer closeJumpAgent()
+
+	jump, err := ssh.Dial("tcp", st.JumpHost.Addr, jumpConfig)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := jump.Dial("tcp", st.Host.Addr)
+	if err != nil {
+		jump.Close()
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, st.Host.Addr, config)
+	if err != nil {
+		conn.Close()
+		jump.Close()
+		return nil, err
+	}
+
+	client := ssh.NewClient(c, chans, reqs)
+	go func() {
+		client.Wait()
+		jump.Close()
+	}()
+	return client, nil
+}
+
+func (st *SSHCommandTask) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	if st.InsecureIgnoreHostKey {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	file := st.KnownHostsFile
+	if file == "" {
+		file = filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+	}
+	return knownhosts.New(file)
+}
+
+func (h *SSHHost) clientConfig(hostKeyCallback ssh.HostKeyCallback) (*ssh.ClientConfig, func(), error) {
+	auths := make([]ssh.AuthMethod, 0)
+	closeAgent := func() {}
+
+	if h.PrivateKeyFile != "" {
+		key, err := ioutil.ReadFile(h.PrivateKeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		auths = append(auths, ssh.PublicKeys(signer))
+	}
+
+	if h.UseAgent {
+		socket := h.AgentSocket
+		if socket == "" {
+			socket = os.Getenv("SSH_AUTH_SOCK")
+		}
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cloudflow: ssh agent is not available: %v", err)
+		}
+		closeAgent = func() { conn.Close() }
+		auths = append(auths, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	}
+
+	return &ssh.ClientConfig{
+		User:            h.User,
+		Auth:            auths,
+		HostKeyCallback: hostKeyCallback,
+	}, closeAgent, nil
+}
+
+func uploadFile(client *ssh.Client, f SSHFile) error {
+	file, err := os.Open(f.Local)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	session.Stdin = file
+	return session.Run("cat > " + shellQuote(f.Remote))
+}
+
+// downloadFile writes the remote file into a temporary file next to f.Local,
+// and renames it only after the download succeeded so that a failed download keeps the local file.
+func downloadFile(client *ssh.Client, f SSHFile) error {
+	file, err := ioutil.TempFile(filepath.Dir(f.Local), "."+filepath.Base(f.Local)+".")
+	if err != nil {
+		return err
+	}
+	tmp := file.Name()
+	defer os.Remove(tmp)
+
+	session, err := client.NewSession()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	defer session.Close()
+
+	session.Stdout = file
+	err = session.Run("cat " + shellQuote(f.Remote))
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(f.Local); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := os.Chmod(tmp, mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.Local)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
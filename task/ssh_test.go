@@ -0,0 +1,275 @@
+package task
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSSHServer is an in-process ssh server which runs exec requests by local shell.
+type testSSHServer struct {
+	addr     string
+	hostKey  ssh.Signer
+	listener net.Listener
+}
+
+func newTestSSHServer(t *testing.T, authorized ssh.PublicKey) *testSSHServer {
+	hostKey := newTestSSHKey(t)
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSSHConn(conn, config)
+		}
+	}()
+
+	return &testSSHServer{addr: l.Addr().String(), hostKey: signer, listener: l}
+}
+
+func serveTestSSHConn(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for nc := range chans {
+		switch nc.ChannelType() {
+		case "session":
+			ch, reqs, err := nc.Accept()
+			if err != nil {
+				continue
+			}
+			go serveTestSSHSession(ch, reqs)
+		case "direct-tcpip":
+			var target struct {
+				Host     string
+				Port     uint32
+				OrigHost string
+				OrigPort uint32
+			}
+			if err := ssh.Unmarshal(nc.ExtraData(), &target); err != nil {
+				nc.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			dst, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+			if err != nil {
+				nc.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			ch, reqs, err := nc.Accept()
+			if err != nil {
+				dst.Close()
+				continue
+			}
+			go ssh.DiscardRequests(reqs)
+			go func() {
+				io.Copy(ch, dst)
+				ch.Close()
+			}()
+			go func() {
+				io.Copy(dst, ch)
+				dst.Close()
+			}()
+		default:
+			nc.Reject(ssh.UnknownChannelType, "unsupported")
+		}
+	}
+}
+
+func serveTestSSHSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	for req := range reqs {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+		var payload struct{ Command string }
+		ssh.Unmarshal(req.Payload, &payload)
+		req.Reply(true, nil)
+
+		cmd := exec.Command("sh", "-c", payload.Command)
+		cmd.Stdin = ch
+		cmd.Stdout = ch
+		cmd.Stderr = ch.Stderr()
+		status := 0
+		if err := cmd.Run(); err != nil {
+			status = 255
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				status = exitErr.ExitCode()
+			}
+		}
+		ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+		return
+	}
+}
+
+func newTestSSHKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func writeTestKnownHosts(t *testing.T, dir, addr string, key ssh.PublicKey) string {
+	p := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, key)
+	if err := ioutil.WriteFile(p, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestSSHCommandTask_Execute(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientKey := newTestSSHKey(t)
+	der, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_ecdsa")
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	clientSigner, err := ssh.NewSignerFromKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newTestSSHServer(t, clientSigner.PublicKey())
+	defer server.listener.Close()
+	knownHosts := writeTestKnownHosts(t, dir, server.addr, server.hostKey.PublicKey())
+
+	host := &SSHHost{Addr: server.addr, User: "cloudflow", PrivateKeyFile: keyFile}
+
+	stdout := new(bytes.Buffer)
+	st := NewSSHCommandTask(host, "echo hello")
+	st.KnownHostsFile = knownHosts
+	st.Stdout = stdout
+	if err := st.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "hello\n" {
+		t.Errorf("ssh: invalid output expect:%q got:%q", "hello\n", stdout.String())
+	}
+
+	st = NewSSHCommandTask(host, "exit 3")
+	st.KnownHostsFile = knownHosts
+	err = st.Execute()
+	if exitErr, ok := err.(*ssh.ExitError); !ok || exitErr.ExitStatus() != 3 {
+		t.Errorf("ssh: expect to exit with status 3 but got: %v", err)
+	}
+
+	// upload, run and download through jump host
+	ioutil.WriteFile(filepath.Join(dir, "input"), []byte("cloudflow"), 0666)
+	remoteIn := filepath.Join(dir, "remote input")
+	remoteOut := filepath.Join(dir, "remote output")
+	st = NewSSHCommandTask(host, "tr a-z A-Z < '"+remoteIn+"' > '"+remoteOut+"'")
+	st.JumpHost = host
+	st.KnownHostsFile = knownHosts
+	st.Uploads = []SSHFile{{Local: filepath.Join(dir, "input"), Remote: remoteIn}}
+	st.Downloads = []SSHFile{{Local: filepath.Join(dir, "output"), Remote: remoteOut}}
+	if err := st.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "output")); string(b) != "CLOUDFLOW" {
+		t.Errorf("ssh: invalid downloaded file expect:%q got:%q", "CLOUDFLOW", string(b))
+	}
+
+	// failed download keeps the local file
+	st = NewSSHCommandTask(host, "true")
+	st.KnownHostsFile = knownHosts
+	st.Downloads = []SSHFile{{Local: filepath.Join(dir, "output"), Remote: filepath.Join(dir, "missing")}}
+	if err := st.Execute(); err == nil {
+		t.Error("ssh: download of missing file must be error")
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "output")); string(b) != "CLOUDFLOW" {
+		t.Errorf("ssh: failed download must keep the local file but got:%q", string(b))
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, ".output.*")); len(matches) > 0 {
+		t.Errorf("ssh: temporary files must be removed: %v", matches)
+	}
+
+	// authenticate by ssh-agent
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: clientKey}); err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "agent.sock")
+	al, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer al.Close()
+	go func() {
+		for {
+			conn, err := al.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+
+	st = NewSSHCommandTask(&SSHHost{Addr: server.addr, User: "cloudflow", UseAgent: true, AgentSocket: socket}, "true")
+	st.KnownHostsFile = knownHosts
+	if err := st.Execute(); err != nil {
+		t.Error(err)
+	}
+
+	// unknown host key
+	otherKey, err := ssh.NewSignerFromKey(newTestSSHKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st = NewSSHCommandTask(host, "true")
+	otherDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.KnownHostsFile = writeTestKnownHosts(t, otherDir, server.addr, otherKey.PublicKey())
+	if err := st.Execute(); err == nil {
+		t.Error("expect to fail host key checking but it succeeded")
+	}
+}
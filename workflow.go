@@ -1,6 +1,7 @@
 package cloudflow
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"strings"
@@ -13,6 +14,7 @@ import (
 type Workflow struct {
 	tasks  []*namedTask
 	logger *log.Logger
+	params map[string]string
 }
 
 // NewWorkflow creates a new workflow definition.
@@ -20,14 +22,23 @@ func NewWorkflow() *Workflow {
 	return &Workflow{
 		tasks:  make([]*namedTask, 0),
 		logger: log.New(os.Stdout, "[cloudflow] ", log.Ldate|log.Ltime|log.Lshortfile),
+		params: make(map[string]string),
 	}
 }
 
 // SetLogger sets log writer.
+// Tasks which have SetLogger method also write into this logger,
+// unless their Logger field is already set.
 func (wf *Workflow) SetLogger(logger *log.Logger) {
 	wf.logger = logger
 }
 
+// SetParam sets default value of workflow parameter.
+// Parameters given by the context of RunContext take precedence over defaults.
+func (wf *Workflow) SetParam(name, value string) {
+	wf.params[name] = value
+}
+
 // AddTask add task with name.
 func (wf *Workflow) AddTask(name string, task Task) {
 	wf.tasks = append(wf.tasks, &namedTask{name: name, task: task})
@@ -39,16 +50,32 @@ func (wf *Workflow) Execute() error {
 	return wf.Run()
 }
 
+// ExecuteContext implement ContextTask.ExecuteContext.
+func (wf *Workflow) ExecuteContext(ctx context.Context) error {
+	return wf.RunContext(ctx)
+}
+
 // Run defined workflow tasks.
 func (wf *Workflow) Run() error {
-	return wf.run(wf.tasks)
+	return wf.RunContext(context.Background())
+}
+
+// RunContext runs defined workflow tasks until ctx is cancelled.
+// Tasks implementing ContextTask receive ctx carrying the workflow parameters.
+func (wf *Workflow) RunContext(ctx context.Context) error {
+	return wf.run(ctx, wf.tasks)
 }
 
 // RunFrom runs workflow from task specified.
 func (wf *Workflow) RunFrom(name string) error {
+	return wf.RunFromContext(context.Background(), name)
+}
+
+// RunFromContext runs workflow from task specified until ctx is cancelled.
+func (wf *Workflow) RunFromContext(ctx context.Context, name string) error {
 	for i, t := range wf.tasks {
 		if name == t.name {
-			return wf.run(wf.tasks[i:])
+			return wf.run(ctx, wf.tasks[i:])
 		}
 	}
 	return fmt.Errorf("workflow: task %v not found in: %v", name, wf.Summary())
@@ -56,18 +83,36 @@ func (wf *Workflow) RunFrom(name string) error {
 
 // RunOnly runs workflow only task specified.
 func (wf *Workflow) RunOnly(name string) error {
+	return wf.RunOnlyContext(context.Background(), name)
+}
+
+// RunOnlyContext runs workflow only task specified until ctx is cancelled.
+func (wf *Workflow) RunOnlyContext(ctx context.Context, name string) error {
 	for i, t := range wf.tasks {
 		if name == t.name {
-			return wf.run(wf.tasks[i : i+1])
+			return wf.run(ctx, wf.tasks[i:i+1])
 		}
 	}
 	return fmt.Errorf("workflow: task %v not found in: %v", name, wf.Summary())
 }
 
-func (wf *Workflow) run(tasks []*namedTask) error {
+func (wf *Workflow) run(ctx context.Context, tasks []*namedTask) error {
+	params := ParamsFromContext(ctx)
+	if params == nil {
+		params = NewParams(nil)
+		ctx = WithParams(ctx, params)
+	}
+	for name, value := range wf.params {
+		params.setDefault(name, value)
+	}
+
 	for i, t := range tasks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		wf.logger.Print(fmt.Sprintf("workflow: Start task: %v", tasks[i].name))
-		if err := t.task.Execute(); err != nil {
+		setTaskLogger(t.task, wf.logger)
+		if err := executeTask(ctx, t.task); err != nil {
 			return err
 		}
 		wf.logger.Print(fmt.Sprintf("workflow: Complete task: %v", tasks[i].name))
@@ -2,7 +2,11 @@ package cloudflow
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"io/ioutil"
+	"log"
+	"strings"
 	"testing"
 )
 
@@ -249,3 +253,197 @@ func TestWorkflow_Summary(t *testing.T) {
 		t.Errorf("workflow summary \ngot:   %v\nexpect:%v", wf.Summary(), expect)
 	}
 }
+
+type loggingTask struct {
+	logger *log.Logger
+}
+
+func (t *loggingTask) SetLogger(logger *log.Logger) {
+	t.logger = logger
+}
+
+func (t *loggingTask) Execute() error {
+	t.logger.Print("logging task")
+	return nil
+}
+
+func TestWorkflow_SetLogger(t *testing.T) {
+	t.Parallel()
+
+	buf := bytes.NewBufferString("")
+	logger := log.New(buf, "", 0)
+
+	wf := NewWorkflow()
+	wf.SetLogger(logger)
+	a := &loggingTask{}
+	wf.AddTask("a", a)
+	pt := NewParallelTask()
+	b := &loggingTask{}
+	pt.AddTask("b", b)
+	wf.AddTask("parallel", pt)
+	if err := wf.Run(); err != nil {
+		t.Error(err)
+	}
+
+	if a.logger != logger || b.logger != logger {
+		t.Error("workflow: logger is not passed to tasks")
+	}
+	if strings.Count(buf.String(), "logging task") != 2 {
+		t.Errorf("workflow: task logs are not written into workflow logger: %v", buf.String())
+	}
+
+	own := log.New(ioutil.Discard, "", 0)
+	c := &ownLoggingTask{Logger: own}
+	wf.AddTask("c", c)
+	if err := wf.Run(); err != nil {
+		t.Error(err)
+	}
+	if c.Logger != own {
+		t.Error("workflow: logger set to task is overwritten")
+	}
+}
+
+type ownLoggingTask struct {
+	Logger *log.Logger
+}
+
+func (t *ownLoggingTask) SetLogger(logger *log.Logger) {
+	t.Logger = logger
+}
+
+func (t *ownLoggingTask) Execute() error {
+	t.Logger.Print("own logging task")
+	return nil
+}
+
+type contextTask struct {
+	ctx context.Context
+}
+
+func (t *contextTask) Execute() error {
+	return errors.New("contextTask must be executed with context")
+}
+
+func (t *contextTask) ExecuteContext(ctx context.Context) error {
+	t.ctx = ctx
+	return nil
+}
+
+func TestWorkflow_RunContext(t *testing.T) {
+	t.Parallel()
+
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, "value")
+
+	wf := NewWorkflow()
+	a := &contextTask{}
+	wf.AddTask("a", a)
+	pt := NewParallelTask()
+	b := &contextTask{}
+	pt.AddTask("b", b)
+	wf.AddTask("parallel", pt)
+	if err := wf.RunContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if a.ctx.Value(key{}) != "value" || b.ctx.Value(key{}) != "value" {
+		t.Error("workflow: context is not passed to tasks")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c := &contextTask{}
+	wf = NewWorkflow()
+	wf.AddTask("c", c)
+	if err := wf.RunContext(ctx); err != context.Canceled {
+		t.Errorf("workflow: expect to be cancelled but got: %v", err)
+	}
+	if c.ctx != nil {
+		t.Error("workflow: task is executed after cancelled")
+	}
+}
+
+func TestWorkflow_RunFromContext(t *testing.T) {
+	t.Parallel()
+
+	wf := NewWorkflow()
+	a, b, c := &paramTask{}, &paramTask{}, &paramTask{}
+	wf.AddTask("a", a)
+	wf.AddTask("b", b)
+	wf.AddTask("c", c)
+
+	ctx := WithParams(context.Background(), NewParams(map[string]string{"date": "2017-03-01"}))
+	if err := wf.RunFromContext(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if a.value != "" || b.value != "2017-03-01" || c.value != "2017-03-01" {
+		t.Errorf("workflow: params are not passed from the task: %v %v %v", a.value, b.value, c.value)
+	}
+
+	b.value, c.value = "", ""
+	ctx = WithParams(context.Background(), NewParams(map[string]string{"date": "2017-03-02"}))
+	if err := wf.RunOnlyContext(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if b.value != "2017-03-02" || c.value != "" {
+		t.Errorf("workflow: params are not passed only to the task: %v %v", b.value, c.value)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := wf.RunFromContext(ctx, "a"); err != context.Canceled {
+		t.Errorf("workflow: expect to be cancelled but got: %v", err)
+	}
+	if err := wf.RunOnlyContext(ctx, "a"); err != context.Canceled {
+		t.Errorf("workflow: expect to be cancelled but got: %v", err)
+	}
+}
+
+type paramTask struct {
+	set   string
+	value string
+}
+
+func (t *paramTask) Execute() error {
+	return errors.New("paramTask must be executed with context")
+}
+
+func (t *paramTask) ExecuteContext(ctx context.Context) error {
+	params := ParamsFromContext(ctx)
+	t.value, _ = params.Get("date")
+	if t.set != "" {
+		params.Set("date", t.set)
+	}
+	return nil
+}
+
+func TestWorkflow_Params(t *testing.T) {
+	t.Parallel()
+
+	wf := NewWorkflow()
+	wf.SetParam("date", "2017-01-01")
+	a := &paramTask{set: "2017-01-02"}
+	wf.AddTask("a", a)
+	nested := NewWorkflow()
+	nested.SetParam("date", "nested default")
+	b := &paramTask{}
+	nested.AddTask("b", b)
+	wf.AddTask("nested", nested)
+	if err := wf.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if a.value != "2017-01-01" {
+		t.Errorf("workflow: default param is not passed: %v", a.value)
+	}
+	if b.value != "2017-01-02" {
+		t.Errorf("workflow: param set by task is not passed to later tasks: %v", b.value)
+	}
+
+	ctx := WithParams(context.Background(), NewParams(map[string]string{"date": "2017-02-01"}))
+	a.set = ""
+	if err := wf.RunContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if a.value != "2017-02-01" {
+		t.Errorf("workflow: param of context must take precedence over default: %v", a.value)
+	}
+}